@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	irc "github.com/thoj/go-ircevent"
+)
+
+const (
+	// metricDiameter is the largest number of hops between any two servers
+	metricDiameter = "diameter"
+	// metricServers is how many servers are in the graph
+	metricServers = "servers"
+	// metricServersLost is how many fewer servers there are than when the rule last stopped firing
+	metricServersLost = "servers_lost"
+	// metricHopsFrom is the largest number of hops from the rule's From server to any other
+	metricHopsFrom = "hops_from"
+)
+
+var (
+	alertMetrics   = []string{metricDiameter, metricServers, metricServersLost, metricHopsFrom}
+	alertOperators = []string{">", ">=", "<", "<=", "==", "!="}
+)
+
+type alertsConfig struct {
+	// Channels get alerts from rules that do not list their own
+	Channels []string `toml:"channels"`
+	// Cooldown is the default for how soon a rule may fire again after it last fired
+	Cooldown time.Duration `toml:"cooldown"`
+	Rules    []alertRule   `toml:"rules"`
+}
+
+// alertRule fires when Metric compared to Threshold with Op is true after a refresh, and resolves once it is not
+type alertRule struct {
+	Name      string   `toml:"name"`
+	Metric    string   `toml:"metric"`
+	From      string   `toml:"from"`
+	Op        string   `toml:"op"`
+	Threshold int      `toml:"threshold"`
+	Channels  []string `toml:"channels"`
+	// Networks limits the rule to the named networks
+	Networks []string `toml:"networks"`
+	// Cooldown overrides alerts.cooldown for this rule
+	Cooldown time.Duration `toml:"cooldown"`
+}
+
+func (r alertRule) String() string {
+	if r.Metric == metricHopsFrom {
+		return fmt.Sprintf("%s %s %s %d", r.Metric, r.From, r.Op, r.Threshold)
+	}
+
+	return fmt.Sprintf("%s %s %d", r.Metric, r.Op, r.Threshold)
+}
+
+func (r alertRule) validate() error {
+	switch {
+	case r.Name == "":
+		return fmt.Errorf("rules need a name")
+	case !stringSliceContains(r.Metric, alertMetrics):
+		return fmt.Errorf("unknown metric %q, use one of %s", r.Metric, strings.Join(alertMetrics, ", "))
+	case !stringSliceContains(r.Op, alertOperators):
+		return fmt.Errorf("unknown op %q, use one of %s", r.Op, strings.Join(alertOperators, " "))
+	case r.Metric == metricHopsFrom && r.From == "":
+		return fmt.Errorf("%s needs from", metricHopsFrom)
+	case r.Cooldown < 0:
+		return fmt.Errorf("cooldown cannot be negative")
+	}
+
+	return nil
+}
+
+func (c alertsConfig) validate() error {
+	if c.Cooldown < 0 {
+		return fmt.Errorf("cooldown cannot be negative")
+	}
+
+	names := make(map[string]bool)
+	for i, r := range c.Rules {
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("rules[%d]: %w", i, err)
+		}
+
+		if names[r.Name] {
+			return fmt.Errorf("rules[%d]: more than one rule is called %q", i, r.Name)
+		}
+
+		if len(r.Channels) == 0 && len(c.Channels) == 0 {
+			return fmt.Errorf("rules[%d] (%s) has no channels to alert, and neither does alerts.channels", i, r.Name)
+		}
+
+		names[r.Name] = true
+	}
+
+	return nil
+}
+
+func (r alertRule) appliesTo(network string) bool {
+	return len(r.Networks) == 0 || stringSliceContains(network, r.Networks)
+}
+
+func (r alertRule) compare(value int) bool {
+	switch r.Op {
+	case ">":
+		return value > r.Threshold
+	case ">=":
+		return value >= r.Threshold
+	case "<":
+		return value < r.Threshold
+	case "<=":
+		return value <= r.Threshold
+	case "==":
+		return value == r.Threshold
+	}
+
+	return value != r.Threshold
+}
+
+// alertState is what is remembered about a rule on one network between refreshes
+type alertState struct {
+	Firing bool `json:"firing"`
+	// Announced is whether the current firing was sent, rather than held back by the cooldown
+	Announced bool      `json:"announced"`
+	LastFired time.Time `json:"last_fired,omitempty"`
+	Value     int       `json:"value"`
+	Detail    string    `json:"detail,omitempty"`
+	// baseline is the server count servers_lost is measured from, taken from a graph built from source when the rule
+	// was first checked against it or last resolved
+	baseline int
+	source   string
+}
+
+// alerter evaluates the alert rules after every refresh
+type alerter struct {
+	cfg alertsConfig
+
+	mu     sync.Mutex
+	states map[string]map[string]*alertState // network, then rule name
+}
+
+func newAlerter(cfg alertsConfig) *alerter {
+	return &alerter{cfg: cfg, states: make(map[string]map[string]*alertState)}
+}
+
+func (a *alerter) state(network, rule string) *alertState {
+	if a.states[network] == nil {
+		a.states[network] = make(map[string]*alertState)
+	}
+
+	st, exists := a.states[network][rule]
+	if !exists {
+		st = &alertState{baseline: -1}
+		a.states[network][rule] = st
+	}
+
+	return st
+}
+
+// measure returns the value of r's metric in the snapshot, with a description of it. ok is false if the metric
+// could not be measured.
+func (r alertRule) measure(cur *snapshot, st *alertState) (value int, detail string, ok bool) {
+	g, t := cur.graph, cur.topology()
+	switch r.Metric {
+	case metricDiameter:
+		d, one, two := t.diameter(nil)
+		if one == nil {
+			return 0, "", false
+		}
+
+		return d, fmt.Sprintf("diameter is %d, from %s to %s", d, one.Name, two.Name), true
+
+	case metricServers:
+		return len(g), fmt.Sprintf("%d servers", len(g)), true
+
+	case metricServersLost:
+		if st.baseline < 0 {
+			return 0, "", false
+		}
+
+		lost := st.baseline - len(g)
+		return lost, fmt.Sprintf("%d servers, down %d from %d", len(g), lost, st.baseline), true
+
+	case metricHopsFrom:
+		from := t.getServer(r.From)
+		if from == nil {
+			return 0, "", false
+		}
+
+		hops, far := t.largestDistanceFrom(from, nil)
+		if far == nil {
+			return 0, "", false
+		}
+
+		return hops, fmt.Sprintf("%s is %d hops from %s", far.Name, hops, from.Name), true
+	}
+
+	return 0, "", false
+}
+
+// evaluate checks every rule against cur and returns the messages to send, by channel
+func (a *alerter) evaluate(network string, cur *snapshot) map[string][]string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	out := make(map[string][]string)
+	send := func(r alertRule, line string) {
+		channels := r.Channels
+		if len(channels) == 0 {
+			channels = a.cfg.Channels
+		}
+
+		for _, c := range channels {
+			out[c] = append(out[c], line)
+		}
+	}
+
+	for _, r := range a.cfg.Rules {
+		if !r.appliesTo(network) {
+			continue
+		}
+
+		st := a.state(network, r.Name)
+		if st.source != cur.Source {
+			// Sources rarely agree on how many servers there are
+			st.baseline, st.source = -1, cur.Source
+		}
+
+		value, detail, ok := r.measure(cur, st)
+		if !ok {
+			// A metric that cannot be measured, such as a hub that is missing, says nothing either way
+			if st.baseline < 0 {
+				st.baseline = len(cur.graph)
+			}
+
+			continue
+		}
+
+		st.Value, st.Detail = value, detail
+		firing := r.compare(value)
+		cooldown := r.Cooldown
+		if cooldown == 0 {
+			cooldown = a.cfg.Cooldown
+		}
+
+		switch {
+		case firing && !st.Firing:
+			st.Firing = true
+			st.Announced = time.Since(st.LastFired) >= cooldown
+			if st.Announced {
+				st.LastFired = cur.Taken
+				send(r, fmt.Sprintf("Alert %s firing on %s: %s (%s)", r.Name, network, detail, r))
+			}
+
+		case !firing && st.Firing:
+			st.Firing = false
+			if st.Announced {
+				send(r, fmt.Sprintf("Alert %s resolved on %s: %s", r.Name, network, detail))
+			}
+
+			// Loss is counted again from here. Moving the baseline on every quiet refresh would hide servers
+			// leaving a few at a time.
+			st.baseline = len(cur.graph)
+		}
+	}
+
+	return out
+}
+
+// alertHook returns the snapshot hook that evaluates the alert rules for n
+func (b *bot) alertHook(n *network) snapshotHook {
+	return func(_, cur *snapshot) {
+		for channel, lines := range b.alerts.evaluate(n.name, cur) {
+			// Sending is rate limited, which must not hold up whoever built the graph
+			go n.output.send(channel, lines)
+		}
+	}
+}
+
+type alertStatus struct {
+	Rule    string `json:"rule"`
+	Name    string `json:"name"`
+	Network string `json:"network"`
+	alertState
+}
+
+// listAlerts shows every rule that applies to n and whether it is firing
+func (b *bot) listAlerts(n *network, _ *irc.Event, _ *commandArgs) *commandResult {
+	b.alerts.mu.Lock()
+	defer b.alerts.mu.Unlock()
+
+	data := []alertStatus{}
+	lines := []string{}
+	for _, r := range b.alerts.cfg.Rules {
+		if !r.appliesTo(n.name) {
+			continue
+		}
+
+		st := b.alerts.state(n.name, r.Name)
+		data = append(data, alertStatus{Rule: r.String(), Name: r.Name, Network: n.name, alertState: *st})
+
+		status := "ok"
+		switch {
+		case st.Firing:
+			status = "FIRING"
+		case st.Detail == "":
+			status = "not checked yet"
+		}
+
+		line := fmt.Sprintf("%s (%s): %s", r.Name, r, status)
+		if st.Detail != "" {
+			line += " -- " + st.Detail
+		}
+
+		lines = append(lines, line)
+	}
+
+	if len(lines) == 0 {
+		lines = append(lines, fmt.Sprintf("No alert rules apply to %s", n.name))
+	}
+
+	return newResult(data, lines...)
+}
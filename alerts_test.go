@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServersLostGradually(t *testing.T) {
+	a := newAlerter(alertsConfig{
+		Channels: []string{"#alerts"},
+		Rules:    []alertRule{{Name: "lost", Metric: metricServersLost, Op: ">=", Threshold: 3}},
+	})
+
+	snap := func(servers int) *snapshot {
+		g := make(graph)
+		for i := 0; i < servers; i++ {
+			name := fmt.Sprintf("s%d.test.net", i)
+			g[name] = &Server{Name: name}
+		}
+
+		return &snapshot{Taken: time.Now(), Source: graphModeIRC, graph: g}
+	}
+
+	// One server leaves at a time, which must add up to the rule firing
+	for _, servers := range []int{10, 9, 8} {
+		if out := a.evaluate("net", snap(servers)); len(out) > 0 {
+			t.Fatalf("%d servers: fired early: %v", servers, out)
+		}
+	}
+
+	out := a.evaluate("net", snap(7))
+	if len(out["#alerts"]) != 1 || !strings.Contains(out["#alerts"][0], "down 3 from 10") {
+		t.Fatalf("7 servers: got %v", out)
+	}
+
+	out = a.evaluate("net", snap(9))
+	if len(out["#alerts"]) != 1 || !strings.Contains(out["#alerts"][0], "resolved") {
+		t.Fatalf("9 servers: got %v", out)
+	}
+
+	// Counting starts again from where it resolved
+	if out := a.evaluate("net", snap(7)); len(out) > 0 {
+		t.Errorf("7 servers after resolving at 9: got %v", out)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+)
+
+// analysis is a graph analysis that is shared between the chat commands and the offline CLI
+type analysis struct {
+	name    string
+	desc    string
+	aliases []string
+	args    []argSpec
+	flags   []argSpec
+	run     func(t *topology, args *commandArgs) (*commandResult, error)
+}
+
+var analyses = []analysis{
+	{
+		name: "biggesthop", desc: "Find largest number of hops between two servers, now fasterer",
+		aliases: []string{"bh", "howfucked"}, run: maxHops,
+		flags: []argSpec{
+			{name: "noskip", kind: argBool, desc: "include servers whose description starts with ~"},
+			{name: "exclude", kind: argFilter, desc: "skip servers matching a name glob, or desc:<glob>"},
+		},
+	},
+	{
+		name: "biggesthopfrom", desc: "Find the furthest server from the given server",
+		aliases: []string{"bhf", "howfuckedis"}, run: maxHopsFrom,
+		args: []argSpec{{name: "from", kind: argServer}},
+	},
+	{
+		name: "singlepointoffailure", desc: "Find the server with the most peers",
+		aliases: []string{"spof"}, run: singlePointOfFailure,
+		flags: []argSpec{{name: "top", kind: argInt, desc: "list this many servers with the most peers"}},
+	},
+	{
+		name: "peercount", desc: "Get the number of peers for the given server",
+		aliases: []string{"pc", "peecount"}, run: peerCount,
+		args: []argSpec{{name: "server", kind: argServer}},
+	},
+	{
+		name: "hopsbetween", desc: "get the number of hops between two servers",
+		aliases: []string{"hb"}, run: hopsBetween,
+		args: []argSpec{{name: "a", kind: argServer}, {name: "b", kind: argServer}},
+	},
+	{
+		name: "showhopsbetween", desc: "Lists the hops between servers",
+		aliases: []string{"shb", "streambetween"}, run: showHopsBetween,
+		args: []argSpec{{name: "a", kind: argServer}, {name: "b", kind: argServer}},
+	},
+	{
+		name: "tree", desc: "Check that the network is a tree, and find its centre and centroid",
+		aliases: []string{"centre", "center"}, run: treeShape,
+	},
+	{
+		name: "cutpoints", desc: "List the servers whose loss would split the network, those cutting off the most first",
+		aliases: []string{"cuts"}, run: cutPointsAnalysis,
+		flags: []argSpec{{name: "top", kind: argInt, desc: "how many servers to list"}},
+	},
+	{
+		name: "central", desc: "List the servers the most paths between other servers go through",
+		aliases: []string{"betweenness"}, run: centralServers,
+		flags: []argSpec{{name: "top", kind: argInt, desc: "how many servers to list"}},
+	},
+	{
+		name: "count", desc: "Current server count, or the number of servers matching a filter", run: serverCount,
+		args: []argSpec{{name: "filter", kind: argFilter, optional: true}},
+	},
+}
+
+// command returns the chat command spec for a, without a run func
+func (a analysis) command() *command {
+	return &command{name: a.name, desc: a.desc, aliases: a.aliases, args: a.args, flags: a.flags}
+}
+
+// findAnalysis looks up an analysis by name or alias
+func findAnalysis(name string) (analysis, bool) {
+	for _, a := range analyses {
+		if a.name == name || stringSliceContains(name, a.aliases) {
+			return a, true
+		}
+	}
+
+	return analysis{}, false
+}
+
+// runAnalysis resolves the server arguments in args and runs a, converting any error or panic into an error result.
+// Panics are logged to logger, and only a generic error goes back to whoever asked.
+func runAnalysis(a analysis, t *topology, args *commandArgs, logger *log.Logger) (out *commandResult) {
+	defer func() {
+		if res := recover(); res != nil {
+			logger.Printf("PANIC running %s: %v\n%s", a.name, res, debug.Stack())
+			out = errorf("PANIC! Caught and logged.")
+		}
+	}()
+
+	if err := args.resolveServers(t); err != nil {
+		return errorResult(err)
+	}
+
+	res, err := a.run(t, args)
+	if err != nil {
+		return errorResult(err)
+	}
+
+	t.warnCycles(res)
+	return res
+}
+
+func (t *topology) mustGetServer(nameOrID string) (*Server, error) {
+	if srv := t.getServer(nameOrID); srv != nil {
+		return srv, nil
+	}
+
+	return nil, fmt.Errorf("Server ID / name %q doesn't exist!", nameOrID)
+}
+
+type hopsResult struct {
+	Hops   int       `json:"hops"`
+	From   serverRef `json:"from"`
+	To     serverRef `json:"to"`
+	TookMS float64   `json:"took_ms"`
+}
+
+func maxHops(top *topology, args *commandArgs) (*commandResult, error) {
+	skipTilde := !args.bool("noskip")
+	exclude, hasExclude := args.filter("exclude")
+
+	t := time.Now()
+	// Only one end has to be without a ~, but neither may be excluded
+	notTilde := func(srv *Server) bool { return !skipTilde || !strings.HasPrefix(srv.Description, "~") }
+	best, one, two := top.diameterFrom(notTilde, func(srv *Server) bool { return !hasExclude || !exclude.match(srv) })
+
+	bestPair := [2]*Server{one, two}
+	if bestPair[0] == nil || bestPair[1] == nil {
+		return nil, errors.New("Error occurred (try with -noskip)")
+	}
+
+	return resultf(
+		hopsResult{Hops: best, From: bestPair[0].ref(), To: bestPair[1].ref(), TookMS: tookMS(t)},
+		"Largest hop size is %d! between %s and %s (search took %s)",
+		best, bestPair[0].NameID(), bestPair[1].NameID(), time.Since(t),
+	), nil
+}
+
+func maxHopsFrom(top *topology, args *commandArgs) (*commandResult, error) {
+	from := args.server("from")
+	t := time.Now()
+	biggestHop, srv := top.largestDistanceFrom(from, nil)
+	return resultf(
+		hopsResult{Hops: biggestHop, From: from.ref(), To: srv.ref(), TookMS: tookMS(t)},
+		"Largest hop size from %s is %d! other side is %s (search took %s)",
+		from.NameID(), biggestHop, srv.NameID(), time.Since(t),
+	), nil
+}
+
+type peersResult struct {
+	Server serverRef `json:"server"`
+	Peers  int       `json:"peers"`
+}
+
+func singlePointOfFailure(gr *topology, args *commandArgs) (*commandResult, error) {
+	t := time.Now()
+	mostPeers := gr.g.mostPeers()
+	if mostPeers == nil {
+		return nil, errors.New("graph is empty")
+	}
+
+	if top := args.int("top", 0); top > 0 {
+		servers := gr.g.byPeerCount()
+		if top > len(servers) {
+			top = len(servers)
+		}
+
+		out := []string{}
+		data := []peersResult{}
+		for _, srv := range servers[:top] {
+			out = append(out, fmt.Sprintf("%s: %d peers", srv.NameID(), len(srv.Peers)))
+			data = append(data, peersResult{Server: srv.ref(), Peers: len(srv.Peers)})
+		}
+
+		return resultf(data, "Servers with the most peers: %s (Search took %s)", strings.Join(out, ", "), time.Since(t)), nil
+	}
+
+	return resultf(
+		peersResult{Server: mostPeers.ref(), Peers: len(mostPeers.Peers)},
+		"Server with the most peers is %s with %d peers! (Search took %s)",
+		mostPeers.NameID(), len(mostPeers.Peers), time.Since(t),
+	), nil
+}
+
+func peerCount(_ *topology, args *commandArgs) (*commandResult, error) {
+	srv := args.server("server")
+	return resultf(
+		peersResult{Server: srv.ref(), Peers: len(srv.Peers)}, "%s has %d peers!", srv.NameID(), len(srv.Peers),
+	), nil
+}
+
+func hopsBetween(top *topology, args *commandArgs) (*commandResult, error) {
+	one, two := args.server("a"), args.server("b")
+	t := time.Now()
+	dst := top.distance(one, two)
+
+	return resultf(
+		hopsResult{Hops: dst, From: one.ref(), To: two.ref(), TookMS: tookMS(t)},
+		"there are %d hops between %s and %s (Search took %s)",
+		dst, one.NameID(), two.NameID(), time.Since(t),
+	), nil
+}
+
+func showHopsBetween(top *topology, args *commandArgs) (*commandResult, error) {
+	source, dst := args.server("a"), args.server("b")
+	res := top.path(source, dst)
+	if res == nil {
+		return nil, fmt.Errorf("there is no path between %s and %s", source.NameID(), dst.NameID())
+	}
+
+	nameIDs := []string{}
+	path := []serverRef{}
+	for _, v := range res {
+		nameIDs = append(nameIDs, v.NameID())
+		path = append(path, v.ref())
+	}
+
+	// The output layer splits this at the arrows if it is too long for one line
+	return newResult(struct {
+		Path []serverRef `json:"path"`
+	}{path}, strings.Join(nameIDs, " -> ")), nil
+}
+
+type countResult struct {
+	Count  int    `json:"count"`
+	Filter string `json:"filter,omitempty"`
+}
+
+func serverCount(top *topology, args *commandArgs) (*commandResult, error) {
+	filter, ok := args.filter("filter")
+	if !ok {
+		return resultf(countResult{Count: top.len()}, "Currently there are %d servers on the network", top.len()), nil
+	}
+
+	count := 0
+	for _, srv := range top.servers {
+		if filter.match(srv) {
+			count++
+		}
+	}
+
+	return resultf(
+		countResult{Count: count, Filter: filter.String()},
+		"Currently there are %d servers matching %s on the network", count, filter,
+	), nil
+}
+
+// analysisNames returns the names of every analysis, sorted
+func analysisNames() []string {
+	out := []string{}
+	for _, a := range analyses {
+		out = append(out, a.name)
+	}
+
+	sort.Strings(out)
+	return out
+}
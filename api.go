@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const apiPath = "/api/"
+
+type apiConfig struct {
+	// Tokens may use the API, each with the roles it holds. No tokens disables the API.
+	Tokens []apiToken `toml:"tokens"`
+}
+
+type apiToken struct {
+	// Name is used in logs to say which token was used
+	Name  string   `toml:"name"`
+	Token string   `toml:"token"`
+	Roles []string `toml:"roles"`
+}
+
+// serveAPI runs chat commands over HTTP. /api/<command>/<subcommand> runs a command, with its arguments and flags
+// given as query or form parameters named after them and "net" picking the network. Requests need an
+// "Authorization: Bearer <token>" header, and a token may run whatever its roles could run in a private message.
+// The reply is the same result --json gives on IRC.
+func (b *bot) serveAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		writeAPIResult(w, http.StatusMethodNotAllowed, errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	tok, ok := b.apiToken(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="pngraphbot"`)
+		writeAPIResult(w, http.StatusUnauthorized, errorf("missing or unknown API token"))
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeAPIResult(w, http.StatusBadRequest, errorResult(err))
+		return
+	}
+
+	path := strings.FieldsFunc(strings.TrimPrefix(r.URL.Path, apiPath), func(r rune) bool { return r == '/' })
+	if len(path) == 0 {
+		writeAPIResult(w, http.StatusOK, b.apiIndex(tok))
+		return
+	}
+
+	c, exists := b.registry.lookup(path[0])
+	if !exists {
+		writeAPIResult(w, http.StatusNotFound, errorf("unknown command %q", path[0]))
+		return
+	}
+
+	for _, name := range path[1:] {
+		sub, exists := c.subcommand(name)
+		if !exists {
+			writeAPIResult(w, http.StatusNotFound, errorf("%s has no subcommand %q", c.path(), name))
+			return
+		}
+
+		c = sub
+	}
+
+	n, err := b.apiNetwork(r.Form.Get("net"))
+	if err != nil {
+		writeAPIResult(w, http.StatusBadRequest, errorResult(err))
+		return
+	}
+
+	// Rules name top level commands, as they do on IRC, so subcommands are allowed by their root command's rule
+	root := c
+	for root.parent != nil {
+		root = root.parent
+	}
+
+	if !b.apiAllowed(tok, root.name, n.name) {
+		log.Printf("API: refusing %s on %s for token %s: not permitted", root.name, n.name, tok.Name)
+		writeAPIResult(w, http.StatusForbidden, errorf("token %s may not run %s on %s", tok.Name, root.name, n.name))
+		return
+	}
+
+	tokens, err := apiArgs(c, r.Form)
+	var args *commandArgs
+	if err == nil {
+		c, args, err = parseCommandArgs(c, tokens)
+	}
+
+	if err != nil {
+		res := errorf("%s -- usage: %s", err, c.usage(b.cfg.Commands.Prefix))
+		res.Command = c.path()
+		writeAPIResult(w, http.StatusBadRequest, res)
+		return
+	}
+
+	res := b.execute(c, n, nil, args)
+	if res == nil {
+		res = &commandResult{Command: c.path(), Network: n.name, OK: true}
+	}
+
+	status := http.StatusOK
+	if !res.OK {
+		status = http.StatusUnprocessableEntity
+	}
+
+	writeAPIResult(w, status, res)
+}
+
+// apiToken returns the configured token the request carries
+func (b *bot) apiToken(r *http.Request) (apiToken, bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return apiToken{}, false
+	}
+
+	given := []byte(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")))
+	for _, tok := range b.cfg.API.Tokens {
+		if subtle.ConstantTimeCompare(given, []byte(tok.Token)) == 1 {
+			return tok, true
+		}
+	}
+
+	return apiToken{}, false
+}
+
+// apiAllowed reports whether tok holds a role the permissions rules allow to run command in a private message on
+// network
+func (b *bot) apiAllowed(tok apiToken, command, network string) bool {
+	for _, role := range b.perms.rolesFor(command, "", network, network) {
+		if role == roleEveryone || stringSliceContains(role, tok.Roles) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// apiAllowedAnywhere reports whether tok may run command on at least one network
+func (b *bot) apiAllowedAnywhere(tok apiToken, command string) bool {
+	for _, network := range b.cfg.networkNames() {
+		if b.apiAllowed(tok, command, network) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// apiIndex lists the commands tok may run on any network
+func (b *bot) apiIndex(tok apiToken) *commandResult {
+	out := []commandHelp{}
+	for _, name := range b.registry.names() {
+		if b.apiAllowedAnywhere(tok, name) {
+			c, _ := b.registry.lookup(name)
+			out = append(out, c.help(b.cfg.Commands.Prefix))
+		}
+	}
+
+	return newResult(out)
+}
+
+// apiNetwork returns the named network. The name can be left out if there is only one.
+func (b *bot) apiNetwork(name string) (*network, error) {
+	names := b.cfg.networkNames()
+	if name == "" {
+		if len(names) != 1 {
+			return nil, fmt.Errorf("more than one network is configured, pass net= with one of %s", strings.Join(names, ", "))
+		}
+
+		name = names[0]
+	}
+
+	n, exists := b.networks[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown network %q, available: %s", name, strings.Join(names, ", "))
+	}
+
+	return n, nil
+}
+
+// apiArgs turns request parameters into the tokens parseCommandArgs takes, so that arguments are checked the same
+// way as on IRC. A bool flag is set by being present, unless its value is false.
+func apiArgs(c *command, form url.Values) ([]string, error) {
+	flags := []string{}
+	for name, values := range form {
+		if name == "net" {
+			continue
+		}
+
+		spec, isFlag := c.flag(name)
+		if !isFlag {
+			if !c.hasArg(name) {
+				return nil, fmt.Errorf("unknown parameter %q", name)
+			}
+
+			continue
+		}
+
+		value := values[len(values)-1]
+		if spec.kind != argBool {
+			flags = append(flags, "--"+name+"="+value)
+			continue
+		}
+
+		set := true
+		if value != "" {
+			v, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be true or false, not %q", name, value)
+			}
+
+			set = v
+		}
+
+		if set {
+			flags = append(flags, "--"+name)
+		}
+	}
+
+	// Map order is random, keep errors about flags the same from one request to the next
+	sort.Strings(flags)
+
+	positional := []string{}
+	var missing *argSpec
+	for i, spec := range c.args {
+		values, given := form[spec.name]
+		switch {
+		case !given:
+			if missing == nil {
+				missing = &c.args[i]
+			}
+
+			continue
+		case missing != nil:
+			return nil, fmt.Errorf("missing %s", missing.usage())
+		case spec.rest:
+			positional = append(positional, values...)
+		default:
+			positional = append(positional, values[len(values)-1])
+		}
+	}
+
+	// Everything after "--" is positional, so values starting with a dash or naming a subcommand are left alone
+	return append(append(flags, "--"), positional...), nil
+}
+
+// hasArg reports whether c takes a positional argument called name
+func (c *command) hasArg(name string) bool {
+	for _, a := range c.args {
+		if a.name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func writeAPIResult(w http.ResponseWriter, status int, res *commandResult) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Printf("API: could not write reply: %s", err)
+	}
+}
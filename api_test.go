@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPISubcommandPermissions(t *testing.T) {
+	b, _, _, _ := startTestBot(t, newFakeIRCd(t), func(cfg *config) {
+		cfg.HTTP.Listen = "127.0.0.1:0"
+		cfg.API.Tokens = []apiToken{{Name: "reader", Token: "s3cret", Roles: []string{"reader"}}}
+		cfg.Permissions.Roles["reader"] = roleConfig{}
+		cfg.Permissions.Rules = []aclRule{
+			{Command: "*", Roles: []string{"reader"}},
+			{Command: "reconcile", Roles: []string{"admin"}},
+		}
+	})
+
+	// Denied reconcile, the token must not get at it through its subcommands either
+	for _, path := range []string{"reconcile", "reconcile/full", "rec/server?server=hub.test.net"} {
+		r := httptest.NewRequest(http.MethodGet, apiPath+path, nil)
+		r.Header.Set("Authorization", "Bearer s3cret")
+		w := httptest.NewRecorder()
+		b.serveAPI(w, r)
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s: got status %d, want %d: %s", path, w.Code, http.StatusForbidden, w.Body)
+		}
+	}
+}
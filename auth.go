@@ -0,0 +1,405 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	irc "github.com/thoj/go-ircevent"
+)
+
+const (
+	saslExternalTimeout   = 15 * time.Second
+	challengeTimeout      = 15 * time.Second
+	saslMechanismPlain    = "PLAIN"
+	saslMechanismExternal = "EXTERNAL"
+	operMethodPassword    = "password"
+	operMethodCertFP      = "certfp"
+	operMethodChallenge   = "challenge"
+)
+
+type tlsConfig struct {
+	// Cert and Key are a client certificate to present, used for CertFP and SASL EXTERNAL
+	Cert string `toml:"cert"`
+	Key  string `toml:"key"`
+	// CA is a PEM bundle used instead of the system roots to verify the server
+	CA string `toml:"ca"`
+	// ServerName overrides the name the server certificate is verified against
+	ServerName string `toml:"server_name"`
+}
+
+type saslConfig struct {
+	// Mechanism is PLAIN, EXTERNAL, or empty to disable SASL
+	Mechanism string `toml:"mechanism"`
+	Login     string `toml:"login"`
+	Password  string `toml:"password"`
+}
+
+type operConfig struct {
+	// Method is password, certfp, or challenge
+	Method   string `toml:"method"`
+	Name     string `toml:"name"`
+	Password string `toml:"password"`
+	// ChallengeKey is the PEM RSA private key used to answer CHALLENGE
+	ChallengeKey string `toml:"challenge_key"`
+}
+
+// buildTLSConfig creates the TLS config for connecting to server
+func buildTLSConfig(server string, cfg tlsConfig) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server address %q: %w", server, err)
+	}
+
+	out := &tls.Config{ServerName: host}
+	if cfg.ServerName != "" {
+		out.ServerName = cfg.ServerName
+	}
+
+	if cfg.Cert != "" || cfg.Key != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %w", err)
+		}
+
+		out.Certificates = []tls.Certificate{cert}
+	}
+
+	if cfg.CA != "" {
+		data, err := ioutil.ReadFile(cfg.CA)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA bundle: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %q", cfg.CA)
+		}
+
+		out.RootCAs = pool
+	}
+
+	return out, nil
+}
+
+// setupAuth configures TLS and SASL on the connection and adds the callbacks that track oper status. It must be
+// called before connecting.
+func (n *network) setupAuth() error {
+	cfg := n.cfg.IRC
+	if cfg.TLS {
+		tlsCfg, err := buildTLSConfig(cfg.Server, cfg.TLSConfig)
+		if err != nil {
+			return err
+		}
+
+		n.ircCon.TLSConfig = tlsCfg
+	}
+
+	switch strings.ToUpper(cfg.SASL.Mechanism) {
+	case "":
+	case saslMechanismPlain:
+		n.ircCon.UseSASL = true
+		n.ircCon.SASLMech = saslMechanismPlain
+		n.ircCon.SASLLogin = cfg.SASL.Login
+		n.ircCon.SASLPassword = cfg.SASL.Password
+
+	case saslMechanismExternal:
+		if len(n.ircCon.TLSConfig.Certificates) == 0 {
+			return errors.New("SASL EXTERNAL requires a TLS client certificate")
+		}
+
+	default:
+		return fmt.Errorf("unsupported SASL mechanism %q", cfg.SASL.Mechanism)
+	}
+
+	n.ircCon.AddCallback(RPL_YOUREOPER, func(_ *irc.Event) {
+		n.setOper(true)
+		n.ircCon.Log.Println("Now opered")
+	})
+
+	for _, code := range []string{ERR_PASSWDMISMATCH, ERR_NOOPERHOST} {
+		n.ircCon.AddCallback(code, func(e *irc.Event) {
+			n.setOper(false)
+			n.ircCon.Log.Printf("OPER failed: %s", e.Message())
+		})
+	}
+
+	n.ircCon.AddCallback("MODE", func(e *irc.Event) {
+		if len(e.Arguments) > 1 && strings.EqualFold(e.Arguments[0], n.ircCon.GetNick()) {
+			n.trackUserModes(e.Arguments[1])
+		}
+	})
+
+	n.ircCon.AddCallback(RPL_UMODEIS, func(e *irc.Event) {
+		if len(e.Arguments) > 1 {
+			n.setOper(false)
+			n.trackUserModes(e.Arguments[1])
+		}
+	})
+
+	// The underlying connection is gone; we will need to OPER again on reconnect
+	n.ircCon.AddCallback("ERROR", func(_ *irc.Event) { n.setOper(false) })
+
+	return nil
+}
+
+// trackUserModes updates oper status from a mode change on ourselves
+func (n *network) trackUserModes(modes string) {
+	adding := true
+	for _, c := range modes {
+		switch c {
+		case '+':
+			adding = true
+		case '-':
+			adding = false
+		case 'o', 'O':
+			n.setOper(adding)
+		}
+	}
+}
+
+func (n *network) setOper(oper bool) {
+	n.operMutex.Lock()
+	defer n.operMutex.Unlock()
+
+	n.opered = oper
+}
+
+func (n *network) isOper() bool {
+	n.operMutex.Lock()
+	defer n.operMutex.Unlock()
+
+	return n.opered
+}
+
+// onWelcome finishes authenticating after registration, then joins the configured channels. Callbacks block the
+// read loop, so this must run in its own goroutine.
+func (n *network) onWelcome() {
+	// account-tag lets permission checks see services accounts without a WHO for every command, and account-notify
+	// tells us when cached accounts go stale. Each is asked for alone, as a server lacking one refuses the lot.
+	n.ircCon.SendRaw("CAP REQ :account-tag")
+	n.ircCon.SendRaw("CAP REQ :account-notify")
+
+	if strings.EqualFold(n.cfg.IRC.SASL.Mechanism, saslMechanismExternal) {
+		if err := n.saslExternal(); err != nil {
+			n.ircCon.Log.Printf("SASL EXTERNAL failed: %s", err)
+		}
+	}
+
+	if err := n.oper(); err != nil {
+		n.ircCon.Log.Printf("Could not OPER: %s", err)
+	}
+
+	for _, channel := range n.cfg.IRC.Channels {
+		n.ircCon.Join(channel)
+	}
+}
+
+// saslExternal authenticates with SASL EXTERNAL using our client certificate. go-ircevent only supports PLAIN
+// during registration, so this is done afterwards, which needs a server that allows SASL after registration.
+func (n *network) saslExternal() error {
+	result := make(chan error, 1)
+	var once sync.Once
+	finish := func(err error) { once.Do(func() { result <- err }) }
+
+	callbacks := []irc.CallbackID{}
+	addCallback := func(code string, cb func(*irc.Event)) {
+		callbacks = append(callbacks, irc.CallbackID{EventCode: code, ID: n.ircCon.AddCallback(code, cb)})
+	}
+
+	defer func() {
+		for _, cb := range callbacks {
+			n.ircCon.RemoveCallback(cb.EventCode, cb.ID)
+		}
+	}()
+
+	addCallback("CAP", func(e *irc.Event) {
+		if len(e.Arguments) < 3 || !listContains(e.Arguments[2], "sasl") {
+			return
+		}
+
+		switch e.Arguments[1] {
+		case "ACK":
+			n.ircCon.SendRaw("AUTHENTICATE " + saslMechanismExternal)
+		case "NAK":
+			finish(errors.New("server refused the sasl capability"))
+		}
+	})
+
+	addCallback("AUTHENTICATE", func(e *irc.Event) {
+		if len(e.Arguments) > 0 && e.Arguments[0] == "+" {
+			n.ircCon.SendRaw("AUTHENTICATE +")
+		}
+	})
+
+	addCallback(RPL_SASLSUCCESS, func(_ *irc.Event) { finish(nil) })
+	// Already being logged in is as good as logging in now
+	addCallback(ERR_SASLALREADY, func(e *irc.Event) {
+		n.ircCon.Log.Printf("SASL EXTERNAL: %s", e.Message())
+		finish(nil)
+	})
+
+	for _, code := range []string{ERR_SASLFAIL, ERR_SASLTOOLONG, ERR_SASLABORTED, RPL_SASLMECHS} {
+		addCallback(code, func(e *irc.Event) { finish(errors.New(e.Message())) })
+	}
+
+	n.ircCon.SendRaw("CAP REQ :sasl")
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(saslExternalTimeout):
+		return errors.New("timed out")
+	}
+}
+
+// oper sends OPER or CHALLENGE according to the config
+func (n *network) oper() error {
+	cfg := n.cfg.IRC.Oper
+	if cfg.Name == "" {
+		if n.cfg.IRC.OperIdent != "" {
+			n.ircCon.SendRaw("OPER " + n.cfg.IRC.OperIdent)
+		}
+
+		return nil
+	}
+
+	switch cfg.Method {
+	case operMethodPassword, "":
+		n.ircCon.SendRawf("OPER %s %s", cfg.Name, cfg.Password)
+
+	case operMethodCertFP:
+		// The ircd matches our certificate fingerprint. Some still want a password field, so send a placeholder
+		password := cfg.Password
+		if password == "" {
+			password = "*"
+		}
+
+		n.ircCon.SendRawf("OPER %s %s", cfg.Name, password)
+
+	case operMethodChallenge:
+		return n.challenge(cfg)
+
+	default:
+		return fmt.Errorf("unknown oper method %q", cfg.Method)
+	}
+
+	return nil
+}
+
+// challenge opers with the ratbox style CHALLENGE command. The server sends an RSA encrypted challenge, and we
+// answer with the base64 SHA1 of the decrypted bytes.
+func (n *network) challenge(cfg operConfig) error {
+	key, err := loadRSAKey(cfg.ChallengeKey)
+	if err != nil {
+		return err
+	}
+
+	var (
+		mu      sync.Mutex
+		encoded strings.Builder
+		done    = make(chan struct{})
+		once    sync.Once
+	)
+
+	partID := n.ircCon.AddCallback(RPL_RSACHALLENGE2, func(e *irc.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		encoded.WriteString(e.Message())
+	})
+	defer n.ircCon.RemoveCallback(RPL_RSACHALLENGE2, partID)
+
+	endID := n.ircCon.AddCallback(RPL_ENDOFRSACHALLENGE2, func(_ *irc.Event) { once.Do(func() { close(done) }) })
+	defer n.ircCon.RemoveCallback(RPL_ENDOFRSACHALLENGE2, endID)
+
+	n.ircCon.SendRawf("CHALLENGE %s", cfg.Name)
+
+	select {
+	case <-done:
+	case <-time.After(challengeTimeout):
+		return errors.New("timed out waiting for CHALLENGE")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	response, err := challengeResponse(key, encoded.String())
+	if err != nil {
+		return err
+	}
+
+	n.ircCon.SendRaw("CHALLENGE +" + response)
+	return nil
+}
+
+// challengeResponse decrypts a CHALLENGE and returns the response to send
+func challengeResponse(key *rsa.PrivateKey, challenge string) (string, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(challenge)
+	if err != nil {
+		return "", fmt.Errorf("could not decode challenge: %w", err)
+	}
+
+	plain, err := rsa.DecryptOAEP(sha1.New(), nil, key, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt challenge: %w", err)
+	}
+
+	sum := sha1.Sum(plain)
+	return base64.StdEncoding.EncodeToString(sum[:]), nil
+}
+
+func loadRSAKey(path string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read challenge key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %q", path)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse challenge key: %w", err)
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("challenge key is not an RSA key")
+	}
+
+	return key, nil
+}
+
+// listContains checks if a space-separated list contains value
+func listContains(list, value string) bool {
+	return stringSliceContains(value, strings.Fields(list))
+}
+
+func (b *bot) operStatus(n *network, _ *irc.Event, _ *commandArgs) *commandResult {
+	opered := n.isOper()
+	status := "not opered"
+	if opered {
+		status = "opered"
+	}
+
+	return resultf(struct {
+		Network string `json:"network"`
+		Opered  bool   `json:"opered"`
+	}{n.name, opered}, "Oper status on %s: %s", n.name, status)
+}
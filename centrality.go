@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const defaultCentralityTop = 5
+
+// cutPoint is a server whose loss would split its part of the network
+type cutPoint struct {
+	server int32
+	// parts are the sizes of the pieces left without it, the largest first
+	parts []int
+}
+
+// cutOff returns how many servers would lose touch with the largest piece
+func (c cutPoint) cutOff() int {
+	out := 0
+	for _, p := range c.parts[1:] {
+		out += p
+	}
+
+	return out
+}
+
+// cutPoints returns every articulation point, those cutting off the most servers first. The result is remembered
+// and must not be changed.
+func (t *topology) cutPoints() []cutPoint {
+	return t.memo("cut points", func() interface{} { return t.findCutPoints() }).([]cutPoint)
+}
+
+// findCutPoints is Tarjan's algorithm, without recursion so that long chains of servers cannot overflow the stack.
+// A server is a cut point if a subtree below it in the search cannot reach above it except through it.
+func (t *topology) findCutPoints() []cutPoint {
+	n := t.len()
+	disc, low, size, parent, next := make([]int32, n), make([]int32, n), make([]int32, n), make([]int32, n), make([]int32, n)
+	separated := make(map[int32][]int)
+	for i := range disc {
+		disc[i] = -1
+	}
+
+	timer := int32(0)
+	visit := func(i, p int32) {
+		disc[i], low[i], size[i], parent[i] = timer, timer, 1, p
+		timer++
+	}
+
+	var stack []int32
+	for _, root := range t.forest.roots {
+		visit(root, -1)
+		stack = append(stack[:0], root)
+		for len(stack) > 0 {
+			v := stack[len(stack)-1]
+			if peers := t.peers(v); int(next[v]) < len(peers) {
+				w := peers[next[v]]
+				next[v]++
+				switch {
+				case disc[w] < 0:
+					visit(w, v)
+					stack = append(stack, w)
+				case w != parent[v] && disc[w] < low[v]:
+					low[v] = disc[w]
+				}
+
+				continue
+			}
+
+			stack = stack[:len(stack)-1]
+			p := parent[v]
+			if p < 0 {
+				continue
+			}
+
+			size[p] += size[v]
+			if low[v] < low[p] {
+				low[p] = low[v]
+			}
+
+			if low[v] >= disc[p] {
+				separated[p] = append(separated[p], int(size[v]))
+			}
+		}
+	}
+
+	out := []cutPoint{}
+	for i, parts := range separated {
+		rest := int(t.forest.sizes[t.forest.component[i]]) - 1
+		for _, p := range parts {
+			rest -= p
+		}
+
+		// Every child of a root is separated from the others, but a root with one child splits nothing
+		if parent[i] < 0 && len(parts) < 2 {
+			continue
+		}
+
+		if rest > 0 {
+			parts = append(parts, rest)
+		}
+
+		sort.Sort(sort.Reverse(sort.IntSlice(parts)))
+		out = append(out, cutPoint{server: i, parts: parts})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if a, b := out[i].cutOff(), out[j].cutOff(); a != b {
+			return a > b
+		}
+
+		return out[i].server < out[j].server
+	})
+
+	return out
+}
+
+// betweenness returns, for every server, how many shortest paths between pairs of other servers pass through it.
+// Pairs with more than one shortest path count each path in proportion. The result is remembered and must not be
+// changed.
+func (t *topology) betweenness() []float64 {
+	return t.memo("betweenness", func() interface{} {
+		if t.acyclic() {
+			return t.treeBetweenness()
+		}
+
+		return t.brandes()
+	}).([]float64)
+}
+
+// treeBetweenness counts paths through each server in linear time. In a tree there is one path between any two
+// servers, and it passes through a server exactly when the two are in different branches around it.
+func (t *topology) treeBetweenness() []float64 {
+	out := make([]float64, t.len())
+	sizes := t.subtreeSizes()
+	for i := range out {
+		rest := float64(t.forest.sizes[t.forest.component[i]] - 1)
+		sumSquares := 0.0
+		for _, b := range t.branches(int32(i), sizes) {
+			sumSquares += float64(b) * float64(b)
+		}
+
+		out[i] = (rest*rest - sumSquares) / 2
+	}
+
+	return out
+}
+
+// brandes is Brandes' algorithm for graphs with cycles: a search from every server, counting shortest paths on the
+// way out and adding up dependencies on the way back.
+func (t *topology) brandes() []float64 {
+	n := t.len()
+	out := make([]float64, n)
+	dist, sigma, delta := make([]int32, n), make([]float64, n), make([]float64, n)
+	var queue []int32
+	for s := int32(0); s < int32(n); s++ {
+		for i := range dist {
+			dist[i], sigma[i], delta[i] = -1, 0, 0
+		}
+
+		dist[s], sigma[s] = 0, 1
+		queue = append(queue[:0], s)
+		for head := 0; head < len(queue); head++ {
+			v := queue[head]
+			for _, w := range t.peers(v) {
+				if dist[w] < 0 {
+					dist[w] = dist[v] + 1
+					queue = append(queue, w)
+				}
+
+				if dist[w] == dist[v]+1 {
+					sigma[w] += sigma[v]
+				}
+			}
+		}
+
+		// Servers are visited furthest first, so every server's dependency is complete before its predecessors use it
+		for k := len(queue) - 1; k > 0; k-- {
+			w := queue[k]
+			for _, v := range t.peers(w) {
+				if dist[v] == dist[w]-1 {
+					delta[v] += sigma[v] / sigma[w] * (1 + delta[w])
+				}
+			}
+
+			out[w] += delta[w]
+		}
+	}
+
+	// Every pair was counted from both ends
+	for i := range out {
+		out[i] /= 2
+	}
+
+	return out
+}
+
+type cutPointResult struct {
+	Server serverRef `json:"server"`
+	CutOff int       `json:"cut_off"`
+	Parts  []int     `json:"parts"`
+}
+
+// cutPointsAnalysis lists the servers whose loss would split the network
+func cutPointsAnalysis(top *topology, args *commandArgs) (*commandResult, error) {
+	points := top.cutPoints()
+	limit := args.int("top", defaultCentralityTop)
+	data := []cutPointResult{}
+	worst := []string{}
+	for i, c := range points {
+		if i >= limit {
+			break
+		}
+
+		srv := top.servers[c.server]
+		data = append(data, cutPointResult{Server: srv.ref(), CutOff: c.cutOff(), Parts: c.parts})
+		worst = append(worst, fmt.Sprintf("%s (cuts off %d)", srv.Name, c.cutOff()))
+	}
+
+	if len(points) == 0 {
+		return newResult(data, "No single server would split the network"), nil
+	}
+
+	return resultf(
+		data, "%d of %d servers would split the network if lost. Worst: %s",
+		len(points), top.len(), strings.Join(worst, ", "),
+	), nil
+}
+
+type centralityResult struct {
+	Server serverRef `json:"server"`
+	Paths  float64   `json:"paths"`
+	// Share is the fraction of paths between other servers that go through it
+	Share float64 `json:"share"`
+}
+
+// centralServers lists the servers the most paths between other servers go through
+func centralServers(top *topology, args *commandArgs) (*commandResult, error) {
+	if top.len() < 3 {
+		return nil, fmt.Errorf("there are too few servers for any to be between others")
+	}
+
+	between := top.betweenness()
+	order := make([]int32, top.len())
+	for i := range order {
+		order[i] = int32(i)
+	}
+
+	sort.SliceStable(order, func(i, j int) bool { return between[order[i]] > between[order[j]] })
+
+	limit := args.int("top", defaultCentralityTop)
+	switch {
+	case limit > len(order):
+		limit = len(order)
+	case limit < 0:
+		limit = 0
+	}
+
+	data := []centralityResult{}
+	names := []string{}
+	for _, i := range order[:limit] {
+		others := float64(top.forest.sizes[top.forest.component[i]] - 1)
+		share := 0.0
+		if others > 1 {
+			share = between[i] / (others * (others - 1) / 2)
+		}
+
+		srv := top.servers[i]
+		data = append(data, centralityResult{Server: srv.ref(), Paths: between[i], Share: share})
+		names = append(names, fmt.Sprintf("%s (%.1f%%)", srv.Name, 100*share))
+	}
+
+	return resultf(data, "Servers the most paths go through: %s", strings.Join(names, ", ")), nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	irc "github.com/thoj/go-ircevent"
+)
+
+const (
+	chartPath          = "/chart/"
+	defaultChartWindow = 7 * 24 * time.Hour
+	chartWidth         = 800
+	chartHeight        = 320
+	chartLeft          = 60
+	chartRight         = 20
+	chartTop           = 40
+	chartBottom        = 40
+	chartYTicks        = 5
+	chartXTicks        = 6
+)
+
+// chartMetrics are the history values that can be charted
+var chartMetrics = map[string]func(*historyEntry) int{
+	"servers":  func(e *historyEntry) int { return e.Servers },
+	"links":    func(e *historyEntry) int { return e.Links },
+	"diameter": func(e *historyEntry) int { return e.Diameter },
+	"users":    func(e *historyEntry) int { return e.Users },
+}
+
+func chartMetricNames() []string {
+	out := []string{}
+	for name := range chartMetrics {
+		out = append(out, name)
+	}
+
+	sort.Strings(out)
+	return out
+}
+
+// chartSpec is a chart someone asked for. Charts are drawn from history each time they are fetched, so a link
+// keeps showing the latest data until it expires.
+type chartSpec struct {
+	Network string
+	Metric  string
+	Window  time.Duration
+	expires time.Time
+}
+
+// chartStore hands out links to charts. Links use random IDs like pastes do, so that only people who were given
+// one can see the network's history, and last as long as pastes.
+type chartStore struct {
+	cfg     pasteConfig
+	http    *httpServer
+	history *historyStore
+
+	mu     sync.Mutex
+	charts map[string]*chartSpec
+	order  []string
+}
+
+func newChartStore(cfg pasteConfig, h *httpServer, history *historyStore) *chartStore {
+	s := &chartStore{cfg: cfg, http: h, history: history, charts: make(map[string]*chartSpec)}
+	h.handle(chartPath, s.serve)
+	return s
+}
+
+// add stores spec and returns a link to its chart
+func (s *chartStore) add(spec chartSpec) (string, error) {
+	raw := make([]byte, 8)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("could not create chart ID: %w", err)
+	}
+
+	id := hex.EncodeToString(raw)
+	spec.expires = time.Now().Add(s.cfg.Expiry)
+
+	s.mu.Lock()
+	s.expire()
+	for len(s.order) >= s.cfg.MaxPastes {
+		delete(s.charts, s.order[0])
+		s.order = s.order[1:]
+	}
+
+	s.charts[id] = &spec
+	s.order = append(s.order, id)
+	s.mu.Unlock()
+
+	return s.http.url(chartPath + id + ".svg"), nil
+}
+
+// expire drops every expired chart. s.mu must be held.
+func (s *chartStore) expire() {
+	now := time.Now()
+	for len(s.order) > 0 && now.After(s.charts[s.order[0]].expires) {
+		delete(s.charts, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+func (s *chartStore) serve(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, chartPath), ".svg")
+
+	s.mu.Lock()
+	s.expire()
+	spec, exists := s.charts[id]
+	s.mu.Unlock()
+
+	if !exists {
+		http.Error(w, "no such chart, it may have expired", http.StatusNotFound)
+		return
+	}
+
+	to := time.Now()
+	from := to.Add(-spec.Window)
+	points := []chartPoint{}
+	for _, entry := range s.history.window(spec.Network, from) {
+		points = append(points, chartPoint{at: entry.Taken, value: chartMetrics[spec.Metric](entry)})
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "no-store")
+	title := fmt.Sprintf("%s on %s, last %s", spec.Metric, spec.Network, formatDuration(spec.Window))
+	renderChart(w, title, points, from, to)
+}
+
+type chartPoint struct {
+	at    time.Time
+	value int
+}
+
+// renderChart draws points as an SVG line chart between from and to. Points before from are drawn at from, as they
+// show the value when the window began.
+func renderChart(w io.Writer, title string, points []chartPoint, from, to time.Time) {
+	plotW := float64(chartWidth - chartLeft - chartRight)
+	plotH := float64(chartHeight - chartTop - chartBottom)
+
+	maxValue := 0
+	for _, p := range points {
+		if p.value > maxValue {
+			maxValue = p.value
+		}
+	}
+
+	step := niceStep(float64(maxValue) / chartYTicks)
+	top := step * chartYTicks
+	x := func(t time.Time) float64 {
+		if t.Before(from) {
+			t = from
+		}
+
+		return chartLeft + plotW*float64(t.Sub(from))/float64(to.Sub(from))
+	}
+
+	y := func(v float64) float64 { return chartTop + plotH - plotH*v/top }
+
+	fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" `+
+		`font-family="sans-serif" font-size="12">`+"\n", chartWidth, chartHeight, chartWidth, chartHeight)
+	fmt.Fprintf(w, `<rect width="100%%" height="100%%" fill="white"/>`+"\n")
+	fmt.Fprintf(w, `<text x="%d" y="24" font-size="16">%s</text>`+"\n", chartLeft, html.EscapeString(title))
+
+	for i := 0; i <= chartYTicks; i++ {
+		v := step * float64(i)
+		fmt.Fprintf(w, `<line x1="%d" x2="%d" y1="%.1f" y2="%.1f" stroke="#ddd"/>`+"\n", chartLeft, chartWidth-chartRight, y(v), y(v))
+		fmt.Fprintf(w, `<text x="%d" y="%.1f" text-anchor="end">%s</text>`+"\n", chartLeft-6, y(v)+4, formatTick(v))
+	}
+
+	layout := "Jan 2"
+	if to.Sub(from) <= 48*time.Hour {
+		layout = "Jan 2 15:04"
+	}
+
+	for i := 0; i <= chartXTicks; i++ {
+		t := from.Add(time.Duration(float64(to.Sub(from)) * float64(i) / chartXTicks))
+		fmt.Fprintf(w, `<text x="%.1f" y="%d" text-anchor="middle">%s</text>`+"\n", x(t), chartHeight-chartBottom+18, t.Local().Format(layout))
+	}
+
+	if len(points) == 0 {
+		fmt.Fprintf(w, `<text x="%d" y="%d" text-anchor="middle">No history in this window</text>`+"\n", chartLeft+int(plotW)/2, chartTop+int(plotH)/2)
+	} else {
+		coords := []string{}
+		for _, p := range points {
+			coords = append(coords, fmt.Sprintf("%.1f,%.1f", x(p.at), y(float64(p.value))))
+		}
+
+		// The last value still holds now, so carry it to the right edge
+		last := points[len(points)-1]
+		coords = append(coords, fmt.Sprintf("%.1f,%.1f", x(to), y(float64(last.value))))
+		fmt.Fprintf(w, `<polyline fill="none" stroke="#1f77b4" stroke-width="2" points="%s"/>`+"\n", strings.Join(coords, " "))
+	}
+
+	fmt.Fprintln(w, "</svg>")
+}
+
+// niceStep rounds v up to 1, 2 or 5 times a power of ten, so that axis ticks are round numbers. It is never below 1
+// since every metric is a whole number.
+func niceStep(v float64) float64 {
+	if v <= 1 {
+		return 1
+	}
+
+	magnitude := math.Pow(10, math.Floor(math.Log10(v)))
+	for _, m := range []float64{1, 2, 5, 10} {
+		if m*magnitude >= v {
+			return m * magnitude
+		}
+	}
+
+	return 10 * magnitude
+}
+
+func formatTick(v float64) string {
+	if v >= 10000 {
+		return fmt.Sprintf("%.0fk", v/1000)
+	}
+
+	return fmt.Sprintf("%.0f", v)
+}
+
+func (b *bot) chart(n *network, _ *irc.Event, args *commandArgs) *commandResult {
+	if b.charts == nil {
+		return errorf("charts need the HTTP server, set http.listen")
+	}
+
+	metric := args.str("metric")
+	if _, exists := chartMetrics[metric]; !exists {
+		return errorf("unknown metric %q, use one of %s", metric, strings.Join(chartMetricNames(), ", "))
+	}
+
+	window := args.duration("window", defaultChartWindow)
+	if window <= 0 {
+		return errorf("window must be positive")
+	}
+
+	link, err := b.charts.add(chartSpec{Network: n.name, Metric: metric, Window: window})
+	if err != nil {
+		return errorResult(err)
+	}
+
+	return resultf(struct {
+		Metric string `json:"metric"`
+		Window string `json:"window"`
+		URL    string `json:"url"`
+	}{metric, formatDuration(window), link}, "%s on %s over the last %s: %s", metric, n.name, formatDuration(window), link)
+}
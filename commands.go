@@ -0,0 +1,639 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	irc "github.com/thoj/go-ircevent"
+)
+
+// argKind is the type of a command argument or flag value
+type argKind int
+
+const (
+	argString argKind = iota
+	argServer
+	argInt
+	argDuration
+	argFilter
+	// argBool is only valid for flags, which are then switches that take no value
+	argBool
+)
+
+func (k argKind) String() string {
+	switch k {
+	case argServer:
+		return "server"
+	case argInt:
+		return "int"
+	case argDuration:
+		return "duration"
+	case argFilter:
+		return "filter"
+	}
+
+	return ""
+}
+
+// argSpec describes a positional argument or a flag
+type argSpec struct {
+	name string
+	kind argKind
+	desc string
+	// optional arguments may be left out. Only trailing arguments can be optional.
+	optional bool
+	// rest collects every remaining positional argument. It must be the last argument.
+	rest bool
+}
+
+func (a argSpec) usage() string {
+	out := a.name
+	if kind := a.kind.String(); kind != "" && kind != a.name {
+		out += ":" + kind
+	}
+
+	out = "<" + out + ">"
+	if a.rest {
+		out += "..."
+	}
+
+	if a.optional {
+		out = "[" + out + "]"
+	}
+
+	return out
+}
+
+func (a argSpec) flagUsage() string {
+	if a.kind == argBool {
+		return "[--" + a.name + "]"
+	}
+
+	kind := a.kind.String()
+	if kind == "" {
+		kind = a.name
+	}
+
+	return fmt.Sprintf("[--%s <%s>]", a.name, kind)
+}
+
+// commandFunc runs a command against n. e is the message that ran it, which is nil when it did not come from IRC.
+type commandFunc func(n *network, e *irc.Event, args *commandArgs) *commandResult
+
+// command is a chat command. A command with subcommands runs its own run func when the first argument does not
+// name one of them.
+type command struct {
+	name        string
+	desc        string
+	aliases     []string
+	args        []argSpec
+	flags       []argSpec
+	subcommands []*command
+	run         commandFunc
+
+	parent *command
+}
+
+// path is the command name as typed, including any parent commands
+func (c *command) path() string {
+	if c.parent == nil {
+		return c.name
+	}
+
+	return c.parent.path() + " " + c.name
+}
+
+// usage returns a usage line generated from the argument and flag specs
+func (c *command) usage(prefix string) string {
+	parts := []string{prefix + c.path()}
+	for _, f := range c.flags {
+		parts = append(parts, f.flagUsage())
+	}
+
+	for _, a := range c.args {
+		parts = append(parts, a.usage())
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func (c *command) subcommand(name string) (*command, bool) {
+	for _, sub := range c.subcommands {
+		if sub.name == name || stringSliceContains(name, sub.aliases) {
+			return sub, true
+		}
+	}
+
+	return nil, false
+}
+
+func (c *command) flag(name string) (argSpec, bool) {
+	for _, f := range c.flags {
+		if f.name == name {
+			return f, true
+		}
+	}
+
+	return argSpec{}, false
+}
+
+// commandRegistry holds every chat command, indexed by name and alias
+type commandRegistry struct {
+	commands map[string]*command
+	aliases  map[string]*command
+}
+
+func newCommandRegistry() *commandRegistry {
+	return &commandRegistry{commands: make(map[string]*command), aliases: make(map[string]*command)}
+}
+
+func (r *commandRegistry) add(c *command) {
+	for _, sub := range c.subcommands {
+		sub.parent = c
+	}
+
+	r.commands[c.name] = c
+	for _, alias := range c.aliases {
+		r.aliases[alias] = c
+	}
+}
+
+// lookup finds a command by name or alias
+func (r *commandRegistry) lookup(name string) (*command, bool) {
+	if c, exists := r.commands[name]; exists {
+		return c, true
+	}
+
+	c, exists := r.aliases[name]
+	return c, exists
+}
+
+// names returns every command name, sorted
+func (r *commandRegistry) names() []string {
+	out := []string{}
+	for name := range r.commands {
+		out = append(out, name)
+	}
+
+	sort.Strings(out)
+	return out
+}
+
+// commandArgs are the parsed arguments and flags for a command
+type commandArgs struct {
+	values map[string]interface{}
+	rest   []string
+}
+
+func (a *commandArgs) has(name string) bool {
+	_, exists := a.values[name]
+	return exists
+}
+
+func (a *commandArgs) str(name string) string {
+	switch v := a.values[name].(type) {
+	case string:
+		return v
+	case serverName:
+		return string(v)
+	case *Server:
+		return v.Name
+	}
+
+	return ""
+}
+
+func (a *commandArgs) int(name string, def int) int {
+	if v, ok := a.values[name].(int); ok {
+		return v
+	}
+
+	return def
+}
+
+func (a *commandArgs) duration(name string, def time.Duration) time.Duration {
+	if v, ok := a.values[name].(time.Duration); ok {
+		return v
+	}
+
+	return def
+}
+
+func (a *commandArgs) bool(name string) bool {
+	v, _ := a.values[name].(bool)
+	return v
+}
+
+func (a *commandArgs) filter(name string) (serverFilter, bool) {
+	f, ok := a.values[name].(serverFilter)
+	return f, ok
+}
+
+// server returns a server argument. It is only set once resolveServers has been called.
+func (a *commandArgs) server(name string) *Server {
+	s, _ := a.values[name].(*Server)
+	return s
+}
+
+// resolveServers looks up every server argument in t
+func (a *commandArgs) resolveServers(t *topology) error {
+	for name, v := range a.values {
+		nameOrID, ok := v.(serverName)
+		if !ok {
+			continue
+		}
+
+		srv, err := t.mustGetServer(string(nameOrID))
+		if err != nil {
+			return err
+		}
+
+		a.values[name] = srv
+	}
+
+	return nil
+}
+
+// serverName is an unresolved server argument
+type serverName string
+
+// parseCommandArgs finds the subcommand tokens select, if any, and parses the rest of tokens against its specs.
+// Flags are given as --name, --name value, or --name=value. A single dash is also accepted for flags the command
+// knows about, and "--" ends flag parsing.
+func parseCommandArgs(c *command, tokens []string) (*command, *commandArgs, error) {
+	if len(tokens) > 0 {
+		if sub, exists := c.subcommand(tokens[0]); exists {
+			return parseCommandArgs(sub, tokens[1:])
+		}
+	}
+
+	if c.run == nil && len(c.subcommands) > 0 {
+		names := []string{}
+		for _, sub := range c.subcommands {
+			names = append(names, sub.name)
+		}
+
+		return c, nil, fmt.Errorf("%s needs a subcommand: %s", c.path(), strings.Join(names, ", "))
+	}
+
+	out := &commandArgs{values: make(map[string]interface{})}
+	positional := []string{}
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		if tok == "--" {
+			positional = append(positional, tokens[i+1:]...)
+			break
+		}
+
+		name, value, hasValue := "", "", false
+		switch {
+		case strings.HasPrefix(tok, "--") && len(tok) > 2:
+			name = tok[2:]
+		case strings.HasPrefix(tok, "-") && len(tok) > 1:
+			if _, known := c.flag(strings.SplitN(tok[1:], "=", 2)[0]); known {
+				name = tok[1:]
+			}
+		}
+
+		if name == "" {
+			positional = append(positional, tok)
+			continue
+		}
+
+		if split := strings.SplitN(name, "=", 2); len(split) == 2 {
+			name, value, hasValue = split[0], split[1], true
+		}
+
+		spec, known := c.flag(name)
+		if !known {
+			return c, nil, fmt.Errorf("unknown flag --%s", name)
+		}
+
+		if spec.kind == argBool {
+			if hasValue {
+				return c, nil, fmt.Errorf("--%s does not take a value", name)
+			}
+
+			out.values[name] = true
+			continue
+		}
+
+		if !hasValue {
+			if i+1 >= len(tokens) {
+				return c, nil, fmt.Errorf("--%s requires a %s", name, spec.kind)
+			}
+
+			i++
+			value = tokens[i]
+		}
+
+		v, err := parseArgValue(spec, value)
+		if err != nil {
+			return c, nil, err
+		}
+
+		out.values[name] = v
+	}
+
+	for i, spec := range c.args {
+		if spec.rest {
+			if i < len(positional) {
+				out.rest = positional[i:]
+			}
+
+			positional = nil
+			break
+		}
+
+		if i >= len(positional) {
+			if spec.optional {
+				break
+			}
+
+			return c, nil, fmt.Errorf("missing %s", spec.usage())
+		}
+
+		v, err := parseArgValue(spec, positional[i])
+		if err != nil {
+			return c, nil, err
+		}
+
+		out.values[spec.name] = v
+	}
+
+	if len(positional) > len(c.args) {
+		return c, nil, fmt.Errorf("too many arguments")
+	}
+
+	return c, out, nil
+}
+
+// parseDuration is time.ParseDuration that also takes whole days and weeks, such as 30d or 2w
+func parseDuration(s string) (time.Duration, error) {
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+	if len(s) > 1 {
+		if unit, exists := units[s[len(s)-1:]]; exists {
+			if v, err := strconv.Atoi(s[:len(s)-1]); err == nil {
+				return time.Duration(v) * unit, nil
+			}
+		}
+	}
+
+	return time.ParseDuration(s)
+}
+
+// formatDuration is the inverse of parseDuration, using days for whole days
+func formatDuration(d time.Duration) string {
+	day := 24 * time.Hour
+	if d >= day && d%day == 0 {
+		return fmt.Sprintf("%dd", d/day)
+	}
+
+	out := d.String()
+	if d >= time.Minute && d%time.Minute == 0 {
+		out = strings.TrimSuffix(out, "0s")
+	}
+
+	if d >= time.Hour && d%time.Hour == 0 {
+		out = strings.TrimSuffix(out, "0m")
+	}
+
+	return out
+}
+
+func parseArgValue(spec argSpec, value string) (interface{}, error) {
+	switch spec.kind {
+	case argServer:
+		return serverName(value), nil
+
+	case argInt:
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a whole number, not %q", spec.name, value)
+		}
+
+		return v, nil
+
+	case argDuration:
+		v, err := parseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a duration like 5m, 1h30m or 7d, not %q", spec.name, value)
+		}
+
+		return v, nil
+
+	case argFilter:
+		return parseServerFilter(value)
+	}
+
+	return value, nil
+}
+
+// serverFilter selects servers by a glob on their name, or on their description when prefixed with "desc:". A
+// leading "!" inverts it.
+type serverFilter struct {
+	mask   string
+	desc   bool
+	negate bool
+}
+
+func parseServerFilter(s string) (serverFilter, error) {
+	out := serverFilter{}
+	if strings.HasPrefix(s, "!") {
+		out.negate = true
+		s = s[1:]
+	}
+
+	if strings.HasPrefix(s, "desc:") {
+		out.desc = true
+		s = strings.TrimPrefix(s, "desc:")
+	}
+
+	if s == "" {
+		return serverFilter{}, errors.New("empty filter")
+	}
+
+	out.mask = s
+	return out, nil
+}
+
+func (f serverFilter) String() string {
+	out := f.mask
+	if f.desc {
+		out = "desc:" + out
+	}
+
+	if f.negate {
+		out = "!" + out
+	}
+
+	return out
+}
+
+func (f serverFilter) match(s *Server) bool {
+	field := s.Name
+	if f.desc {
+		field = s.Description
+	}
+
+	return ircGlobMatch(f.mask, field) != f.negate
+}
+
+// dispatch returns the single PRIVMSG callback for n, which finds the command a message names and runs it
+func (b *bot) dispatch(n *network) func(e *irc.Event) {
+	prefix := b.cfg.Commands.Prefix
+	return func(e *irc.Event) {
+		fields := strings.Fields(e.MessageWithoutFormat())
+		if len(fields) == 0 || !strings.HasPrefix(fields[0], prefix) {
+			return
+		}
+
+		c, exists := b.registry.lookup(strings.TrimPrefix(fields[0], prefix))
+		if !exists {
+			return
+		}
+
+		// Authorizing may need a WHO round trip, which cant happen while we block the read loop
+		go func() {
+			var asJSON bool
+			// Nothing else would catch a panic here, and it would take every network down with it
+			defer func() {
+				if res := recover(); res != nil {
+					n.ircCon.Log.Printf("PANIC running %s from %s: %v\n%s", c.name, e.Source, res, debug.Stack())
+					b.reply(e, &commandResult{Command: c.name, Error: "PANIC! Caught and logged."}, asJSON)
+				}
+			}()
+
+			// A bad --net is only reported to those allowed to run the command here
+			target, tokens, wantJSON, err := b.globalFlags(n, fields[1:])
+			asJSON = wantJSON
+			to := target
+			if err != nil {
+				to = n
+			}
+
+			if !b.authorize(n, to, e, c.name) {
+				n.ircCon.Log.Printf("Skipping %s from %s on %s: not permitted", c.name, e.Source, to.name)
+				return
+			}
+
+			if err != nil {
+				b.reply(e, &commandResult{Command: c.name, Error: err.Error()}, asJSON)
+				return
+			}
+
+			res := b.runCommand(c, target, e, tokens)
+			if res != nil {
+				b.reply(e, res, asJSON)
+			}
+		}()
+	}
+}
+
+// runCommand parses tokens for c and runs it against n. e is the message that ran it, if it came from IRC. A nil
+// result means the command has already replied.
+func (b *bot) runCommand(c *command, n *network, e *irc.Event, tokens []string) *commandResult {
+	sub, args, err := parseCommandArgs(c, tokens)
+	if err != nil {
+		res := errorf("%s -- usage: %s", err, sub.usage(b.cfg.Commands.Prefix))
+		res.Command = sub.path()
+		return res
+	}
+
+	return b.execute(sub, n, e, args)
+}
+
+// execute runs c with already parsed args and fills in where the result came from
+func (b *bot) execute(c *command, n *network, e *irc.Event, args *commandArgs) *commandResult {
+	res := c.run(n, e, args)
+	if res != nil {
+		res.Command = c.path()
+		res.Network = n.name
+	}
+
+	return res
+}
+
+// addChatCommand registers a chat command. Who may use it is decided by the permissions rules in the config,
+// which are checked against the top level command name.
+func (b *bot) addChatCommand(c *command) {
+	b.registry.add(c)
+}
+
+type commandHelp struct {
+	Name        string        `json:"name"`
+	Aliases     []string      `json:"aliases,omitempty"`
+	Usage       string        `json:"usage,omitempty"`
+	Description string        `json:"description"`
+	Subcommands []commandHelp `json:"subcommands,omitempty"`
+}
+
+func (c *command) help(prefix string) commandHelp {
+	out := commandHelp{Name: c.path(), Aliases: c.aliases, Description: c.desc}
+	if c.run != nil {
+		out.Usage = c.usage(prefix)
+	}
+
+	for _, sub := range c.subcommands {
+		out.Subcommands = append(out.Subcommands, sub.help(prefix))
+	}
+
+	return out
+}
+
+func (b *bot) doHelp(_ *network, _ *irc.Event, args *commandArgs) *commandResult {
+	prefix := b.cfg.Commands.Prefix
+	if !args.has("command") {
+		keys := []string{}
+		data := []commandHelp{}
+		for _, name := range b.registry.names() {
+			c, _ := b.registry.lookup(name)
+			aliases := ""
+			if len(c.aliases) > 0 {
+				aliases = fmt.Sprintf(" (%s)", strings.Join(c.aliases, ", "))
+			}
+
+			keys = append(keys, name+aliases)
+			data = append(data, c.help(prefix))
+		}
+
+		return resultf(data, "available commands: %s", strings.Join(keys, ", "))
+	}
+
+	asked := strings.TrimPrefix(args.str("command"), prefix)
+	c, exists := b.registry.lookup(asked)
+	if !exists {
+		return errorf("unknown command: %q", asked)
+	}
+
+	aliases := ""
+	if len(c.aliases) > 0 {
+		aliases = fmt.Sprintf(" -- Aliases: %s", strings.Join(c.aliases, ", "))
+	}
+
+	lines := []string{fmt.Sprintf("%s: %s%s", c.name, c.desc, aliases)}
+	if c.run != nil {
+		lines[0] = fmt.Sprintf("%s -- %s%s", c.usage(prefix), c.desc, aliases)
+	}
+
+	for _, sub := range c.subcommands {
+		lines = append(lines, fmt.Sprintf("%s -- %s", sub.usage(prefix), sub.desc))
+	}
+
+	flags := []string{}
+	for _, f := range c.flags {
+		flags = append(flags, fmt.Sprintf("--%s: %s", f.name, f.desc))
+	}
+
+	if len(flags) > 0 {
+		lines = append(lines, strings.Join(flags, "; "))
+	}
+
+	lines = append(lines, "Every command also takes --net <network> and --json")
+	return newResult(c.help(prefix), lines...)
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+const defaultConfigFile = "pngraphbot.toml"
+
+type config struct {
+	IRC         ircConfig         `toml:"irc"`
+	Commands    commandsConfig    `toml:"commands"`
+	Permissions permissionsConfig `toml:"permissions"`
+	Sources     sourcesConfig     `toml:"sources"`
+	Refresh     refreshConfig     `toml:"refresh"`
+	Output      outputConfig      `toml:"output"`
+	HTTP        httpConfig        `toml:"http"`
+	Paste       pasteConfig       `toml:"paste"`
+	API         apiConfig         `toml:"api"`
+	Watch       watchConfig       `toml:"watch"`
+	Alerts      alertsConfig      `toml:"alerts"`
+	History     historyConfig     `toml:"history"`
+	Presence    presenceConfig    `toml:"presence"`
+	Reports     []reportConfig    `toml:"reports"`
+
+	// Networks holds one table per network, each with irc and sources sections. Anything a network leaves out is
+	// taken from the top level irc and sources sections, except credentials, which each network must set itself.
+	// With no networks, the top level is the only network.
+	Networks map[string]toml.Primitive `toml:"networks"`
+	networks map[string]*networkConfig
+}
+
+type networkConfig struct {
+	IRC     ircConfig     `toml:"irc"`
+	Sources sourcesConfig `toml:"sources"`
+}
+
+const defaultNetworkName = "default"
+
+type ircConfig struct {
+	Server    string   `toml:"server"`
+	TLS       bool     `toml:"tls"`
+	Nick      string   `toml:"nick"`
+	User      string   `toml:"user"`
+	RealName  string   `toml:"realname"`
+	OperIdent string   `toml:"oper_ident"`
+	Channels  []string `toml:"channels"`
+	Debug     bool     `toml:"debug"`
+
+	TLSConfig tlsConfig  `toml:"tls_config"`
+	SASL      saslConfig `toml:"sasl"`
+	Oper      operConfig `toml:"oper"`
+}
+
+type commandsConfig struct {
+	Prefix string `toml:"prefix"`
+}
+
+type sourcesConfig struct {
+	IOServURL string            `toml:"ioserv_url"`
+	IDCache   string            `toml:"id_cache"`
+	StaticIDs map[string]string `toml:"static_ids"`
+	GraphMode string            `toml:"graph_mode"`
+}
+
+type refreshConfig struct {
+	// Timeout is how long to wait for MAP and LINKS to finish
+	Timeout time.Duration `toml:"timeout"`
+	// MinInterval is how long collected MAP and LINKS output is reused before asking the server again
+	MinInterval  time.Duration `toml:"min_interval"`
+	GetIDTimeout time.Duration `toml:"getid_timeout"`
+	// Interval is how often the graph is rebuilt in the background, so that watches see changes. 0 disables it.
+	Interval time.Duration `toml:"interval"`
+	// MaxAge is how old the latest graph can be before a command builds a new one instead of using it
+	MaxAge time.Duration `toml:"max_age"`
+}
+
+func defaultConfig() *config {
+	return &config{
+		IRC: ircConfig{
+			Server:   "irc.awesome-dragon.science:6697",
+			TLS:      true,
+			Nick:     "graphbot",
+			User:     "pissing-on-graphs",
+			Channels: []string{"#opers"},
+			Debug:    true,
+		},
+		Commands: commandsConfig{
+			Prefix: "~",
+		},
+		Permissions: permissionsConfig{
+			File:  defaultPermissionsFile,
+			Roles: map[string]roleConfig{"admin": {}},
+		},
+		Sources: sourcesConfig{
+			IOServURL: host,
+			IDCache:   defaultIDCacheFile,
+			GraphMode: graphModeIRC,
+		},
+		Refresh: refreshConfig{
+			Timeout:      linksAndMapTimeout,
+			GetIDTimeout: getIDTimeout,
+			Interval:     5 * time.Minute,
+			MaxAge:       time.Minute,
+		},
+		Output: outputConfig{
+			PageLines:  5,
+			Burst:      5,
+			Rate:       2 * time.Second,
+			PageExpiry: 10 * time.Minute,
+			Overflow:   overflowMore,
+		},
+		Watch: watchConfig{
+			File: defaultWatchFile,
+		},
+		History: historyConfig{
+			File:           defaultHistoryFile,
+			Retention:      90 * 24 * time.Hour,
+			SampleInterval: 5 * time.Minute,
+		},
+		Presence: presenceConfig{
+			File: defaultPresenceFile,
+		},
+		Alerts: alertsConfig{
+			Cooldown: 30 * time.Minute,
+		},
+		Paste: pasteConfig{
+			Expiry:    24 * time.Hour,
+			MaxPastes: 1000,
+		},
+	}
+}
+
+// loadConfig reads the config file at path over the defaults, then applies environment overrides. A missing file
+// is not an error if mustExist is false.
+func loadConfig(path string, mustExist bool) (*config, error) {
+	cfg := defaultConfig()
+	md, err := toml.DecodeFile(path, cfg)
+	if err != nil {
+		if mustExist || !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("could not load config from %q: %w", path, err)
+		}
+	}
+
+	// Rules replace the defaults as a whole rather than adding to them, so they are only filled in when none were set
+	if len(cfg.Permissions.Rules) == 0 {
+		cfg.Permissions.Rules = defaultACLRules()
+	}
+
+	if err := cfg.applyEnv(os.Getenv); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.resolveNetworks(md); err != nil {
+		return nil, err
+	}
+
+	return cfg, cfg.validate()
+}
+
+// resolveNetworks builds the config for each network on top of the top level irc and sources sections. Credentials
+// are not inherited, so that one network's passwords and keys are never sent to another network's servers.
+func (c *config) resolveNetworks(md toml.MetaData) error {
+	c.networks = make(map[string]*networkConfig)
+	if len(c.Networks) == 0 {
+		c.networks[defaultNetworkName] = &networkConfig{IRC: c.IRC, Sources: c.Sources}
+		return nil
+	}
+
+	for name, prim := range c.Networks {
+		// Copy anything the decoder could write through to the top level config
+		nc := &networkConfig{IRC: c.IRC, Sources: c.Sources}
+		nc.IRC.withoutCredentials()
+		nc.IRC.Channels = append([]string(nil), c.IRC.Channels...)
+		nc.Sources.StaticIDs = make(map[string]string)
+		for k, v := range c.Sources.StaticIDs {
+			nc.Sources.StaticIDs[k] = v
+		}
+
+		if nc.Sources.IDCache == defaultIDCacheFile {
+			nc.Sources.IDCache = fmt.Sprintf("serverids-%s.json", name)
+		}
+
+		if err := md.PrimitiveDecode(prim, nc); err != nil {
+			return fmt.Errorf("config: network %s: %w", name, err)
+		}
+
+		c.networks[name] = nc
+	}
+
+	return nil
+}
+
+// withoutCredentials clears everything that proves who the bot is: SASL, OPER and the TLS client certificate
+func (c *ircConfig) withoutCredentials() {
+	c.OperIdent = ""
+	c.SASL = saslConfig{}
+	c.Oper = operConfig{}
+	c.TLSConfig.Cert = ""
+	c.TLSConfig.Key = ""
+}
+
+// networkNames returns the name of every configured network, sorted
+func (c *config) networkNames() []string {
+	out := []string{}
+	for name := range c.networks {
+		out = append(out, name)
+	}
+
+	sort.Strings(out)
+	return out
+}
+
+// presence returns the presence config with max_gap filled in
+func (c *config) presence() presenceConfig {
+	out := c.Presence
+	if out.MaxGap == 0 {
+		out.MaxGap = 3 * c.Refresh.Interval
+	}
+
+	if out.MaxGap == 0 {
+		// Without background refreshes the graph is only built when someone asks, so allow for longer gaps
+		out.MaxGap = time.Hour
+	}
+
+	return out
+}
+
+// network returns the config for the named network. An empty name is allowed if there is only one network.
+func (c *config) network(name string) (*networkConfig, error) {
+	if name == "" {
+		if len(c.networks) != 1 {
+			return nil, fmt.Errorf("more than one network is configured, pick one of %s", strings.Join(c.networkNames(), ", "))
+		}
+
+		name = c.networkNames()[0]
+	}
+
+	nc, exists := c.networks[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown network %q, available: %s", name, strings.Join(c.networkNames(), ", "))
+	}
+
+	return nc, nil
+}
+
+// applyEnv overrides config values from the environment. OPERIDENT, IDCACHE, STATICIDS and IOSERV_URL are kept
+// from before the config file existed.
+func (c *config) applyEnv(getenv func(string) string) error {
+	strs := map[string]*string{
+		"PNGRAPHBOT_SERVER":        &c.IRC.Server,
+		"PNGRAPHBOT_NICK":          &c.IRC.Nick,
+		"PNGRAPHBOT_USER":          &c.IRC.User,
+		"PNGRAPHBOT_REALNAME":      &c.IRC.RealName,
+		"PNGRAPHBOT_PREFIX":        &c.Commands.Prefix,
+		"PNGRAPHBOT_GRAPH_MODE":    &c.Sources.GraphMode,
+		"PNGRAPHBOT_SASL_LOGIN":    &c.IRC.SASL.Login,
+		"PNGRAPHBOT_SASL_PASSWORD": &c.IRC.SASL.Password,
+		"PNGRAPHBOT_OPER_NAME":     &c.IRC.Oper.Name,
+		"PNGRAPHBOT_OPER_PASSWORD": &c.IRC.Oper.Password,
+		"PNGRAPHBOT_PERMISSIONS":   &c.Permissions.File,
+		"PNGRAPHBOT_HTTP_LISTEN":   &c.HTTP.Listen,
+		"PNGRAPHBOT_OVERFLOW":      &c.Output.Overflow,
+		"PNGRAPHBOT_WATCH_FILE":    &c.Watch.File,
+		"PNGRAPHBOT_HISTORY_FILE":  &c.History.File,
+		"PNGRAPHBOT_PRESENCE_FILE": &c.Presence.File,
+		"OPERIDENT":                &c.IRC.OperIdent,
+		"IDCACHE":                  &c.Sources.IDCache,
+		"IOSERV_URL":               &c.Sources.IOServURL,
+	}
+
+	for name, target := range strs {
+		if res := getenv(name); res != "" {
+			*target = res
+		}
+	}
+
+	if res := getenv("PNGRAPHBOT_CHANNELS"); res != "" {
+		c.IRC.Channels = splitList(res)
+	}
+
+	bools := map[string]*bool{
+		"PNGRAPHBOT_TLS":   &c.IRC.TLS,
+		"PNGRAPHBOT_DEBUG": &c.IRC.Debug,
+	}
+
+	for name, target := range bools {
+		if res := getenv(name); res != "" {
+			v, err := strconv.ParseBool(res)
+			if err != nil {
+				return fmt.Errorf("invalid value for %s: %w", name, err)
+			}
+
+			*target = v
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"PNGRAPHBOT_REFRESH_TIMEOUT":      &c.Refresh.Timeout,
+		"PNGRAPHBOT_REFRESH_MIN_INTERVAL": &c.Refresh.MinInterval,
+		"PNGRAPHBOT_REFRESH_INTERVAL":     &c.Refresh.Interval,
+		"PNGRAPHBOT_REFRESH_MAX_AGE":      &c.Refresh.MaxAge,
+	}
+
+	for name, target := range durations {
+		if res := getenv(name); res != "" {
+			v, err := time.ParseDuration(res)
+			if err != nil {
+				return fmt.Errorf("invalid value for %s: %w", name, err)
+			}
+
+			*target = v
+		}
+	}
+
+	if res := getenv("STATICIDS"); res != "" {
+		if c.Sources.StaticIDs == nil {
+			c.Sources.StaticIDs = make(map[string]string)
+		}
+
+		for name, id := range parseStaticIDs(res) {
+			c.Sources.StaticIDs[name] = id
+		}
+	}
+
+	return nil
+}
+
+func (c *config) validate() error {
+	switch {
+	case c.Commands.Prefix == "":
+		return errors.New("config: commands.prefix must be set")
+	case c.Refresh.Timeout <= 0 || c.Refresh.GetIDTimeout <= 0:
+		return errors.New("config: refresh timeouts must be positive")
+	case c.Refresh.Interval < 0 || c.Refresh.MaxAge < 0:
+		return errors.New("config: refresh.interval and refresh.max_age cannot be negative")
+	case c.Output.PageLines < 1 || c.Output.Burst < 1:
+		return errors.New("config: output.page_lines and output.burst must be at least 1")
+	case c.Output.Rate <= 0 || c.Output.PageExpiry <= 0:
+		return errors.New("config: output.rate and output.page_expiry must be positive")
+	case !stringSliceContains(c.Output.Overflow, []string{overflowMore, overflowPaste}):
+		return fmt.Errorf("config: unknown output.overflow %q", c.Output.Overflow)
+	case c.Output.Overflow == overflowPaste && c.HTTP.Listen == "":
+		return errors.New("config: output.overflow \"paste\" needs http.listen")
+	case c.Paste.Expiry <= 0 || c.Paste.MaxPastes < 1:
+		return errors.New("config: paste.expiry and paste.max_pastes must be positive")
+	case len(c.API.Tokens) > 0 && c.HTTP.Listen == "":
+		return errors.New("config: api.tokens needs http.listen")
+	}
+
+	if err := c.Alerts.validate(); err != nil {
+		return fmt.Errorf("config: alerts: %w", err)
+	}
+
+	if c.History.Retention <= 0 || c.History.SampleInterval < 0 {
+		return errors.New("config: history.retention must be positive and history.sample_interval not negative")
+	}
+
+	if c.Presence.MaxGap < 0 {
+		return errors.New("config: presence.max_gap cannot be negative")
+	}
+
+	for i, r := range c.Reports {
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("config: reports[%d]: %w", i, err)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i, tok := range c.API.Tokens {
+		switch {
+		case tok.Name == "" || tok.Token == "":
+			return fmt.Errorf("config: api.tokens[%d] needs a name and a token", i)
+		case seen[tok.Token]:
+			return fmt.Errorf("config: api.tokens[%d] (%s) reuses another token", i, tok.Name)
+		}
+
+		seen[tok.Token] = true
+	}
+
+	for i, rule := range c.Permissions.Rules {
+		for _, name := range rule.Networks {
+			if _, exists := c.networks[name]; !exists {
+				return fmt.Errorf("config: permissions.rules[%d] names unknown network %q", i, name)
+			}
+		}
+
+		for _, role := range rule.Roles {
+			if _, exists := c.Permissions.Roles[role]; !exists && role != roleEveryone {
+				// Roles can also be created at runtime with grant, so this is only worth a warning
+				fmt.Fprintf(os.Stderr, "config: permissions.rules[%d] uses role %q which is not defined in the config\n", i, role)
+			}
+		}
+	}
+
+	for _, name := range c.networkNames() {
+		if err := c.networks[name].validate(); err != nil {
+			return fmt.Errorf("config: network %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *networkConfig) validate() error {
+	switch {
+	case c.IRC.Server == "":
+		return errors.New("irc.server must be set")
+	case c.IRC.Nick == "" || c.IRC.User == "":
+		return errors.New("irc.nick and irc.user must be set")
+	case !stringSliceContains(c.Sources.GraphMode, []string{graphModeIRC, graphModeJSON, graphModeMerged}):
+		return fmt.Errorf("unknown sources.graph_mode %q", c.Sources.GraphMode)
+	case c.Sources.GraphMode != graphModeIRC && c.Sources.IOServURL == "":
+		return fmt.Errorf("sources.graph_mode %q needs sources.ioserv_url", c.Sources.GraphMode)
+	case !stringSliceContains(c.IRC.Oper.Method, []string{"", operMethodPassword, operMethodCertFP, operMethodChallenge}):
+		return fmt.Errorf("unknown irc.oper.method %q", c.IRC.Oper.Method)
+	case c.IRC.Oper.Method == operMethodChallenge && c.IRC.Oper.ChallengeKey == "":
+		return errors.New("irc.oper.challenge_key is required for CHALLENGE")
+	case strings.EqualFold(c.IRC.SASL.Mechanism, saslMechanismExternal) && !c.IRC.TLS:
+		return errors.New("SASL EXTERNAL requires TLS")
+	}
+
+	return nil
+}
+
+func splitList(s string) []string {
+	out := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestNetworksDoNotInheritCredentials(t *testing.T) {
+	cfg := defaultConfig()
+	md, err := toml.Decode(`
+[irc]
+oper_ident = "main secret"
+[irc.sasl]
+mechanism = "PLAIN"
+login = "graphbot"
+password = "sasl secret"
+[irc.oper]
+name = "graphbot"
+password = "oper secret"
+[irc.tls_config]
+cert = "main.pem"
+key = "main.key"
+ca = "ca.pem"
+
+[networks.main.irc.oper]
+name = "graphbot"
+password = "oper secret"
+
+[networks.other.irc]
+server = "irc.example.net:6697"
+`, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cfg.resolveNetworks(md); err != nil {
+		t.Fatal(err)
+	}
+
+	other := cfg.networks["other"].IRC
+	if other.OperIdent != "" || other.SASL != (saslConfig{}) || other.Oper != (operConfig{}) ||
+		other.TLSConfig.Cert != "" || other.TLSConfig.Key != "" {
+		t.Errorf("other network inherited credentials: %+v", other)
+	}
+
+	if other.TLSConfig.CA != "ca.pem" {
+		t.Errorf("other network lost the CA bundle: %q", other.TLSConfig.CA)
+	}
+
+	if cfg.networks["main"].IRC.Oper.Password != "oper secret" {
+		t.Errorf("main network lost its own oper block: %+v", cfg.networks["main"].IRC.Oper)
+	}
+}
+
+func TestNoDefaultAdmins(t *testing.T) {
+	cfg := defaultConfig()
+	if _, err := toml.Decode(`
+[permissions.roles.staff]
+accounts = ["carol"]
+`, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, r := range cfg.Permissions.Roles {
+		if (len(r.Accounts) > 0 && name != "staff") || len(r.Hostmasks) > 0 || r.Opers {
+			t.Errorf("%s has holders the config did not give it: %+v", name, r)
+		}
+	}
+}
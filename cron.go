@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed five field cron expression: minute, hour, day of month, month and day of week
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny record a * day field. When both day fields are restricted, either may match.
+	domAny, dowAny bool
+}
+
+var cronShorthands = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// parseCron parses a cron expression such as "0 9 * * 1" (09:00 every Monday). Fields take *, numbers, ranges
+// like 1-5, lists like 1,3,5 and steps like */15 or 0-30/10. Day of week is 0-7 where 0 and 7 are Sunday. The
+// shorthands @hourly, @daily, @weekly and @monthly are also accepted.
+func parseCron(expr string) (*cronSchedule, error) {
+	if long, exists := cronShorthands[strings.TrimSpace(expr)]; exists {
+		expr = long
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q needs 5 fields, not %d", expr, len(fields))
+	}
+
+	limits := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	names := [5]string{"minute", "hour", "day of month", "month", "day of week"}
+	sets := [5]uint64{}
+	for i, field := range fields {
+		set, err := parseCronField(field, limits[i][0], limits[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("cron expression %q: %s: %w", expr, names[i], err)
+		}
+
+		sets[i] = set
+	}
+
+	// Sunday can be 0 or 7
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+
+	return &cronSchedule{
+		minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+		domAny: fields[2] == "*", dowAny: fields[4] == "*",
+	}, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var out uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if split := strings.SplitN(part, "/", 2); len(split) == 2 {
+			v, err := strconv.Atoi(split[1])
+			if err != nil || v < 1 {
+				return 0, fmt.Errorf("bad step %q", split[1])
+			}
+
+			part, step = split[0], v
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			v, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, fmt.Errorf("bad value %q", bounds[0])
+			}
+
+			lo, hi = v, v
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("bad value %q", bounds[1])
+				}
+			} else if step > 1 {
+				// 5/15 means every 15 starting at 5
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			out |= 1 << uint(v)
+		}
+	}
+
+	return out, nil
+}
+
+// matches reports whether the schedule fires in the minute containing t
+func (c *cronSchedule) matches(t time.Time) bool {
+	has := func(set uint64, v int) bool { return set&(1<<uint(v)) != 0 }
+	if !has(c.minute, t.Minute()) || !has(c.hour, t.Hour()) || !has(c.month, int(t.Month())) {
+		return false
+	}
+
+	domMatch, dowMatch := has(c.dom, t.Day()), has(c.dow, int(t.Weekday()))
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dowMatch
+	case c.dowAny:
+		return domMatch
+	}
+
+	return domMatch || dowMatch
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	irc "github.com/thoj/go-ircevent"
+)
+
+// testNetwork is a small network with one server missing from MAP:
+//
+//	hub.test.net - leaf1.test.net
+//	             - leaf2.test.net - hidden.test.net
+var (
+	testServers = []fakeServer{
+		{name: "hub.test.net", id: "001", desc: "Hub", users: 10},
+		{name: "leaf1.test.net", id: "002", desc: "Leaf one", users: 5},
+		{name: "leaf2.test.net", id: "003", desc: "Leaf two", users: 3},
+		{name: "hidden.test.net", id: "004", desc: "Hidden leaf", users: 2, hidden: true},
+	}
+
+	testLinks = [][2]string{
+		{"leaf1.test.net", "hub.test.net"},
+		{"leaf2.test.net", "hub.test.net"},
+		{"hidden.test.net", "leaf2.test.net"},
+		{"hub.test.net", "hub.test.net"},
+	}
+)
+
+// testLog collects what a connection logs, so tests can wait for decisions that are only logged
+type testLog struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *testLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.buf.Write(p)
+}
+
+func (l *testLog) contains(s string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return strings.Contains(l.buf.String(), s)
+}
+
+// waitUntil polls cond until it is true, failing the test if that takes too long
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testConfig returns a config for a single network on server, with every file kept in a temporary directory and short
+// timeouts. configure, if not nil, may change it before it is validated.
+func testConfig(t *testing.T, server string, configure func(*config)) *config {
+	t.Helper()
+
+	dir := t.TempDir()
+	cfg := defaultConfig()
+	cfg.IRC = ircConfig{
+		Server:   server,
+		Nick:     "graphbot",
+		User:     "graphs",
+		Channels: []string{"#opers"},
+		Oper:     operConfig{Name: "graphbot", Password: "hunter2"},
+	}
+
+	cfg.Sources = sourcesConfig{IDCache: filepath.Join(dir, "serverids.json"), GraphMode: graphModeIRC}
+	cfg.Permissions.File = filepath.Join(dir, "permissions.json")
+	cfg.Permissions.Roles = map[string]roleConfig{"admin": {Accounts: []string{"A_Dragon"}}}
+	cfg.Permissions.Rules = defaultACLRules()
+	cfg.Watch.File = filepath.Join(dir, "watches.json")
+	cfg.History.File = filepath.Join(dir, "history.json")
+	cfg.Presence.File = filepath.Join(dir, "presence.json")
+	cfg.Refresh = refreshConfig{Timeout: 2 * time.Second, GetIDTimeout: 500 * time.Millisecond}
+	cfg.Output.Rate = time.Millisecond
+
+	if configure != nil {
+		configure(cfg)
+	}
+
+	if err := cfg.resolveNetworks(toml.MetaData{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	return cfg
+}
+
+// startTestBot connects a bot to d and waits for it to finish registering and join its channels. It returns the
+// bot's only network, the server side of its connection, and what the connection logs.
+func startTestBot(t *testing.T, d *fakeIRCd, configure func(*config)) (*bot, *network, *fakeClient, *testLog) {
+	t.Helper()
+	silenceLog(t)
+
+	b, err := NewBot(testConfig(t, d.addr(), configure))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := b.networks[defaultNetworkName]
+	c, logs := connectTestNetwork(t, d, n)
+	return b, n, c, logs
+}
+
+// connectTestNetwork connects n to d and waits for it to finish registering and join its channels
+func connectTestNetwork(t *testing.T, d *fakeIRCd, n *network) (*fakeClient, *testLog) {
+	t.Helper()
+
+	d.setNetwork(testServers, testLinks)
+	d.setOper("graphbot", "hunter2")
+
+	logs := &testLog{}
+	n.ircCon.Log = log.New(logs, "", 0)
+	n.ids.log = n.ircCon.Log
+
+	if err := n.ircCon.Connect(n.cfg.IRC.Server); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		n.ircCon.Quit()
+		d.close()
+		n.ircCon.Disconnect()
+	})
+
+	c := d.client()
+	d.waitFor(func(line string) bool { return strings.HasPrefix(line, "JOIN ") }, 5*time.Second)
+	return c, logs
+}
+
+func TestOperAndGraph(t *testing.T) {
+	d := newFakeIRCd(t)
+	_, n, _, _ := startTestBot(t, d, nil)
+	waitUntil(t, "OPER", n.isOper)
+
+	g, err := n.ircGraph()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(g) != len(testServers) {
+		t.Fatalf("got %d servers, want %d: %v", len(g), len(testServers), g.values())
+	}
+
+	for _, want := range testServers {
+		srv := g[want.id]
+		if srv == nil || srv.Name != want.name {
+			t.Errorf("server %s: got %v, want %s", want.id, srv, want.name)
+		}
+	}
+
+	// The hidden server was not in MAP, so its ID must have come from GETID
+	if entry, ok := n.ids.cached("hidden.test.net"); !ok || entry.ID != "004" || entry.Source != "GETID" {
+		t.Errorf("hidden.test.net: got %+v, want ID 004 from GETID", entry)
+	}
+
+	top := newTopology(g)
+	if i, _ := top.lookup("001"); top.degree(i) != 2 {
+		t.Errorf("hub has %d peers, want 2 without the link to itself", top.degree(i))
+	}
+
+	if d := top.distance(g["002"], g["004"]); d != 3 {
+		t.Errorf("leaf1 to hidden is %d hops, want 3", d)
+	}
+}
+
+func TestGetID(t *testing.T) {
+	d := newFakeIRCd(t)
+	_, n, _, _ := startTestBot(t, d, nil)
+	src := getIDSource{con: n.ircCon, timeout: n.refresh.GetIDTimeout}
+
+	ids, err := src.LookupIDs([]string{"LEAF1.test.net", "hidden.test.net", "gone.test.net"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"LEAF1.test.net": "002", "hidden.test.net": "004"}
+	if len(ids) != len(want) {
+		t.Errorf("got %v, want %v", ids, want)
+	}
+
+	for name, id := range want {
+		if ids[name] != id {
+			t.Errorf("%s: got %q, want %q", name, ids[name], id)
+		}
+	}
+
+	d.ignore("GETID")
+	if _, err := src.LookupIDs([]string{"leaf2.test.net"}); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("got %v, want a timeout", err)
+	}
+}
+
+func TestUpdateLinksAndMapErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(d *fakeIRCd)
+		want  string
+	}{
+		{"refused", func(d *fakeIRCd) { d.refuse("MAP", ERR_NOPRIVILEGES) }, "server refused MAP or LINKS"},
+		{"unsupported", func(d *fakeIRCd) { d.refuse("LINKS", ERR_UNKNOWNCOMMAND) }, "server does not support LINKS"},
+		{"unterminated", func(d *fakeIRCd) { d.ignore("MAP") }, "timed out after 300ms waiting for MAP and LINKS"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newFakeIRCd(t)
+			_, n, _, _ := startTestBot(t, d, func(cfg *config) { cfg.Refresh.Timeout = 300 * time.Millisecond })
+			tt.setup(d)
+
+			err := n.updateLinksAndMap()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got %v, want %q", err, tt.want)
+			}
+
+			if links, sMap := n.linksAndMap(); links != nil || sMap != nil {
+				t.Errorf("a failed update kept %d LINKS and %d MAP lines", len(links), len(sMap))
+			}
+		})
+	}
+
+	t.Run("disconnected", func(t *testing.T) {
+		d := newFakeIRCd(t)
+		_, n, _, _ := startTestBot(t, d, nil)
+		n.ircCon.Quit()
+
+		if err := n.updateLinksAndMap(); err == nil || err.Error() != "not connected to IRC" {
+			t.Fatalf("got %v, want not connected", err)
+		}
+	})
+}
+
+func TestCommands(t *testing.T) {
+	d := newFakeIRCd(t)
+	_, n, c, _ := startTestBot(t, d, nil)
+	waitUntil(t, "OPER", n.isOper)
+
+	tests := []struct {
+		message string
+		want    string
+	}{
+		{"~count", "Currently there are 4 servers on the network"},
+		{"~hb leaf1.test.net hidden.test.net", "3"},
+		{"~showhopsbetween leaf1.test.net nowhere.test.net", "Error: "},
+		{"~graphmode sideways", `Error: Unknown graph mode "sideways"`},
+		{"~count --net nowhere", `Error: unknown network "nowhere"`},
+	}
+
+	for _, tt := range tests {
+		c.privmsg("alice!alice@user.host", "#opers", tt.message)
+		if got := d.waitForPrivmsg("#opers"); !strings.Contains(got, tt.want) {
+			t.Errorf("%s: got %q, want it to contain %q", tt.message, got, tt.want)
+		}
+	}
+
+	// Messages that are not commands are ignored, so the next reply is to the JSON request
+	c.privmsg("alice!alice@user.host", "#opers", "count")
+	c.privmsg("alice!alice@user.host", "#opers", "~nosuchcommand")
+	c.privmsg("alice!alice@user.host", "#opers", "~count --json")
+
+	var res commandResult
+	if err := json.Unmarshal([]byte(d.waitForPrivmsg("#opers")), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if !res.OK || res.Command != "count" || res.Network != defaultNetworkName {
+		t.Errorf("got %+v", res)
+	}
+}
+
+func TestCommandsUnopered(t *testing.T) {
+	d := newFakeIRCd(t)
+	_, n, c, logs := startTestBot(t, d, func(cfg *config) { cfg.IRC.Oper.Password = "wrong" })
+	waitUntil(t, "OPER to fail", func() bool { return logs.contains("OPER failed") })
+
+	if n.isOper() {
+		t.Fatal("opered with the wrong password")
+	}
+
+	c.privmsg("alice!alice@user.host", "#opers", "~count")
+	if got := d.waitForPrivmsg("#opers"); !strings.HasPrefix(got, "Warning: I am not opered") {
+		t.Errorf("got %q, want a warning about not being opered", got)
+	}
+}
+
+func TestCommandPermissions(t *testing.T) {
+	d := newFakeIRCd(t)
+	_, _, c, logs := startTestBot(t, d, nil)
+	d.addUser("eve", fakeUser{account: "eve"})
+	d.addUser("dragon", fakeUser{account: "A_Dragon"})
+
+	// Outside #opers only admins may run commands. eve has to be looked up with WHO to find that out.
+	c.privmsg("eve!eve@user.host", "graphbot", "~count")
+	d.waitFor(func(line string) bool { return strings.HasPrefix(line, "WHO eve ") }, 5*time.Second)
+	waitUntil(t, "eve to be refused", func() bool { return logs.contains("Skipping count from eve!eve@user.host") })
+
+	// dragon is an admin by account, found with WHO or sent as a message tag
+	c.privmsg("dragon!dragon@user.host", "graphbot", "~count")
+	c.privmsg("other!other@user.host", "graphbot", "~count", "account=A_Dragon")
+
+	// The two are answered in whichever order their checks finish
+	replies := make(map[string]string)
+	for len(replies) < 2 {
+		line := d.waitFor(func(line string) bool { return strings.HasPrefix(line, "PRIVMSG ") }, 5*time.Second)
+		_, params := parseFakeLine(line)
+		replies[params[0]] = params[1]
+	}
+
+	for _, nick := range []string{"dragon", "other"} {
+		if !strings.Contains(replies[nick], "4 servers") {
+			t.Errorf("%s got %q", nick, replies[nick])
+		}
+	}
+
+	// help is open to everyone, anywhere
+	c.privmsg("eve!eve@user.host", "graphbot", "~help count")
+	if got := d.waitForPrivmsg("eve"); !strings.Contains(got, "count") {
+		t.Errorf("help: got %q", got)
+	}
+}
+
+func TestCommandPermissionsNickChange(t *testing.T) {
+	d := newFakeIRCd(t)
+	_, _, c, logs := startTestBot(t, d, nil)
+	d.addUser("dragon", fakeUser{account: "A_Dragon"})
+
+	c.privmsg("dragon!dragon@user.host", "graphbot", "~count")
+	if got := d.waitForPrivmsg("dragon"); !strings.Contains(got, "4 servers") {
+		t.Fatalf("dragon got %q", got)
+	}
+
+	// dragon leaves without the bot seeing it, and eve takes the nick, which must not come with dragon's account
+	c.send(":eve!eve@user.host NICK dragon")
+	d.addUser("dragon", fakeUser{account: "eve"})
+
+	c.privmsg("dragon!eve@user.host", "graphbot", "~count")
+	d.waitFor(func(line string) bool { return strings.HasPrefix(line, "WHO dragon ") }, 5*time.Second)
+	waitUntil(t, "eve to be refused", func() bool { return logs.contains("Skipping count from dragon!eve@user.host") })
+}
+
+func TestCommandPermissionsAccountTag(t *testing.T) {
+	d := newFakeIRCd(t)
+	d.offerCaps("account-tag")
+	_, n, c, logs := startTestBot(t, d, nil)
+	d.addUser("dragon", fakeUser{account: "A_Dragon"})
+	waitUntil(t, "account-tag", func() bool {
+		n.userLookupMutex.Lock()
+		defer n.userLookupMutex.Unlock()
+
+		return n.accountTags
+	})
+
+	// With account-tag, a message without the tag is from someone not logged in, whatever WHO says
+	c.privmsg("dragon!dragon@user.host", "graphbot", "~count")
+	waitUntil(t, "dragon to be refused", func() bool { return logs.contains("Skipping count from dragon!dragon@user.host") })
+
+	c.privmsg("dragon!dragon@user.host", "graphbot", "~count", "account=A_Dragon")
+	if got := d.waitForPrivmsg("dragon"); !strings.Contains(got, "4 servers") {
+		t.Errorf("dragon got %q", got)
+	}
+}
+
+func TestCommandPanic(t *testing.T) {
+	d := newFakeIRCd(t)
+	b, _, c, logs := startTestBot(t, d, nil)
+	b.addChatCommand(&command{name: "boom", desc: "Panics", run: func(*network, *irc.Event, *commandArgs) *commandResult {
+		panic("boom")
+	}})
+
+	c.privmsg("alice!alice@user.host", "#opers", "~boom")
+	got := d.waitForPrivmsg("#opers")
+	if !strings.Contains(got, "PANIC! Caught and logged.") || strings.Contains(got, "boom") {
+		t.Errorf("got %q, want a generic error about the panic", got)
+	}
+
+	waitUntil(t, "the panic to be logged", func() bool {
+		return logs.contains("PANIC running boom from alice!alice@user.host: boom")
+	})
+
+	// The bot is still there
+	c.privmsg("alice!alice@user.host", "#opers", "~count")
+	if got := d.waitForPrivmsg("#opers"); !strings.Contains(got, "4 servers") {
+		t.Errorf("got %q after the panic", got)
+	}
+}
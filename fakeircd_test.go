@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer is a server on the network a fakeIRCd pretends to be part of
+type fakeServer struct {
+	name  string
+	id    string
+	desc  string
+	users int
+	// hidden servers are left out of MAP, so their IDs have to be asked for with GETID
+	hidden bool
+}
+
+// fakeUser is someone the bot can look up with WHO
+type fakeUser struct {
+	account string
+	oper    bool
+}
+
+// fakeIRCd is an in-process IRC server that speaks just enough of the protocol for the bot: registration, OPER,
+// MAP, LINKS, GETID, WHO and JOIN. The network it reports is scripted by the test, and commands can be refused
+// or left unanswered to exercise error paths and timeouts. Everything clients send is kept for tests to wait on.
+type fakeIRCd struct {
+	t    testing.TB
+	ln   net.Listener
+	name string
+
+	mu        sync.Mutex
+	servers   []fakeServer
+	links     [][2]string
+	operName  string
+	operPass  string
+	users     map[string]fakeUser
+	caps      map[string]bool
+	refusals  map[string]string // command -> numeric sent instead of an answer
+	ignored   map[string]bool   // commands that get no answer at all
+	clients   []*fakeClient
+	connected chan *fakeClient
+
+	received chan string
+}
+
+type fakeClient struct {
+	d    *fakeIRCd
+	conn net.Conn
+	nick string
+	user string
+
+	writeMutex sync.Mutex
+}
+
+func newFakeIRCd(t testing.TB) *fakeIRCd {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &fakeIRCd{
+		t:         t,
+		ln:        ln,
+		name:      "hub.test.net",
+		users:     make(map[string]fakeUser),
+		caps:      make(map[string]bool),
+		refusals:  make(map[string]string),
+		ignored:   make(map[string]bool),
+		connected: make(chan *fakeClient, 1),
+		received:  make(chan string, 1000),
+	}
+
+	go d.accept()
+	t.Cleanup(d.close)
+	return d
+}
+
+func (d *fakeIRCd) addr() string { return d.ln.Addr().String() }
+
+// close stops listening and drops every client
+func (d *fakeIRCd) close() {
+	d.ln.Close()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, c := range d.clients {
+		c.conn.Close()
+	}
+}
+
+// setNetwork replaces the servers and links reported by MAP and LINKS. The first server is the one clients are
+// connected to.
+func (d *fakeIRCd) setNetwork(servers []fakeServer, links [][2]string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.servers, d.links = servers, links
+	if len(servers) > 0 {
+		d.name = servers[0].name
+	}
+}
+
+// setOper sets the only OPER name and password that will be accepted
+func (d *fakeIRCd) setOper(name, password string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.operName, d.operPass = name, password
+}
+
+func (d *fakeIRCd) addUser(nick string, u fakeUser) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.users[strings.ToLower(nick)] = u
+}
+
+// offerCaps makes CAP REQ for any of caps be acknowledged. Anything else is refused.
+func (d *fakeIRCd) offerCaps(caps ...string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, c := range caps {
+		d.caps[c] = true
+	}
+}
+
+// refuse answers command with the given numeric instead, such as ERR_NOPRIVILEGES or ERR_UNKNOWNCOMMAND
+func (d *fakeIRCd) refuse(command, numeric string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.refusals[command] = numeric
+}
+
+// ignore never answers command, or for MAP and LINKS, never sends the end of the list
+func (d *fakeIRCd) ignore(command string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.ignored[command] = true
+}
+
+func (d *fakeIRCd) accept() {
+	for {
+		conn, err := d.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		c := &fakeClient{d: d, conn: conn}
+		d.mu.Lock()
+		d.clients = append(d.clients, c)
+		d.mu.Unlock()
+
+		go c.serve()
+	}
+}
+
+// client waits for a client to finish registering
+func (d *fakeIRCd) client() *fakeClient {
+	d.t.Helper()
+
+	select {
+	case c := <-d.connected:
+		return c
+	case <-time.After(5 * time.Second):
+		d.t.Fatal("timed out waiting for a client to register")
+		return nil
+	}
+}
+
+// waitFor returns the first line a client sends from now on that match accepts, failing the test if none turns up
+// in time. Lines that do not match are dropped.
+func (d *fakeIRCd) waitFor(match func(line string) bool, timeout time.Duration) string {
+	d.t.Helper()
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case line := <-d.received:
+			if match(line) {
+				return line
+			}
+
+		case <-deadline:
+			d.t.Fatalf("timed out after %s waiting for a line from the client", timeout)
+			return ""
+		}
+	}
+}
+
+// waitForPrivmsg returns the text of the next PRIVMSG a client sends to target
+func (d *fakeIRCd) waitForPrivmsg(target string) string {
+	d.t.Helper()
+
+	prefix := fmt.Sprintf("PRIVMSG %s :", target)
+	line := d.waitFor(func(line string) bool { return strings.HasPrefix(line, prefix) }, 5*time.Second)
+	return strings.TrimPrefix(line, prefix)
+}
+
+func (c *fakeClient) serve() {
+	defer c.conn.Close()
+
+	scanner := bufio.NewScanner(c.conn)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		select {
+		case c.d.received <- line:
+		default:
+		}
+
+		command, params := parseFakeLine(line)
+		if !c.handle(command, params) {
+			return
+		}
+	}
+}
+
+// parseFakeLine splits a line from a client into its command and parameters. Clients do not send prefixes or tags.
+func parseFakeLine(line string) (string, []string) {
+	var trailing *string
+	if i := strings.Index(line, " :"); i >= 0 {
+		rest := line[i+2:]
+		trailing = &rest
+		line = line[:i]
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil
+	}
+
+	params := fields[1:]
+	if trailing != nil {
+		params = append(params, *trailing)
+	}
+
+	return strings.ToUpper(fields[0]), params
+}
+
+// send writes a raw line to the client
+func (c *fakeClient) send(format string, args ...interface{}) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	fmt.Fprintf(c.conn, format+"\r\n", args...)
+}
+
+// numeric sends a numeric reply from the server
+func (c *fakeClient) numeric(code string, params string) {
+	c.send(":%s %s %s %s", c.d.name, code, c.nick, params)
+}
+
+// privmsg delivers a message to the client from source, a nick!user@host. tags, such as account=name, are sent
+// as IRCv3 message tags.
+func (c *fakeClient) privmsg(source, target, text string, tags ...string) {
+	prefix := ""
+	if len(tags) > 0 {
+		prefix = "@" + strings.Join(tags, ";") + " "
+	}
+
+	c.send("%s:%s PRIVMSG %s :%s", prefix, source, target, text)
+}
+
+// handle answers a single command, returning false if the client is done
+func (c *fakeClient) handle(command string, params []string) bool {
+	d := c.d
+	d.mu.Lock()
+	refusal, refused := d.refusals[command]
+	ignored := d.ignored[command]
+	d.mu.Unlock()
+
+	switch {
+	case refused:
+		switch refusal {
+		case ERR_UNKNOWNCOMMAND:
+			c.numeric(refusal, command+" :Unknown command")
+		default:
+			c.numeric(refusal, ":Permission Denied - You're not an IRC operator")
+		}
+
+		return true
+
+	case ignored && command != "MAP" && command != "LINKS":
+		return true
+	}
+
+	switch command {
+	case "NICK":
+		registered := c.nick == "" && c.user != ""
+		c.nick = params[0]
+		if registered {
+			c.welcome()
+		}
+
+	case "USER":
+		c.user = params[0]
+		if c.nick != "" {
+			c.welcome()
+		}
+
+	case "PING":
+		c.send(":%s PONG %s :%s", d.name, d.name, strings.Join(params, " "))
+
+	case "CAP":
+		if len(params) > 1 && params[0] == "REQ" {
+			d.mu.Lock()
+			ok := d.caps[params[1]]
+			d.mu.Unlock()
+
+			reply := "NAK"
+			if ok {
+				reply = "ACK"
+			}
+
+			c.send(":%s CAP %s %s :%s", d.name, c.nick, reply, params[1])
+		}
+
+	case "OPER":
+		d.mu.Lock()
+		ok := len(params) == 2 && d.operName != "" && params[0] == d.operName && params[1] == d.operPass
+		d.mu.Unlock()
+
+		if !ok {
+			c.numeric(ERR_PASSWDMISMATCH, ":Password incorrect")
+			break
+		}
+
+		c.send(":%s MODE %s :+o", c.nick, c.nick)
+		c.numeric(RPL_YOUREOPER, ":You are now an IRC operator")
+
+	case "MAP":
+		for _, line := range d.mapLines() {
+			c.numeric(RPL_MAP, ":"+line)
+		}
+
+		if !ignored {
+			c.numeric(RPL_ENDOFMAP, ":End of /MAP")
+		}
+
+	case "LINKS":
+		for _, line := range d.linksLines() {
+			c.numeric(RPL_LINKS, line)
+		}
+
+		if !ignored {
+			c.numeric(RPL_ENDOFLINKS, "* :End of /LINKS list.")
+		}
+
+	case "GETID":
+		if id, exists := d.serverID(params[0]); exists {
+			c.send(":%s NOTICE %s :GETID: %s is %s", d.name, c.nick, params[0], id)
+		} else {
+			c.numeric(RPL_NOSUCHNICK, params[0]+" :No such server")
+		}
+
+	case "WHO":
+		nick := params[0]
+		d.mu.Lock()
+		u, exists := d.users[strings.ToLower(nick)]
+		d.mu.Unlock()
+
+		if exists {
+			flags, account := "H", "0"
+			if u.oper {
+				flags += "*"
+			}
+
+			if u.account != "" {
+				account = u.account
+			}
+
+			c.numeric(RPL_WHOSPCRPL, fmt.Sprintf("%s %s %s %s", whoxToken, nick, flags, account))
+		}
+
+		c.numeric(RPL_ENDOFWHO, nick+" :End of /WHO list.")
+
+	case "JOIN":
+		for _, channel := range strings.Split(params[0], ",") {
+			c.send(":%s!%s@fake.host JOIN %s", c.nick, c.user, channel)
+		}
+
+	case "QUIT":
+		return false
+	}
+
+	return true
+}
+
+func (c *fakeClient) welcome() {
+	c.numeric("001", ":Welcome to the fake network "+c.nick)
+	select {
+	case c.d.connected <- c:
+	default:
+	}
+}
+
+// mapLines returns MAP output for every server that is not hidden, formatted like InspIRCd does
+func (d *fakeIRCd) mapLines() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	total := 0
+	for _, s := range d.servers {
+		total += s.users
+	}
+
+	out := []string{}
+	for i, s := range d.servers {
+		if s.hidden {
+			continue
+		}
+
+		pct := 0.0
+		if total > 0 {
+			pct = 100 * float64(s.users) / float64(total)
+		}
+
+		indent := ""
+		if i > 0 {
+			indent = "`-"
+		}
+
+		out = append(out, fmt.Sprintf("%s%s ---- | Users: %d (%.2f%%) [%s]", indent, s.name, s.users, pct, s.id))
+	}
+
+	return out
+}
+
+// linksLines returns the parameters of each RPL_LINKS line, one for each side of every link
+func (d *fakeIRCd) linksLines() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	desc := make(map[string]string, len(d.servers))
+	for _, s := range d.servers {
+		desc[s.name] = s.desc
+	}
+
+	out := []string{}
+	for _, l := range d.links {
+		out = append(out, fmt.Sprintf("%s %s :1 %s", l[0], l[1], desc[l[0]]))
+	}
+
+	return out
+}
+
+func (d *fakeIRCd) serverID(name string) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, s := range d.servers {
+		if strings.EqualFold(s.name, name) {
+			return s.id, true
+		}
+	}
+
+	return "", false
+}
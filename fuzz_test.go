@@ -0,0 +1,180 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"unicode"
+
+	irc "github.com/thoj/go-ircevent"
+)
+
+// Fuzzing needs Go 1.18. The seeds are the golden corpus, so go test runs them as ordinary tests on every build.
+
+// seedCaptures adds every server line in the captures that f's target reads, as given by pick
+func seedCaptures(f *testing.F, pick func(line string) (string, bool)) {
+	for _, path := range goldenInputs(f, "captures/*.log") {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+
+		for _, line := range strings.Split(string(data), "\n") {
+			if seed, ok := pick(line); ok {
+				f.Add(seed)
+			}
+		}
+	}
+}
+
+// checkSymmetric fails if any link in g only goes one way or leads outside it
+func checkSymmetric(t *testing.T, g graph) {
+	t.Helper()
+
+	in := make(map[*Server]bool, len(g))
+	for _, srv := range g {
+		in[srv] = true
+	}
+
+	for key, srv := range g {
+		for _, peer := range srv.Peers {
+			if !in[peer] {
+				t.Fatalf("%s has a peer outside the graph: %s", key, peer.NameID())
+			}
+
+			if !peer.HasPeer(srv) {
+				t.Fatalf("%s links to %s, but not back", srv.NameID(), peer.NameID())
+			}
+		}
+	}
+}
+
+func FuzzMapLine(f *testing.F) {
+	silenceLog(f)
+	seedCaptures(f, func(line string) (string, bool) {
+		if command, params, ok := parseRawLine(line); ok && command == RPL_MAP {
+			return (&irc.Event{Arguments: params}).MessageWithoutFormat(), true
+		}
+
+		return "", false
+	})
+
+	f.Fuzz(func(t *testing.T, line string) {
+		ids, _ := mapIDSource{lines: func() []string { return []string{line} }}.LookupIDs([]string{"x"})
+		if len(ids) > 1 {
+			t.Fatalf("one line gave %d IDs", len(ids))
+		}
+
+		g, err := graphFromLinksAndMap(nil, []string{line}, nil)
+		if err != nil {
+			return
+		}
+
+		if len(g) != 1 {
+			t.Fatalf("one line gave %d servers", len(g))
+		}
+
+		for id, srv := range g {
+			if srv.Name == "" || id == "" || strings.IndexFunc(srv.Name+id, unicode.IsSpace) >= 0 {
+				t.Fatalf("bad name or ID: %q %q", srv.Name, id)
+			}
+
+			if srv.Users < 0 {
+				t.Fatalf("negative users: %d", srv.Users)
+			}
+		}
+	})
+}
+
+func FuzzLinksReply(f *testing.F) {
+	silenceLog(f)
+	seedCaptures(f, func(line string) (string, bool) {
+		if command, _, ok := parseRawLine(line); ok && command == RPL_LINKS {
+			return line, true
+		}
+
+		return "", false
+	})
+
+	f.Fuzz(func(t *testing.T, line string) {
+		command, params, ok := parseRawLine(line)
+		if !ok || command != RPL_LINKS {
+			return
+		}
+
+		links, err := splitLinksReply(params)
+		if err != nil {
+			return
+		}
+
+		if len(links) != 3 || links[0] == "" || links[1] == "" {
+			t.Fatalf("bad split of %q: %q", line, links)
+		}
+
+		g, err := graphFromLinksAndMap([][]string{links}, nil, func(names []string) map[string]string {
+			out := make(map[string]string)
+			for _, name := range names {
+				out[name] = fakeIDPrefix + name
+			}
+
+			return out
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := 2
+		if links[0] == links[1] {
+			want = 1
+		}
+
+		if len(g) != want {
+			t.Fatalf("one link gave %d servers, want %d", len(g), want)
+		}
+
+		checkSymmetric(t, g)
+	})
+}
+
+func FuzzIOServJSON(f *testing.F) {
+	for _, path := range goldenInputs(f, "ioserv/*.json") {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		g, report, err := parseIOServGraph(data)
+		if err != nil {
+			return
+		}
+
+		for id, srv := range g {
+			if srv == nil || srv.ID != id {
+				t.Fatalf("server %q is %v", id, srv)
+			}
+
+			for _, peer := range srv.Peers {
+				if peer == srv {
+					t.Fatalf("%s links to itself", id)
+				}
+			}
+		}
+
+		checkSymmetric(t, g)
+		if report == nil {
+			t.Fatal("no report")
+		}
+
+		// Anything the decoder lets through must be safe to analyse
+		top := newTopology(g)
+		top.diameter(nil)
+		top.cutPoints()
+	})
+}
@@ -2,4 +2,7 @@ module awesome-dragon.science/go/pngraphbot
 
 go 1.16
 
-require github.com/thoj/go-ircevent v0.0.0-20210419090348-35410aa86c49 // indirect
+require (
+	github.com/BurntSushi/toml v1.2.1
+	github.com/thoj/go-ircevent v0.0.0-20210419090348-35410aa86c49
+)
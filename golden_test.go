@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	irc "github.com/thoj/go-ircevent"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata from the current output")
+
+// capture is what the bot would have collected from a recorded session, in the format of the >> lines in the
+// comments: MAP and LINKS as the callbacks in doUpdateLinksAndMap store them, and the IDs any GETID replies gave
+type capture struct {
+	sMap         []string
+	links        [][]string
+	skippedLinks []string
+	ids          map[string]string
+}
+
+func readCapture(t *testing.T, path string) *capture {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	out := &capture{ids: make(map[string]string)}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		command, params, ok := parseRawLine(scanner.Text())
+		if !ok {
+			continue
+		}
+
+		e := &irc.Event{Code: command, Arguments: params, Raw: scanner.Text()}
+		switch e.Code {
+		case RPL_MAP:
+			out.sMap = append(out.sMap, e.MessageWithoutFormat())
+
+		case RPL_LINKS:
+			line, err := splitLinksReply(e.Arguments)
+			if err != nil {
+				out.skippedLinks = append(out.skippedLinks, fmt.Sprintf("%q: %s", e.Raw, err))
+				continue
+			}
+
+			out.links = append(out.links, line)
+
+		case NOTICE:
+			if pair := getIDRe.FindStringSubmatch(e.Message()); pair != nil {
+				out.ids[pair[1]] = pair[2]
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return out
+}
+
+// resolve gives the IDs from GETID replies, and a fake ID like idResolver would for anything else
+func (c *capture) resolve(names []string) map[string]string {
+	out := make(map[string]string)
+	for _, name := range names {
+		if id, exists := c.ids[name]; exists {
+			out[name] = id
+		} else {
+			out[name] = fakeIDPrefix + name
+		}
+	}
+
+	return out
+}
+
+// describeGraph writes out a graph in a stable order, for comparing with golden files
+func describeGraph(w *bytes.Buffer, g graph) {
+	fmt.Fprintf(w, "servers: %d\n", len(g))
+	for _, key := range g.keys() {
+		srv := g[key]
+		peers := []string{}
+		for _, p := range srv.Peers {
+			peers = append(peers, p.ID)
+		}
+
+		sort.Strings(peers)
+		fmt.Fprintf(
+			w, "  %s %s users=%d desc=%q version=%q peers=[%s]\n",
+			key, srv.Name, srv.Users, srv.Description, srv.Version, strings.Join(peers, " "),
+		)
+	}
+}
+
+// checkGolden compares got with the golden file at path, or rewrites the file if -update was given
+func checkGolden(t *testing.T, path string, got []byte) {
+	t.Helper()
+
+	if *updateGolden {
+		if err := ioutil.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		return
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%s (run go test -update to create it)", err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s (run go test -update to accept it)\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+func goldenInputs(t testing.TB, pattern string) []string {
+	t.Helper()
+
+	paths, err := filepath.Glob(filepath.Join("testdata", pattern))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(paths) == 0 {
+		t.Fatalf("no files match testdata/%s", pattern)
+	}
+
+	return paths
+}
+
+func TestCapturesGolden(t *testing.T) {
+	silenceLog(t)
+	for _, path := range goldenInputs(t, "captures/*.log") {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			c := readCapture(t, path)
+			out := &bytes.Buffer{}
+			fmt.Fprintf(out, "MAP lines: %d\nLINKS lines: %d\n", len(c.sMap), len(c.links))
+			for _, s := range c.skippedLinks {
+				fmt.Fprintf(out, "  skipped %s\n", s)
+			}
+
+			g, err := graphFromLinksAndMap(c.links, c.sMap, c.resolve)
+			if err != nil {
+				fmt.Fprintf(out, "error: %s\n", err)
+			} else {
+				describeGraph(out, g)
+			}
+
+			// mapIDSource is checked apart from the graph, as it is what finds IDs for servers MAP leaves out
+			names := []string{}
+			for _, line := range c.links {
+				names = append(names, line[0], line[1])
+			}
+
+			ids, _ := mapIDSource{lines: func() []string { return c.sMap }}.LookupIDs(names)
+			fmt.Fprintf(out, "IDs from MAP: %d\n", len(ids))
+			for _, name := range sortedKeys(ids) {
+				fmt.Fprintf(out, "  %s %s\n", name, ids[name])
+			}
+
+			checkGolden(t, strings.TrimSuffix(path, ".log")+".golden", out.Bytes())
+		})
+	}
+}
+
+func TestIOServGolden(t *testing.T) {
+	for _, path := range goldenInputs(t, "ioserv/*.json") {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			out := &bytes.Buffer{}
+			g, report, err := parseIOServGraph(data)
+			if err != nil {
+				fmt.Fprintf(out, "error: %s\n", err)
+			} else {
+				describeGraph(out, g)
+				reportJSON, _ := json.MarshalIndent(report, "", "\t")
+				fmt.Fprintf(out, "report: %s\n", reportJSON)
+			}
+
+			checkGolden(t, strings.TrimSuffix(path, ".json")+".golden", out.Bytes())
+		})
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	out := []string{}
+	for k := range m {
+		out = append(out, k)
+	}
+
+	sort.Strings(out)
+	return out
+}
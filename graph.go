@@ -1,12 +1,12 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"net/http"
+	"log"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -18,7 +18,10 @@ type (
 		ID          string    `json:"id"`
 		Description string    `json:"description"`
 		Version     string    `json:"version"`
+		Users       int       `json:"users"`
 		Peers       []*Server `json:"-"`
+		// Provenance records which source each field came from, for merged graphs
+		Provenance map[string]string `json:"-"`
 	}
 )
 
@@ -45,78 +48,37 @@ func (s *Server) HasPeer(other *Server) bool {
 	return false
 }
 
-func getJSON(target string) ([]byte, error) {
-	r, err := http.Get(target)
-	if err != nil {
-		return nil, err
-	}
-	defer r.Body.Close()
-	data, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	return data, nil
-}
+var (
+	mapRe    = regexp.MustCompile(`^(?P<name>\S+)\s\-*\s\|\sUsers:\s+(?P<users>\d+)\s+\(.+%\)\s\[(?P<id>\S+)\]$`)
+	oldMapRe = regexp.MustCompile(`^(?P<name>\S+)\s*\((?P<users>\d+)\)\s(?P<id>\S+)$`)
+)
 
-func getGraph(target string) (out graph, err error) {
-	defer func() {
-		res := recover()
-		if res != nil {
-			err = res.(error)
+// parseMapLine reads the server name, ID and user count from a line of MAP, in either the current layout or the
+// older "name (users) id" one
+func parseMapLine(line string) (name, id string, users int, ok bool) {
+	line = strings.TrimLeft(line, "`|- ")
+	for _, re := range []*regexp.Regexp{mapRe, oldMapRe} {
+		if match := re.FindStringSubmatch(line); match != nil {
+			users, _ = strconv.Atoi(match[re.SubexpIndex("users")])
+			return match[re.SubexpIndex("name")], match[re.SubexpIndex("id")], users, true
 		}
-	}()
-
-	type jsonStruct struct {
-		Servers map[string]*Server `json:"nodes"`
-		Links   [][2]string        `json:"links"`
-	}
-
-	parsedJSON := new(jsonStruct)
-	jsonData, err := getJSON(target)
-	if err != nil {
-		return nil, fmt.Errorf("could not get JSON data: %w", err)
-	}
-
-	if err := json.Unmarshal(jsonData, parsedJSON); err != nil {
-		return nil, err
-	}
-
-	for id, server := range parsedJSON.Servers {
-		server.ID = id
 	}
 
-	for _, linkPair := range parsedJSON.Links {
-		one := parsedJSON.Servers[linkPair[0]]
-		two := parsedJSON.Servers[linkPair[1]]
-
-		one.Peers = append(one.Peers, two)
-		two.Peers = append(two.Peers, one)
-
-	}
-
-	return parsedJSON.Servers, nil
+	return "", "", 0, false
 }
 
-var (
-	mapRe    = regexp.MustCompile(`^(?P<name>\S+)\s\-*\s\|\sUsers:\s+\d+\s+\(.+%\)\s\[(?P<id>\S+)\]$`)
-	oldMapRe = regexp.MustCompile(`^(?P<name>\S+)\s*\(\d+\)\s(?P<id>\S+)$`)
-)
-
-func graphFromLinksAndMap(links [][]string, sMap []string, getID func(string) (string, error)) (graph, error) {
+// graphFromLinksAndMap builds a graph from MAP and LINKS output. resolveIDs is used for servers that appear in LINKS
+// but not in MAP, and must return an ID for every name it is given.
+func graphFromLinksAndMap(links [][]string, sMap []string, resolveIDs func([]string) map[string]string) (graph, error) {
 	servers := graph(make(map[string]*Server, len(links)))
 
 	for _, line := range sMap {
-		line = strings.TrimLeft(line, "`|- ")
-		match := mapRe.FindStringSubmatch(line)
-		if match == nil {
-			return nil, fmt.Errorf("%s does not match regexp", line)
+		name, id, users, ok := parseMapLine(line)
+		if !ok {
+			return nil, fmt.Errorf("%s does not match regexp", strings.TrimLeft(line, "`|- "))
 		}
 
-		name := match[mapRe.SubexpIndex("name")]
-		id := match[mapRe.SubexpIndex("id")]
-		fmt.Printf("name: %q; ID: %q\n", name, id)
-		servers[id] = &Server{Name: name, ID: id, Version: "Unknown"}
+		servers[id] = &Server{Name: name, ID: id, Version: "Unknown", Users: users}
 	}
 
 	/*
@@ -125,55 +87,75 @@ func graphFromLinksAndMap(links [][]string, sMap []string, getID func(string) (s
 		>> @time=2021-06-09T12:08:37.996Z :irc.awesome-dragon.science 365 A_Dragon * :End of /LINKS list.
 	*/
 
-	fmt.Println("And now, onto the LINKS")
+	byName := make(map[string]*Server, len(servers))
+	for _, srv := range servers {
+		byName[srv.Name] = srv
+	}
+
+	getServer := func(name string) *Server {
+		if srv, exists := servers[name]; exists {
+			return srv
+		}
+
+		return byName[name]
+	}
+
+	// MAP doesnt always contain every server. Resolve IDs for everything it missed in one batch
+	unknown := []string{}
+	seen := make(map[string]bool)
+	for _, line := range links {
+		if len(line) < 3 {
+			return nil, fmt.Errorf("LINKS line %q has %d fields, expected 3", line, len(line))
+		}
+
+		for _, name := range line[:2] {
+			if getServer(name) == nil && !seen[name] {
+				seen[name] = true
+				unknown = append(unknown, name)
+			}
+		}
+	}
+
+	var resolved map[string]string
+	if len(unknown) > 0 {
+		log.Printf("Unknown servers %q! requesting...", unknown)
+		resolved = resolveIDs(unknown)
+	}
+
+	linked := make(map[[2]*Server]bool, len(links))
 	for _, line := range links {
 		serv1Name := line[0]
 		serv2Name := line[1]
 		serv1Desc := line[2]
 
-		serv1 := servers.getServer(serv1Name)
-		serv2 := servers.getServer(serv2Name)
-
-		fmt.Printf("Server Pair: %q and %q\n", serv1Name, serv2Name)
+		serv1 := getServer(serv1Name)
 		if serv1 == nil {
-			// MAP didnt contain this server. Do our best to add data for it
-			fmt.Printf("Unknown server %q! requesting...\n", serv1Name)
-			id, err := getID(serv1Name)
-			if err != nil {
-				// we didnt get a decent response. Create a fake ID
-				id = "FAKEID_" + serv1Name
-				fmt.Printf("UNKNOWN SERVER %s! Creating fake ID %q\n", serv1Name, id)
-			}
-
+			id := resolved[serv1Name]
 			serv1 = &Server{Name: serv1Name, Description: serv1Desc, ID: id}
 			servers[id] = serv1
+			byName[serv1Name] = serv1
 		}
 
+		// Looked up after serv1 is added, as a server linked to itself would otherwise be added twice
+		serv2 := getServer(serv2Name)
 		if serv2 == nil {
-			// MAP didnt contain this server. Do our best to add data for it
-			fmt.Printf("Unknown server %q! requesting...\n", serv1Name)
-			id, err := getID(serv2Name)
-			if err != nil {
-				// we didnt get a decent response. Create a fake ID
-				id = "FAKEID_" + serv2Name
-				fmt.Printf("UNKNOWN SERVER %s! Creating fake ID %q\n", serv1Name, id)
-			}
-
-			fmt.Printf("Got a good response: %s\n", id)
-
+			id := resolved[serv2Name]
 			serv2 = &Server{Name: serv2Name, ID: id}
 			servers[id] = serv2
+			byName[serv2Name] = serv2
 		}
 
 		if serv1.Description == "" {
 			serv1.Description = serv1Desc
 		}
 
-		if !serv1.HasPeer(serv2) {
+		if !linked[[2]*Server{serv1, serv2}] {
+			linked[[2]*Server{serv1, serv2}] = true
 			serv1.Peers = append(serv1.Peers, serv2)
 		}
 
-		if !serv2.HasPeer(serv1) {
+		if !linked[[2]*Server{serv2, serv1}] {
+			linked[[2]*Server{serv2, serv1}] = true
 			serv2.Peers = append(serv2.Peers, serv1)
 		}
 	}
@@ -181,6 +163,21 @@ func graphFromLinksAndMap(links [][]string, sMap []string, getID func(string) (s
 	return servers, nil
 }
 
+// splitLinksReply takes the parameters of an RPL_LINKS line, <me> <server> <uplink> :<hops> <description>, and
+// returns the server, its uplink, and the hops and description, which is what graphFromLinksAndMap expects
+func splitLinksReply(params []string) ([]string, error) {
+	if len(params) < 4 {
+		return nil, fmt.Errorf("expected 4 parameters, got %d", len(params))
+	}
+
+	if params[1] == "" || params[2] == "" {
+		return nil, errors.New("empty server name")
+	}
+
+	// Some servers do not send the description as a trailing parameter, in which case it arrives split up
+	return []string{params[1], params[2], strings.Join(params[3:], " ")}, nil
+}
+
 // func graphFromList(list []string) graph {
 // 	//<serverfrom> <serverto> :<hops-from-server-you-are-on> <serverfrom-description>
 // 	servers = []*Server{}
@@ -195,19 +192,6 @@ func stringSliceContains(s string, slice []string) bool {
 	return false
 }
 
-func (g graph) distanceToPeer(start, end *Server) int {
-	if start == end {
-		return 0
-	}
-	distances := g.allDistancesFrom(start)
-
-	if res, exists := distances[end]; exists {
-		return res
-	} else {
-		return -1
-	}
-}
-
 func (g graph) keys() []string {
 	out := []string{}
 	for k := range g {
@@ -227,70 +211,9 @@ func (g graph) values() (out []*Server) {
 	return out
 }
 
-func (g graph) allDistancesFrom(source *Server) map[*Server]int {
-	toCheck := []*Server{}
-	toCheck = append(toCheck, source.Peers...)
-	count := 0
-
-	out := make(map[*Server]int)
-	out[source] = 0
-	for {
-		next := []*Server{}
-		for _, server := range toCheck {
-			out[server] = count + 1
-			for _, s := range server.Peers {
-				if _, exists := out[s]; exists {
-					continue // skip servers we've already seen
-				}
-				next = append(next, s)
-			}
-		}
-		toCheck = next
-		count++
-		if len(toCheck) == 0 {
-			break
-		}
-	}
-	return out
-}
-
-func (g graph) recursiveBFS(source, target, prev *Server) []*Server {
-	out := []*Server{source}
-	if source == target {
-		return out
-	}
-	for _, s := range source.Peers {
-		if s == prev {
-			continue
-		}
-
-		if res := g.recursiveBFS(s, target, source); res != nil {
-			return append(out, res...)
-		}
-	}
-	return nil
-}
-
-// func (g graph) largestDistance2(source *Server) (int, *Server) {
-// }
-
+// largestDistanceFrom returns the server furthest from source, among those filter allows, and its distance
 func (g graph) largestDistanceFrom(source *Server, filter func(*Server) bool) (int, *Server) {
-	bestHopCount := -1
-	var bestServer *Server
-	servers := g.values()
-	distances := g.allDistancesFrom(source)
-
-	for _, other := range servers {
-		if filter != nil && !filter(other) {
-			continue
-		}
-		if hc := distances[other]; hc > bestHopCount {
-			bestHopCount = hc
-			bestServer = other
-		}
-	}
-
-	return bestHopCount, bestServer
+	return newTopology(g).largestDistanceFrom(source, filter)
 }
 
 func (g graph) getServer(nameOrID string) *Server {
@@ -320,3 +243,111 @@ func (g graph) mostPeers() *Server {
 
 	return bestServer
 }
+
+// byPeerCount returns every server, those with the most peers first
+func (g graph) byPeerCount() []*Server {
+	out := make([]*Server, 0, len(g))
+	for _, srv := range g {
+		out = append(out, srv)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if len(out[i].Peers) != len(out[j].Peers) {
+			return len(out[i].Peers) > len(out[j].Peers)
+		}
+
+		return out[i].Name < out[j].Name
+	})
+
+	return out
+}
+
+// degree returns the number of peers s has, not counting itself
+func (s *Server) degree() int {
+	out := 0
+	for _, p := range s.Peers {
+		if p != s {
+			out++
+		}
+	}
+
+	return out
+}
+
+// diameter returns the largest distance between any two servers, and the servers at either end
+func (g graph) diameter() (int, *Server, *Server) {
+	return newTopology(g).diameter(nil)
+}
+
+// degreeDistribution returns how many servers have each number of peers
+func (g graph) degreeDistribution() map[int]int {
+	out := make(map[int]int)
+	for _, s := range g {
+		out[s.degree()]++
+	}
+
+	return out
+}
+
+// graphStats describes the shape of a graph
+type graphStats struct {
+	Servers      int         `json:"servers"`
+	Links        int         `json:"links"`
+	Diameter     int         `json:"diameter"`
+	DiameterFrom *Server     `json:"diameter_from"`
+	DiameterTo   *Server     `json:"diameter_to"`
+	AvgDegree    float64     `json:"avg_degree"`
+	MaxDegree    int         `json:"max_degree"`
+	Degrees      map[int]int `json:"degrees"`
+}
+
+// stats returns the size, diameter and degree distribution of the graph
+func (g graph) stats() graphStats {
+	return newTopology(g).stats()
+}
+
+// stats returns the size, diameter and degree distribution of the topology's graph
+func (t *topology) stats() graphStats {
+	g := t.g
+	out := graphStats{Servers: len(g), Degrees: g.degreeDistribution()}
+	if len(g) == 0 {
+		return out
+	}
+
+	for _, s := range g {
+		out.Links += s.degree()
+		if d := s.degree(); d > out.MaxDegree {
+			out.MaxDegree = d
+		}
+	}
+
+	out.Links /= 2
+	out.AvgDegree = float64(2*out.Links) / float64(len(g))
+	out.Diameter, out.DiameterFrom, out.DiameterTo = t.diameter(nil)
+
+	return out
+}
+
+// summary describes the size, diameter and degree distribution of the graph
+func (st graphStats) summary() string {
+	if st.Servers == 0 {
+		return "no servers"
+	}
+
+	degrees := []int{}
+	for d := range st.Degrees {
+		degrees = append(degrees, d)
+	}
+
+	sort.Ints(degrees)
+	buckets := []string{}
+	for _, d := range degrees {
+		buckets = append(buckets, fmt.Sprintf("%d:%d", d, st.Degrees[d]))
+	}
+
+	return fmt.Sprintf(
+		"%d servers, %d links, diameter %d (%s to %s), degree avg %.2f max %d [%s]",
+		st.Servers, st.Links, st.Diameter, st.DiameterFrom.Name, st.DiameterTo.Name, st.AvgDegree, st.MaxDegree,
+		strings.Join(buckets, " "),
+	)
+}
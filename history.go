@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultHistoryFile = "history.jsonl"
+
+type historyConfig struct {
+	// File is where history is kept, one JSON object per line. Empty keeps it in memory only.
+	File string `toml:"file"`
+	// Retention is how long history is kept
+	Retention time.Duration `toml:"retention"`
+	// SampleInterval is the least time between two entries for a network, unless its servers or links changed
+	SampleInterval time.Duration `toml:"sample_interval"`
+}
+
+// historyEntry records the shape of a network at one point in time
+type historyEntry struct {
+	Network  string    `json:"network"`
+	Taken    time.Time `json:"taken"`
+	Source   string    `json:"source"`
+	Servers  int       `json:"servers"`
+	Links    int       `json:"links"`
+	Diameter int       `json:"diameter"`
+	// Users is the total across every server, 0 if no source reported any
+	Users int `json:"users"`
+	// Topology is only written to the file when it differs from the network's previous entry. In memory every
+	// entry has one, shared with the entries before it while nothing changes.
+	Topology *historyTopology `json:"topology,omitempty"`
+}
+
+type historyTopology struct {
+	// Servers are server names, sorted
+	Servers []string `json:"servers"`
+	// Links are pairs of lowercased server names, sorted
+	Links [][2]string `json:"links"`
+}
+
+func newHistoryTopology(g graph) *historyTopology {
+	t := &historyTopology{Servers: []string{}, Links: [][2]string{}}
+	for _, srv := range g {
+		t.Servers = append(t.Servers, srv.Name)
+	}
+
+	for link := range g.links() {
+		t.Links = append(t.Links, link)
+	}
+
+	sort.Strings(t.Servers)
+	sortLinks(t.Links)
+	return t
+}
+
+func (t *historyTopology) equal(other *historyTopology) bool {
+	if t == other {
+		return true
+	}
+
+	if t == nil || other == nil || len(t.Servers) != len(other.Servers) || len(t.Links) != len(other.Links) {
+		return false
+	}
+
+	for i := range t.Servers {
+		if t.Servers[i] != other.Servers[i] {
+			return false
+		}
+	}
+
+	for i := range t.Links {
+		if t.Links[i] != other.Links[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// historyStore keeps a history of every network's shape for reports and charts. It is fed from snapshots, and
+// saved to a file that is compacted on start and once a day.
+type historyStore struct {
+	cfg historyConfig
+
+	mu          sync.Mutex
+	entries     map[string][]*historyEntry // by network, oldest first
+	out         *os.File
+	lastCompact time.Time
+}
+
+func newHistoryStore(cfg historyConfig) (*historyStore, error) {
+	h := &historyStore{cfg: cfg, entries: make(map[string][]*historyEntry)}
+	if cfg.File == "" {
+		return h, nil
+	}
+
+	if err := h.load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("could not load history from %q: %w", cfg.File, err)
+	}
+
+	if err := h.compact(); err != nil {
+		return nil, fmt.Errorf("could not save history to %q: %w", cfg.File, err)
+	}
+
+	return h, nil
+}
+
+func (h *historyStore) load() error {
+	f, err := os.Open(h.cfg.File)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		entry := &historyEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			// A line cut short by a crash should not lose everything before it
+			if len(scanner.Bytes()) > 0 {
+				log.Printf("History: skipping line %d of %s: %s", line, h.cfg.File, err)
+			}
+
+			continue
+		}
+
+		prev := h.entries[entry.Network]
+		if entry.Topology == nil {
+			if len(prev) == 0 {
+				continue
+			}
+
+			entry.Topology = prev[len(prev)-1].Topology
+		}
+
+		h.entries[entry.Network] = append(prev, entry)
+	}
+
+	return scanner.Err()
+}
+
+// compact drops expired entries and rewrites the file with only what is left. h.mu must be held or not yet shared.
+func (h *historyStore) compact() error {
+	h.expire()
+	if h.out != nil {
+		h.out.Close()
+		h.out = nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(h.cfg.File), filepath.Base(h.cfg.File)+".*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	for _, entries := range h.entries {
+		var prev *historyTopology
+		for _, entry := range entries {
+			if err := writeHistoryEntry(w, entry, prev); err != nil {
+				tmp.Close()
+				return err
+			}
+
+			prev = entry.Topology
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), h.cfg.File); err != nil {
+		return err
+	}
+
+	h.out, err = os.OpenFile(h.cfg.File, os.O_APPEND|os.O_WRONLY, 0o644)
+	h.lastCompact = time.Now()
+	return err
+}
+
+// writeHistoryEntry writes entry as a line, leaving out its topology if it is the same as prev
+func writeHistoryEntry(w io.Writer, entry *historyEntry, prev *historyTopology) error {
+	out := *entry
+	if out.Topology.equal(prev) {
+		out.Topology = nil
+	}
+
+	data, err := json.Marshal(&out)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// expire drops entries older than the retention. h.mu must be held.
+func (h *historyStore) expire() {
+	cutoff := time.Now().Add(-h.cfg.Retention)
+	for network, entries := range h.entries {
+		i := sort.Search(len(entries), func(i int) bool { return entries[i].Taken.After(cutoff) })
+		h.entries[network] = entries[i:]
+	}
+}
+
+// record adds an entry for cur, unless the network's last entry is recent and nothing has changed since
+func (h *historyStore) record(network string, cur *snapshot) {
+	topology := newHistoryTopology(cur.graph)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	entries := h.entries[network]
+	var prev *historyTopology
+	if len(entries) > 0 {
+		last := entries[len(entries)-1]
+		// Entries must stay in order, even if the clock goes backwards
+		if !cur.Taken.After(last.Taken) {
+			return
+		}
+
+		if cur.Taken.Sub(last.Taken) < h.cfg.SampleInterval && last.Topology.equal(topology) {
+			return
+		}
+
+		prev = last.Topology
+		if prev.equal(topology) {
+			topology = prev
+		}
+	}
+
+	diameter, _, _ := cur.topology().diameter(nil)
+	users := 0
+	for _, srv := range cur.graph {
+		users += srv.Users
+	}
+
+	entry := &historyEntry{
+		Network:  network,
+		Taken:    cur.Taken,
+		Source:   cur.Source,
+		Servers:  len(topology.Servers),
+		Links:    len(topology.Links),
+		Diameter: diameter,
+		Users:    users,
+		Topology: topology,
+	}
+
+	h.entries[network] = append(entries, entry)
+
+	if h.out == nil {
+		h.expire()
+		return
+	}
+
+	if time.Since(h.lastCompact) > 24*time.Hour {
+		if err := h.compact(); err != nil {
+			log.Printf("History: could not compact %s: %s", h.cfg.File, err)
+		}
+
+		return
+	}
+
+	if err := writeHistoryEntry(h.out, entry, prev); err != nil {
+		log.Printf("History: could not write to %s: %s", h.cfg.File, err)
+	}
+}
+
+// window returns the entries for network taken after start, oldest first. The last entry from before start comes
+// first if there is one, since it shows what the network looked like when the window began.
+func (h *historyStore) window(network string, start time.Time) []*historyEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	entries := h.entries[network]
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].Taken.After(start) })
+	if i > 0 {
+		i--
+	}
+
+	return append([]*historyEntry(nil), entries[i:]...)
+}
+
+// historyHook returns the snapshot hook that records n's history
+func (b *bot) historyHook(n *network) snapshotHook {
+	return func(_, cur *snapshot) { b.history.record(n.name, cur) }
+}
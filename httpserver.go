@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+type httpConfig struct {
+	// Listen is the address for the built in HTTP server, such as "127.0.0.1:8080". Empty disables it.
+	Listen string `toml:"listen"`
+	// PublicURL is the base of links the bot hands out, for when it sits behind a proxy. Defaults to http://<listen>
+	PublicURL string `toml:"public_url"`
+}
+
+// httpServer is the bot's built in web server. Features register their handlers on it before it is started.
+type httpServer struct {
+	cfg httpConfig
+	mux *http.ServeMux
+}
+
+func newHTTPServer(cfg httpConfig) *httpServer {
+	return &httpServer{cfg: cfg, mux: http.NewServeMux()}
+}
+
+func (h *httpServer) handle(pattern string, handler http.HandlerFunc) {
+	h.mux.HandleFunc(pattern, handler)
+}
+
+// url returns the public URL for path
+func (h *httpServer) url(path string) string {
+	base := h.cfg.PublicURL
+	if base == "" {
+		base = "http://" + h.cfg.Listen
+	}
+
+	return strings.TrimRight(base, "/") + "/" + strings.TrimLeft(path, "/")
+}
+
+// run serves HTTP until it fails
+func (h *httpServer) run() error {
+	srv := &http.Server{
+		Addr:              h.cfg.Listen,
+		Handler:           h.mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return srv.ListenAndServe()
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ioservTimeout = 10 * time.Second
+	ioservRetries = 3
+	ioservBackoff = 500 * time.Millisecond
+)
+
+// ioservReport lists problems found while ingesting the ioserv JSON. None of them are fatal; the offending data is
+// skipped.
+type ioservReport struct {
+	DanglingLinks  [][2]string `json:"dangling_links"`  // links that reference servers not in the node list
+	SelfLoops      []string    `json:"self_loops"`      // servers linked to themselves
+	DuplicateLinks [][2]string `json:"duplicate_links"` // links that appear more than once
+	NullServers    []string    `json:"null_servers"`    // node IDs with no data
+}
+
+// OK reports whether no problems were found
+func (r *ioservReport) OK() bool {
+	return len(r.DanglingLinks) == 0 && len(r.SelfLoops) == 0 && len(r.DuplicateLinks) == 0 && len(r.NullServers) == 0
+}
+
+func (r *ioservReport) String() string {
+	if r.OK() {
+		return "no problems found"
+	}
+
+	pairs := func(p [][2]string) string {
+		out := []string{}
+		for _, v := range p {
+			out = append(out, v[0]+" <-> "+v[1])
+		}
+
+		return strings.Join(out, ", ")
+	}
+
+	out := []string{}
+	if len(r.DanglingLinks) > 0 {
+		out = append(out, fmt.Sprintf("dangling links: %s", pairs(r.DanglingLinks)))
+	}
+
+	if len(r.SelfLoops) > 0 {
+		out = append(out, fmt.Sprintf("self-loops: %s", strings.Join(r.SelfLoops, ", ")))
+	}
+
+	if len(r.DuplicateLinks) > 0 {
+		out = append(out, fmt.Sprintf("duplicate links: %s", pairs(r.DuplicateLinks)))
+	}
+
+	if len(r.NullServers) > 0 {
+		out = append(out, fmt.Sprintf("empty nodes: %s", strings.Join(r.NullServers, ", ")))
+	}
+
+	return strings.Join(out, " | ")
+}
+
+// ioservClient fetches the ioserv JSON graph. Requests time out and are retried with backoff, and responses are
+// cached with ETag / Last-Modified so an unchanged graph is not downloaded again.
+type ioservClient struct {
+	url        string
+	httpClient *http.Client
+	retries    int
+	backoff    time.Duration
+
+	mu           sync.Mutex
+	etag         string
+	lastModified string
+	body         []byte
+	lastReport   *ioservReport
+}
+
+func newIOServClient(url string) *ioservClient {
+	return &ioservClient{
+		url:        url,
+		httpClient: &http.Client{Timeout: ioservTimeout},
+		retries:    ioservRetries,
+		backoff:    ioservBackoff,
+	}
+}
+
+// errRetryable wraps errors that are worth retrying
+type errRetryable struct{ error }
+
+func (e errRetryable) Unwrap() error { return e.error }
+
+func (c *ioservClient) fetchOnce() ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if c.body != nil {
+		if c.etag != "" {
+			req.Header.Set("If-None-Match", c.etag)
+		}
+
+		if c.lastModified != "" {
+			req.Header.Set("If-Modified-Since", c.lastModified)
+		}
+	}
+	c.mu.Unlock()
+
+	r, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, errRetryable{err}
+	}
+	defer r.Body.Close()
+
+	switch {
+	case r.StatusCode == http.StatusNotModified:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.body, nil
+
+	case r.StatusCode >= 500 || r.StatusCode == http.StatusTooManyRequests:
+		return nil, errRetryable{fmt.Errorf("unexpected status %s", r.Status)}
+
+	case r.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("unexpected status %s", r.Status)
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, errRetryable{err}
+	}
+
+	c.mu.Lock()
+	c.body = data
+	c.etag = r.Header.Get("ETag")
+	c.lastModified = r.Header.Get("Last-Modified")
+	c.mu.Unlock()
+
+	return data, nil
+}
+
+// fetch returns the raw JSON, retrying transient failures
+func (c *ioservClient) fetch() ([]byte, error) {
+	backoff := c.backoff
+	var err error
+	for attempt := 0; attempt < c.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		var data []byte
+		if data, err = c.fetchOnce(); err == nil {
+			return data, nil
+		}
+
+		var retryable errRetryable
+		if !errors.As(err, &retryable) {
+			break
+		}
+	}
+
+	return nil, fmt.Errorf("could not get JSON data from %s: %w", c.url, err)
+}
+
+// Graph fetches and parses the ioserv graph
+func (c *ioservClient) Graph() (graph, error) {
+	data, err := c.fetch()
+	if err != nil {
+		return nil, err
+	}
+
+	g, report, err := parseIOServGraph(data)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.lastReport = report
+	c.mu.Unlock()
+
+	return g, nil
+}
+
+// LastReport returns the validation report from the most recent successful parse, or nil
+func (c *ioservClient) LastReport() *ioservReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lastReport
+}
+
+// parseIOServGraph decodes the ioserv JSON. Bad links are skipped and recorded in the returned report rather than
+// causing an error.
+func parseIOServGraph(data []byte) (graph, *ioservReport, error) {
+	type jsonStruct struct {
+		Servers map[string]*Server `json:"nodes"`
+		Links   [][2]string        `json:"links"`
+	}
+
+	parsedJSON := new(jsonStruct)
+	if err := json.Unmarshal(data, parsedJSON); err != nil {
+		return nil, nil, fmt.Errorf("could not decode JSON: %w", err)
+	}
+
+	report := &ioservReport{}
+	out := make(graph, len(parsedJSON.Servers))
+	for id, server := range parsedJSON.Servers {
+		if server == nil {
+			report.NullServers = append(report.NullServers, id)
+			continue
+		}
+
+		server.ID = id
+		out[id] = server
+	}
+
+	seen := make(map[[2]string]bool)
+	for _, linkPair := range parsedJSON.Links {
+		one, two := out[linkPair[0]], out[linkPair[1]]
+		if one == nil || two == nil {
+			report.DanglingLinks = append(report.DanglingLinks, linkPair)
+			continue
+		}
+
+		if one == two {
+			report.SelfLoops = append(report.SelfLoops, one.ID)
+			continue
+		}
+
+		key := linkPair
+		if key[0] > key[1] {
+			key[0], key[1] = key[1], key[0]
+		}
+
+		if seen[key] {
+			report.DuplicateLinks = append(report.DuplicateLinks, linkPair)
+			continue
+		}
+
+		seen[key] = true
+		one.Peers = append(one.Peers, two)
+		two.Peers = append(two.Peers, one)
+	}
+
+	return out, report, nil
+}
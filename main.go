@@ -2,9 +2,10 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
+	"log"
 	"os"
-	"regexp"
 	"strings"
 	"sync"
 	"time"
@@ -12,526 +13,609 @@ import (
 	irc "github.com/thoj/go-ircevent"
 )
 
-const (
-	host   = "https://ioserv.hellomouse.net/graph/json"
-	ircd   = "irc.awesome-dragon.science:6697"
-	prefix = "~"
-)
+const host = "https://ioserv.hellomouse.net/graph/json"
 
 const (
-	RPL_LINKS      = "364"
-	RPL_ENDOFLINKS = "365"
-	RPL_MAP        = "006"
-	RPL_ENDOFMAP   = "007"
-	RPL_NOSUCHNICK = "401"
-	PRIVMSG        = "PRIVMSG"
-	NOTICE         = "NOTICE"
+	RPL_LINKS              = "364"
+	RPL_ENDOFLINKS         = "365"
+	RPL_MAP                = "006"
+	RPL_ENDOFMAP           = "007"
+	RPL_UMODEIS            = "221"
+	RPL_ENDOFWHO           = "315"
+	RPL_WHOREPLY           = "352"
+	RPL_WHOSPCRPL          = "354"
+	RPL_YOUREOPER          = "381"
+	RPL_NOSUCHNICK         = "401"
+	ERR_UNKNOWNCOMMAND     = "421"
+	ERR_PASSWDMISMATCH     = "464"
+	ERR_NOPRIVILEGES       = "481"
+	ERR_NOOPERHOST         = "491"
+	RPL_RSACHALLENGE2      = "740"
+	RPL_ENDOFRSACHALLENGE2 = "741"
+	RPL_SASLSUCCESS        = "903"
+	ERR_SASLFAIL           = "904"
+	ERR_SASLTOOLONG        = "905"
+	ERR_SASLABORTED        = "906"
+	ERR_SASLALREADY        = "907"
+	RPL_SASLMECHS          = "908"
+	PRIVMSG                = "PRIVMSG"
+	NOTICE                 = "NOTICE"
 )
 
 func main() {
-	b := NewBot("graphbot", "pissing-on-graphs")
-	b.run(ircd)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "analyze":
+			os.Exit(analyzeMain(os.Args[2:]))
+		case "replay":
+			os.Exit(replayMain(os.Args[2:]))
+		}
+	}
+
+	configPath := flag.String("config", defaultConfigFile, "path to the config file")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configPath, isFlagSet(flag.CommandLine, "config"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	b, err := NewBot(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	b.run()
+}
+
+func isFlagSet(fs *flag.FlagSet, name string) (set bool) {
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+
+	return set
 }
 
 type bot struct {
-	ircCon         *irc.Connection
-	commands       map[string]string
-	commandAliases map[string][]string
-
-	lastLINKS          [][]string
-	lastMAP            []string
-	mapLinksMutex      sync.Mutex
-	updatingLinkAndMap bool
+	cfg      *config
+	perms    *permissions
+	watches  *watchStore
+	alerts   *alerter
+	history  *historyStore
+	presence *presenceStore
+	networks map[string]*network
+	registry *commandRegistry
+	http     *httpServer // nil if the HTTP server is disabled
+	pastes   *pasteStore // nil if the HTTP server is disabled
+	charts   *chartStore // nil if the HTTP server is disabled
 }
 
-func NewBot(nick, user string) *bot {
-	irccon := irc.IRC(nick, user)
-	irccon.Debug = true
-	irccon.UseTLS = true
+func NewBot(cfg *config) (*bot, error) {
 	b := &bot{
-		ircCon:         irccon,
-		commands:       make(map[string]string),
-		commandAliases: make(map[string][]string),
+		cfg:      cfg,
+		networks: make(map[string]*network),
+		registry: newCommandRegistry(),
+		alerts:   newAlerter(cfg.Alerts),
+	}
+
+	perms, err := newPermissions(cfg.Permissions)
+	if err != nil {
+		return nil, err
+	}
+
+	b.perms = perms
+
+	b.watches, err = newWatchStore(cfg.Watch.File)
+	if err != nil {
+		return nil, err
+	}
+
+	b.history, err = newHistoryStore(cfg.History)
+	if err != nil {
+		return nil, err
+	}
+
+	b.presence, err = newPresenceStore(cfg.presence(), cfg.History.Retention)
+	if err != nil {
+		return nil, err
 	}
 
-	b.ircCon.AddCallback("001", func(_ *irc.Event) {
-		if res := os.Getenv("OPERIDENT"); res != "" {
-			b.ircCon.SendRaw("OPER " + res)
+	if cfg.HTTP.Listen != "" {
+		b.http = newHTTPServer(cfg.HTTP)
+		b.pastes = newPasteStore(cfg.Paste, b.http)
+		b.charts = newChartStore(cfg.Paste, b.http, b.history)
+		if len(cfg.API.Tokens) > 0 {
+			b.http.handle(apiPath, b.serveAPI)
+		}
+	}
+
+	for _, name := range cfg.networkNames() {
+		n, err := newNetwork(name, cfg.networks[name], cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		n.ircCon.AddCallback(PRIVMSG, b.dispatch(n))
+		n.onSnapshot(b.notifyWatchers(n))
+		n.onSnapshot(b.alertHook(n))
+		n.onSnapshot(b.historyHook(n))
+		n.onSnapshot(b.presenceHook(n))
+		if cfg.Output.Overflow == overflowPaste {
+			n.output.paste = b.pasteReply(n)
 		}
 
-		b.ircCon.Join("#opers")
+		b.networks[name] = n
+	}
+
+	for _, a := range analyses {
+		b.addAnalysisCommand(a)
+	}
+
+	b.addChatCommand(&command{
+		name: "reconcile", desc: "Compare the IRC and ioserv graphs", aliases: []string{"rec"}, run: b.reconcile,
+		subcommands: []*command{
+			{name: "full", desc: "List every difference between the IRC and ioserv graphs", run: b.reconcileFull},
+			{
+				name: "server", desc: "Show where the merged data for a server came from", run: b.reconcileServer,
+				args: []argSpec{{name: "server", kind: argServer}},
+			},
+		},
 	})
 
-	defaultSources := []string{"A_Dragon", "#opers"}
+	b.addChatCommand(&command{
+		name: "graphmode", desc: "Show or set where graphs come from: irc (falls back to ioserv), json, or merged",
+		aliases: []string{"gm"}, run: b.setGraphMode, args: []argSpec{{name: "mode", optional: true}},
+	})
 
-	b.addChatCommand("biggesthop", "Find largest number of hops between two servers, now fasterer", defaultSources, -1, b.maxHops, "bh", "howfucked")
-	b.addChatCommand("biggesthopfrom", "Find the furthest server from the given server", defaultSources, 1, b.maxHopsFrom, "bhf", "howfuckedis")
-	b.addChatCommand("singlepointoffailure", "Find the server with the most peers", defaultSources, -1, b.singlePointOfFailure, "spof")
-	b.addChatCommand("peercount", "Get the number of peers for the given server", defaultSources, 1, b.peerCount, "pc", "peecount")
-	b.addChatCommand("hopsbetween", "get the number of hops between two servers", defaultSources, 2, b.hopsBetween, "hb")
-	b.addChatCommand("help", "Take a guess.", nil, -1, b.doHelp)
-	b.addChatCommand("count", "Current server count", defaultSources, 0, func(e *irc.Event, _ []string) {
-		go func() {
-			b.updateLinksAndMap()
-			// g, err := getGraph(host)
-			g, err := graphFromLinksAndMap(b.lastLINKS, b.lastMAP, b.getID)
-			if err != nil {
-				b.replyTof(e, "Error: %s", err)
-			}
-			b.replyTof(e, "Currently there are %d servers on the network", len(g))
-		}()
+	b.addChatCommand(&command{
+		name: "validate", desc: "Check the ioserv JSON for dangling, duplicate and self-referencing links",
+		aliases: []string{"jsonreport"}, run: b.validateJSON,
 	})
 
-	b.addChatCommand("test", "", defaultSources, 0, func(e *irc.Event, args []string) {
-		go func() {
-			b.updateLinksAndMap()
-			g, err := graphFromLinksAndMap(b.lastLINKS, b.lastMAP, b.getID)
-			if err != nil {
-				fmt.Println(err)
-			}
+	b.addChatCommand(&command{
+		name: "operstatus", desc: "Shows whether the bot is currently opered", aliases: []string{"os"}, run: b.operStatus,
+	})
 
-			fmt.Println(g.mostPeers())
-		}()
+	b.addChatCommand(&command{
+		name: "compare", desc: "Compare size, diameter and degree distribution of two networks", run: b.compare,
+		args: []argSpec{{name: "network"}, {name: "other"}},
 	})
 
-	b.addChatCommand("graphsizes", "", defaultSources, 0, func(e *irc.Event, args []string) {
-		go func() {
-			g1, err := getGraph(host)
-			b.replyTof(e, "net: %d %s", len(g1), err)
-		}()
+	b.addChatCommand(&command{
+		name: "networks", desc: "List the networks the bot is connected to", aliases: []string{"nets"}, run: b.listNetworks,
+	})
 
-		go func() {
-			err1 := b.updateLinksAndMap()
-			g2, err2 := graphFromLinksAndMap(b.lastLINKS, b.lastMAP, b.getID)
-			b.replyTof(e, "l+m: %d %s | %s", len(g2), err1, err2)
-		}()
+	b.addChatCommand(&command{
+		name: "grant", desc: "Give a role to a nick!user@host mask or services account", run: b.grant,
+		args: []argSpec{{name: "role"}, {name: "who"}},
 	})
 
-	b.addChatCommand("update", "updates cached links and maps", defaultSources, 0, func(e *irc.Event, args []string) {
-		go func() {
-			if err := b.updateLinksAndMap(); err != nil {
-				b.replyTof(e, "Error: %s", err)
-			}
-			b.replyTo(e, "Done")
-		}()
+	b.addChatCommand(&command{
+		name: "revoke", desc: "Take back a role given with grant", run: b.revoke,
+		args: []argSpec{{name: "role"}, {name: "who"}},
 	})
 
-	b.addChatCommand("showhopsbetween", "Lists the hops between servers", defaultSources, 2, func(e *irc.Event, args []string) {
-		go func() {
-			defer func() {
-				res := recover()
-				if res != nil {
-					b.replyTo(e, "PANIC! Caught and logged. (quit breaking my shit!)")
-					fmt.Println("PANIC!", res)
-				}
-			}()
-			sourceName, destName := args[0], args[1]
-			b.updateLinksAndMap()
-			g, err := graphFromLinksAndMap(b.lastLINKS, b.lastMAP, b.getID)
-			if err != nil {
-				b.replyTof(e, "Error: %s", err)
-				return
-			}
+	b.addChatCommand(&command{
+		name: "roles", desc: "List roles, or who holds the given role", run: b.listRoles,
+		args: []argSpec{{name: "role", optional: true}},
+	})
 
-			source, dst := g.getServer(sourceName), g.getServer(destName)
-			if source == nil {
-				b.replyTof(e, "Unknown server %s", sourceName)
-				return
-			}
+	b.addChatCommand(&command{
+		name: "whoami", desc: "Shows the hostmask, account, oper status and roles the bot sees for you", run: b.whoami,
+	})
 
-			if dst == nil {
-				b.replyTof(e, "Unknown server %s", destName)
-				return
-			}
+	b.addChatCommand(&command{
+		name: "watch", desc: "Get told when a server leaves, comes back, or changes uplink. Lists your watches without a server",
+		run: b.watch, args: []argSpec{{name: "server", optional: true}},
+		flags: []argSpec{{name: "via", kind: argString, desc: "how alerts reach you: pm (the default), notice, or channel"}},
+	})
+
+	b.addChatCommand(&command{
+		name: "unwatch", desc: "Stop watching a server, or every server without one", run: b.unwatch,
+		args: []argSpec{{name: "server", optional: true}},
+	})
+
+	b.addChatCommand(&command{
+		name: "report", desc: "Summarise how the network changed over a period, from the bot's history", run: b.report,
+		args:  []argSpec{{name: "period", kind: argDuration, optional: true}},
+		flags: []argSpec{{name: "top", kind: argInt, desc: "how many links and hubs to list"}},
+	})
+
+	b.addChatCommand(&command{
+		name: "chart", desc: "Link to a chart of servers, links, diameter or users over a window, 7d by default",
+		run: b.chart, args: []argSpec{{name: "metric"}, {name: "window", kind: argDuration, optional: true}},
+	})
+
+	b.addChatCommand(&command{
+		name: "uptime", desc: "Show how much of a window a server was up, 7d by default, and when it was first and last seen",
+		run: b.uptime, args: []argSpec{{name: "server"}, {name: "window", kind: argDuration, optional: true}},
+	})
+
+	b.addChatCommand(&command{
+		name: "flappers", desc: "List the servers and links that dropped out and came back most often over a window",
+		run: b.flappers, args: []argSpec{{name: "window", kind: argDuration, optional: true}},
+		flags: []argSpec{{name: "top", kind: argInt, desc: "how many servers and links to list"}},
+	})
+
+	b.addChatCommand(&command{
+		name: "sla", desc: "List the links that were up less than a target percentage of a window, 7d by default",
+		run: b.sla, args: []argSpec{{name: "window", kind: argDuration, optional: true}},
+		flags: []argSpec{{name: "target", kind: argString, desc: "the uptime percentage links should meet, 99.9 by default"}},
+	})
 
-			res := g.recursiveBFS(g.getServer(sourceName), g.getServer(destName), nil)
-			nameIDs := []string{}
-			names := []string{}
-			IDs := []string{}
+	b.addChatCommand(&command{
+		name: "alerts", desc: "Show the alert rules for this network and whether they are firing", run: b.listAlerts,
+	})
 
-			for _, v := range res {
-				nameIDs = append(nameIDs, v.NameID())
-				names = append(names, v.Name)
-				IDs = append(IDs, v.ID)
+	b.addChatCommand(&command{
+		name: "more", desc: "Show the next page of a long reply", run: func(n *network, e *irc.Event, _ *commandArgs) *commandResult {
+			if e == nil {
+				return errorf("more only works on IRC")
 			}
 
-			joinedNameIDs := strings.Join(nameIDs, " -> ")
-			joinedNames := strings.Join(names, " -> ")
-			joinedIDs := strings.Join(IDs, " -> ")
-			const maxLen = 450
-
-			if len(joinedNameIDs) <= maxLen {
-				b.replyTo(e, joinedNameIDs)
-				return
-			} else if len(joinedNames) <= maxLen {
-				b.replyTo(e, "IDs not included! would be too long!")
-				b.replyTo(e, joinedNames)
-			} else {
-				b.replyTo(e, "IDs only! too long otherwise (and may still be too long!)")
-				b.replyTo(e, joinedIDs)
+			b.networkFor(e).output.more(replyTarget(e))
+			return nil
+		},
+	})
+
+	b.addChatCommand(&command{
+		name: "help", desc: "Take a guess.", run: b.doHelp, args: []argSpec{{name: "command", optional: true}},
+	})
+
+	b.addChatCommand(&command{name: "test", run: func(n *network, _ *irc.Event, _ *commandArgs) *commandResult {
+		s, err := n.currentSnapshot()
+		if err != nil {
+			fmt.Println(err)
+			return nil
+		}
+
+		fmt.Println(s.graph.mostPeers())
+		return nil
+	}})
+
+	b.addChatCommand(&command{name: "graphsizes", run: b.graphSizes})
+
+	b.addChatCommand(&command{
+		name: "update", desc: "updates cached links and maps, unless they are newer than max-age", run: b.update,
+		args: []argSpec{{name: "max-age", kind: argDuration, optional: true}},
+	})
+
+	return b, nil
+}
+
+// run connects to every network and blocks until all of them are closed for good
+func (b *bot) run() {
+	if b.http != nil {
+		go func() {
+			if err := b.http.run(); err != nil {
+				log.Printf("HTTP server stopped: %s", err)
 			}
 		}()
-	}, "shb", "streambetween")
+	}
 
-	return b
-}
+	if len(b.cfg.Reports) > 0 {
+		go b.runReports()
+	}
 
-func (b *bot) run(server string) {
-	b.ircCon.Connect(server)
-	b.ircCon.Loop()
-}
+	wg := sync.WaitGroup{}
+	for _, n := range b.networks {
+		wg.Add(1)
+		go func(n *network) {
+			defer wg.Done()
+			n.run()
+		}(n)
+	}
 
-func (b *bot) addChatCommand(command, desc string, allowedSources []string, numArgs int, callback func(e *irc.Event, args []string), aliases ...string) {
-	b.commands[command] = desc
-	b.commandAliases[command] = append(b.commandAliases[command], aliases...)
-	b.ircCon.AddCallback(PRIVMSG, b.commandWrapper(command, allowedSources, numArgs, callback))
+	wg.Wait()
 }
 
-func (b *bot) matchesCommandOrAlias(s string) (string, bool) {
-	s = strings.TrimPrefix(s, prefix)
-
-	for c := range b.commands {
-		if c == s {
-			return s, true
+// addAnalysisCommand exposes a graph analysis as a chat command, run against the current graph
+func (b *bot) addAnalysisCommand(a analysis) {
+	c := a.command()
+	c.run = func(n *network, _ *irc.Event, args *commandArgs) *commandResult {
+		s, err := n.currentSnapshot()
+		if err != nil {
+			return errorResult(err)
 		}
 
-		for _, alias := range b.commandAliases[c] {
-			if alias == s {
-				return c, true
-			}
+		res := runAnalysis(a, s.topology(), args, n.ircCon.Log)
+		if n.getGraphMode() != graphModeJSON && !n.isOper() {
+			res.warn("I am not opered on %s, so MAP and LINKS may be incomplete or refused", n.name)
 		}
+
+		return res
 	}
-	return "", false
+
+	b.addChatCommand(c)
 }
 
-func (b *bot) commandWrapper(command string, allowedSources []string, numArgs int, callback func(e *irc.Event, args []string)) func(e *irc.Event) {
-	cmd := "~" + command
-	return func(e *irc.Event) {
-		message := strings.TrimSpace(e.MessageWithoutFormat())
-		splitMsg := strings.Split(message, " ")
-		if !strings.HasPrefix(splitMsg[0], prefix) {
-			return
+// globalFlags removes the flags every command takes from args. "--net <name>" picks the network the command runs
+// against, which is def if it is not given, and "--json" asks for a JSON reply.
+func (b *bot) globalFlags(def *network, args []string) (target *network, rest []string, asJSON bool, err error) {
+	out := []string{}
+	target = def
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--" {
+			out = append(out, args[i:]...)
+			break
 		}
 
-		realCommand, exists := b.matchesCommandOrAlias(splitMsg[0])
-		if !exists {
-			return
+		if args[i] == "--json" {
+			asJSON = true
+			continue
 		}
 
-		if len(splitMsg) == 0 || realCommand != command {
-			return
+		if args[i] != "--net" {
+			out = append(out, args[i])
+			continue
 		}
 
-		if allowedSources != nil && !(stringSliceContains(e.Arguments[0], allowedSources) || stringSliceContains(e.Nick, allowedSources)) {
-			b.ircCon.Log.Printf("Skipping as %s or %s not found in %v", e.Source, e.Nick, allowedSources)
-			return
+		if i+1 >= len(args) {
+			return nil, nil, asJSON, errors.New("--net requires a network name")
 		}
 
-		if numArgs != -1 && len(splitMsg[1:]) < numArgs {
-			b.replyTof(e, "%q requires at least %d arguments", cmd, numArgs)
-			return
+		i++
+		n, exists := b.networks[args[i]]
+		if !exists {
+			return nil, nil, asJSON, fmt.Errorf("unknown network %q, available: %s", args[i], strings.Join(b.cfg.networkNames(), ", "))
 		}
 
-		callback(e, splitMsg[1:])
+		target = n
 	}
+
+	return target, out, asJSON, nil
 }
 
-func (b *bot) replyTo(e *irc.Event, message string) {
+// replyTarget returns where replies to e go: the channel it was sent to, or the sender of a private message
+func replyTarget(e *irc.Event) string {
 	target := e.Arguments[0]
-	if target == b.ircCon.GetNick() {
+	if target == e.Connection.GetNick() {
 		// was a PM
 		target = e.Nick
 	}
 
-	b.ircCon.Privmsg(target, message)
-}
-
-func (b *bot) replyTof(e *irc.Event, format string, args ...interface{}) {
-	b.replyTo(e, fmt.Sprintf(format, args...))
+	return target
 }
 
-func (b *bot) maxHopsFrom(e *irc.Event, args []string) {
-	go func() {
-		b.updateLinksAndMap()
-		gr, err := graphFromLinksAndMap(b.lastLINKS, b.lastMAP, b.getID)
-		// gr, err := getGraph(host)
-		if err != nil {
-			b.replyTof(e, "Error: %s", err)
-			return
+// networkFor returns the network e arrived on
+func (b *bot) networkFor(e *irc.Event) *network {
+	for _, n := range b.networks {
+		if n.ircCon == e.Connection {
+			return n
 		}
+	}
 
-		from := gr.getServer(args[0])
-		if from == nil {
-			b.replyTof(e, "Server ID %q doesnt exist!", args[0])
-			return
-		}
-		t := time.Now()
-		biggestHop, srv := gr.largestDistanceFrom(from, nil)
-		b.replyTof(
-			e, "Largest hop size from %s is %d! other side is %s (search took %s)",
-			from.NameID(), biggestHop, srv.NameID(), time.Since(t),
-		)
-	}()
+	return nil
 }
 
-func (b *bot) singlePointOfFailure(e *irc.Event, _ []string) {
-	go func() {
-		b.updateLinksAndMap()
-		gr, err := graphFromLinksAndMap(b.lastLINKS, b.lastMAP, b.getID)
-		// gr, err := getGraph(host)
-		if err != nil {
-			b.replyTof(e, "Error: %s", err)
-			return
-		}
-
-		t := time.Now()
-		mostPeers := gr.mostPeers()
-		b.replyTof(
-			e, "Server with the most peers is %s with %d peers! (Search took %s)",
-			mostPeers.NameID(), len(mostPeers.Peers), time.Since(t),
-		)
-	}()
+// pasteReply returns the function n's output queue uses to move long replies to the pastebin
+func (b *bot) pasteReply(n *network) func(target string, lines []string) (string, error) {
+	return func(target string, lines []string) (string, error) {
+		return b.pastes.add(fmt.Sprintf("pngraphbot reply to %s on %s", target, n.name), lines)
+	}
 }
 
-func (b *bot) peerCount(e *irc.Event, args []string) {
-	go func() {
-		b.updateLinksAndMap()
-		gr, err := graphFromLinksAndMap(b.lastLINKS, b.lastMAP, b.getID)
-		// gr, err := getGraph(host)
-		if err != nil {
-			b.replyTof(e, "Error: %s", err)
-			return
+// replyLines sends lines as a single reply, so that they are paged together if there are too many
+func (b *bot) replyLines(e *irc.Event, lines []string) {
+	n := b.networkFor(e)
+	if n == nil {
+		for _, line := range lines {
+			e.Connection.Privmsg(replyTarget(e), line)
 		}
 
-		srv := gr.getServer(args[0])
-		if srv == nil {
-			b.replyTof(e, "Server ID / name %q doesn't exist!", args[0])
-			return
-		}
+		return
+	}
 
-		b.replyTof(e, "%s has %d peers!", srv.NameID(), len(srv.Peers))
-	}()
+	n.output.send(replyTarget(e), lines)
 }
 
-func (b *bot) doHelp(e *irc.Event, args []string) {
-	if len(args) == 0 {
-		keys := []string{}
-		for k := range b.commands {
-			aliases := ""
-			if a := b.commandAliases[k]; len(a) > 0 {
-				aliases = fmt.Sprintf(" (%s)", strings.Join(a, ", "))
-			}
-			keys = append(keys, fmt.Sprint(k, aliases))
+type graphModeResult struct {
+	Network string `json:"network"`
+	Mode    string `json:"mode"`
+}
 
-		}
-		b.replyTof(e, "available commands: %s", strings.Join(keys, ", "))
-		return
+func (b *bot) setGraphMode(n *network, _ *irc.Event, args *commandArgs) *commandResult {
+	if !args.has("mode") {
+		mode := n.getGraphMode()
+		return resultf(graphModeResult{n.name, mode}, "Current graph mode on %s is %s", n.name, mode)
 	}
 
-	asked := args[0]
-	realCmd, exists := b.matchesCommandOrAlias(asked)
-	if !exists {
-		b.replyTof(e, "unknown command: %q", asked)
-		return
+	mode := strings.ToLower(args.str("mode"))
+	if !stringSliceContains(mode, []string{graphModeIRC, graphModeJSON, graphModeMerged}) {
+		return errorf("Unknown graph mode %q, must be one of %s, %s, or %s", mode, graphModeIRC, graphModeJSON, graphModeMerged)
 	}
 
-	desc := b.commands[realCmd]
-	aliases := ""
-	if len(b.commandAliases[realCmd]) > 0 {
-		aliases = fmt.Sprintf(" -- Aliases: %s", strings.Join(b.commandAliases[realCmd], ", "))
-	}
+	n.graphModeMutex.Lock()
+	n.graphMode = mode
+	n.graphModeMutex.Unlock()
 
-	b.replyTof(e, "help for %q: %s%s", realCmd, desc, aliases)
+	return resultf(graphModeResult{n.name, mode}, "Graph mode on %s set to %s", n.name, mode)
 }
 
-func (b *bot) hopsBetween(e *irc.Event, args []string) {
-	go func() {
-		b.updateLinksAndMap()
-		gr, err := graphFromLinksAndMap(b.lastLINKS, b.lastMAP, b.getID)
-		// gr, err := getGraph(host)
-		if err != nil {
-			b.replyTof(e, "Error: %s", err)
-			return
-		}
+// reconcileSources fetches both graphs for reconcile
+func (b *bot) reconcileSources(n *network) (graph, graph, error) {
+	ircG, err := n.ircGraph()
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not get IRC graph: %w", err)
+	}
 
-		one := gr.getServer(args[0])
-		two := gr.getServer(args[1])
+	jsonG, err := n.jsonGraph()
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not get ioserv graph: %w", err)
+	}
 
-		if one == nil {
-			b.replyTof(e, "Server ID / name %q doesn't exist!", args[0])
-			return
-		}
+	return ircG, jsonG, nil
+}
 
-		if two == nil {
-			b.replyTof(e, "Server ID / name %q doesn't exist!", args[1])
-			return
-		}
-		t := time.Now()
-		dst := gr.distanceToPeer(one, two)
+func (b *bot) reconcile(n *network, _ *irc.Event, _ *commandArgs) *commandResult {
+	return b.reconcileReport(n, false)
+}
 
-		b.replyTof(
-			e, "there are %d hops between %s and %s (Search took %s)",
-			dst, one.NameID(), two.NameID(), time.Since(t),
-		)
-	}()
+func (b *bot) reconcileFull(n *network, _ *irc.Event, _ *commandArgs) *commandResult {
+	return b.reconcileReport(n, true)
 }
 
-func (b *bot) maxHops(e *irc.Event, args []string) {
-	go func() {
-		b.updateLinksAndMap()
-		gr, err := graphFromLinksAndMap(b.lastLINKS, b.lastMAP, b.getID)
-		// gr, err := getGraph(host)
-		if err != nil {
-			b.replyTof(e, "Error: %s", err)
-			return
-		}
+// reconcileReport returns a summary of the differences between the IRC and ioserv graphs, followed by every
+// difference if full is set
+func (b *bot) reconcileReport(n *network, full bool) *commandResult {
+	ircG, jsonG, err := b.reconcileSources(n)
+	if err != nil {
+		return errorResult(err)
+	}
 
-		skipTilde := true
+	report := reconcileGraphs(ircG, jsonG)
+	res := newResult(report, report.Summary())
+	if full {
+		res.text = append(res.text, report.Details()...)
+	}
 
-		if len(args) > 0 && stringSliceContains("-noskip", args) {
-			skipTilde = false
-		}
+	return res
+}
 
-		t := time.Now()
-		var bestPair [2]*Server
-		best := -1
-		for _, start := range gr {
-			distances := gr.allDistancesFrom(start)
-			for other, d := range distances {
-				if skipTilde && strings.HasPrefix(other.Description, "~") {
-					continue
-				}
-				if d > best {
-					best = d
-					bestPair = [2]*Server{start, other}
-				}
-			}
-		}
+func (b *bot) reconcileServer(n *network, _ *irc.Event, args *commandArgs) *commandResult {
+	ircG, jsonG, err := b.reconcileSources(n)
+	if err != nil {
+		return errorResult(err)
+	}
 
-		if bestPair[0] == nil || bestPair[1] == nil {
-			b.replyTo(e, "Error occurred (try with -noskip)")
-			return
-		}
+	if err := args.resolveServers(newTopology(mergeGraphs(ircG, jsonG))); err != nil {
+		return errorResult(err)
+	}
 
-		b.replyTof(
-			e,
-			"Largest hop size is %d! between %s and %s (search took %s)",
-			best, bestPair[0].NameID(), bestPair[1].NameID(), time.Since(t),
-		)
-	}()
+	srv := args.server("server")
+	return resultf(struct {
+		Server     serverRef         `json:"server"`
+		Provenance map[string]string `json:"provenance"`
+	}{srv.ref(), srv.Provenance}, "%s: %s", srv.NameID(), srv.ProvenanceString())
 }
 
-// Parsing LINKS and MAP will work to get all the required data.
-
-func (b *bot) updateLinksAndMap() (out error) {
-	// b.mapLinksMutex.Lock()
-	// defer b.mapLinksMutex.Unlock()
-	defer func() {
-		if err := recover(); err != nil {
-			out = fmt.Errorf("caught panic: %s", err)
-		}
-	}()
-
-	if b.updatingLinkAndMap {
-		return errors.New("already updating")
+func (b *bot) validateJSON(n *network, _ *irc.Event, _ *commandArgs) *commandResult {
+	g, err := n.jsonGraph()
+	if err != nil {
+		return errorResult(err)
 	}
-	b.updatingLinkAndMap = true
 
-	linksChan := make(chan []string)
-	mapChan := make(chan string)
-	currentLinks := [][]string{}
-	currentMap := []string{}
+	report := n.ioserv.LastReport()
+	return resultf(struct {
+		Servers int           `json:"servers"`
+		Report  *ioservReport `json:"report"`
+	}{len(g), report}, "ioserv JSON has %d servers: %s", len(g), report)
+}
 
-	go func() {
-		for res := range linksChan {
-			currentLinks = append(currentLinks, res)
-		}
-	}()
+type networkStatus struct {
+	Name      string `json:"name"`
+	Server    string `json:"server"`
+	Connected bool   `json:"connected"`
+}
 
-	go func() {
-		for res := range mapChan {
-			currentMap = append(currentMap, res)
+func (b *bot) listNetworks(_ *network, _ *irc.Event, _ *commandArgs) *commandResult {
+	names := []string{}
+	data := []networkStatus{}
+	for _, name := range b.cfg.networkNames() {
+		n := b.networks[name]
+		status := "disconnected"
+		if n.ircCon.Connected() {
+			status = "connected"
 		}
-	}()
-
-	wg := sync.WaitGroup{}
-	wg.Add(2)
 
-	defer func() { b.updatingLinkAndMap = false }()
-	linksCB := b.ircCon.AddCallback(RPL_LINKS, func(e *irc.Event) { linksChan <- e.Arguments[1:] })
-	linksEndCB := b.ircCon.AddCallback(RPL_ENDOFLINKS, func(_ *irc.Event) {
-		defer wg.Done()
-		b.ircCon.RemoveCallback(RPL_LINKS, linksCB)
-		close(linksChan)
-	})
+		names = append(names, fmt.Sprintf("%s (%s, %s)", name, n.cfg.IRC.Server, status))
+		data = append(data, networkStatus{Name: name, Server: n.cfg.IRC.Server, Connected: n.ircCon.Connected()})
+	}
 
-	mapCB := b.ircCon.AddCallback(RPL_MAP, func(e *irc.Event) { mapChan <- e.MessageWithoutFormat() })
-	mapEndCB := b.ircCon.AddCallback(RPL_ENDOFMAP, func(_ *irc.Event) {
-		defer wg.Done()
-		b.ircCon.RemoveCallback(RPL_MAP, mapCB)
-		close(mapChan)
-	})
+	return resultf(data, "Networks: %s", strings.Join(names, ", "))
+}
 
-	b.ircCon.SendRaw("MAP")
-	b.ircCon.SendRaw("LINKS")
+func (b *bot) compare(_ *network, _ *irc.Event, args *commandArgs) *commandResult {
+	nets := []*network{}
+	for _, name := range []string{args.str("network"), args.str("other")} {
+		n, exists := b.networks[name]
+		if !exists {
+			return errorf("unknown network %q, available: %s", name, strings.Join(b.cfg.networkNames(), ", "))
+		}
 
-	wg.Wait()
+		nets = append(nets, n)
+	}
 
-	b.ircCon.RemoveCallback(RPL_ENDOFMAP, mapEndCB)
-	b.ircCon.RemoveCallback(RPL_ENDOFLINKS, linksEndCB)
+	res := newResult(nil)
+	data := map[string]graphStats{}
+	for _, n := range nets {
+		s, err := n.currentSnapshot()
+		if err != nil {
+			res.text = append(res.text, fmt.Sprintf("%s: Error: %s", n.name, err))
+			res.warn("could not get graph for %s: %s", n.name, err)
+			continue
+		}
 
-	b.lastLINKS = currentLinks
-	b.lastMAP = currentMap
+		st := s.topology().stats()
+		data[n.name] = st
+		res.text = append(res.text, fmt.Sprintf("%s: %s", n.name, st.summary()))
+	}
 
-	return nil
+	res.Data = data
+	return res
 }
 
-var getIDRe = regexp.MustCompile(`^GETID: (\S+) is (\S+)$`)
+func (b *bot) graphSizes(n *network, _ *irc.Event, _ *commandArgs) *commandResult {
+	var (
+		wg        sync.WaitGroup
+		jsonG     graph
+		jsonErr   error
+		updateErr error
+		ircG      graph
+		ircErr    error
+	)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		jsonG, jsonErr = n.jsonGraph()
+	}()
 
-func (b *bot) getID(name string) (id string, err error) {
-	donechan := make(chan string, 1)
-	var noticeID, noSuchNickID int
+	updateErr = n.updateLinksAndMap()
+	links, sMap := n.linksAndMap()
+	ircG, ircErr = graphFromLinksAndMap(links, sMap, n.ids.resolve)
+	wg.Wait()
 
-	noticeID = b.ircCon.AddCallback(NOTICE, func(e *irc.Event) {
-		msg := e.Message()
-		pair := getIDRe.FindStringSubmatch(msg)
-		if pair == nil || len(pair) == 0 {
-			return
+	errString := func(err error) string {
+		if err == nil {
+			return ""
 		}
 
-		// we matched, extract the data we want, verify that its ours
-		retName, id := pair[1], pair[2]
+		return err.Error()
+	}
 
-		if strings.ToLower(name) != strings.ToLower(retName) {
-			return // wasnt us
-		}
+	return newResult(
+		struct {
+			JSON        int    `json:"json"`
+			JSONError   string `json:"json_error,omitempty"`
+			IRC         int    `json:"irc"`
+			UpdateError string `json:"update_error,omitempty"`
+			IRCError    string `json:"irc_error,omitempty"`
+		}{len(jsonG), errString(jsonErr), len(ircG), errString(updateErr), errString(ircErr)},
+		fmt.Sprintf("net: %d %s", len(jsonG), jsonErr),
+		fmt.Sprintf("l+m: %d %s | %s", len(ircG), updateErr, ircErr),
+	)
+}
 
-		// it was us. drop the hook
-		b.ircCon.RemoveCallback(NOTICE, noticeID)
-		b.ircCon.RemoveCallback(RPL_NOSUCHNICK, noSuchNickID)
-		donechan <- id
-	})
+func (b *bot) update(n *network, _ *irc.Event, args *commandArgs) *commandResult {
+	type updateResult struct {
+		Updated bool    `json:"updated"`
+		AgeSecs float64 `json:"age_seconds"`
+	}
 
-	noSuchNickID = b.ircCon.AddCallback("401", func(e *irc.Event) {
-		resName := e.Arguments[1]
-		if strings.ToLower(resName) != strings.ToLower(name) {
-			return // Not us
+	if maxAge := args.duration("max-age", 0); maxAge > 0 {
+		if age := time.Since(n.lastUpdated()); age < maxAge {
+			return resultf(updateResult{false, age.Seconds()}, "LINKS and MAP are only %s old, not updating", age.Round(time.Second))
 		}
+	}
 
-		b.ircCon.RemoveCallback(NOTICE, noticeID)
-		b.ircCon.RemoveCallback(RPL_NOSUCHNICK, noSuchNickID)
-		donechan <- ""
-	})
-
-	b.ircCon.SendRawf("GETID %s", name)
-
-	timer := time.NewTicker(time.Second)
-	defer timer.Stop()
-
-	select {
-	case <-time.After(time.Second):
-		return "", errors.New("timed out")
-	case id := <-donechan:
-		return id, nil
+	if err := n.updateLinksAndMap(); err != nil {
+		return errorResult(err)
 	}
+
+	return newResult(updateResult{true, 0}, "Done")
 }
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	irc "github.com/thoj/go-ircevent"
+)
+
+// network is a single IRC network the bot is connected to, with its own connection, data sources and graph cache
+type network struct {
+	name    string
+	cfg     *networkConfig
+	refresh refreshConfig
+	ircCon  *irc.Connection
+	ids     *idResolver
+	ioserv  *ioservClient // nil if the network has no ioserv JSON
+	output  *outputQueue
+
+	lastLINKS      [][]string
+	lastMAP        []string
+	mapLinksMutex  sync.Mutex
+	inflightUpdate *linksAndMapUpdate
+	lastUpdate     time.Time
+
+	graphMode      string
+	graphModeMutex sync.Mutex
+
+	opered    bool
+	operMutex sync.Mutex
+
+	userLookups map[string]userLookup
+	// accountTags is set once the server has agreed to account-tag, after which a message without the tag is from
+	// someone who is not logged in
+	accountTags     bool
+	userLookupMutex sync.Mutex
+
+	// selfServer is the name of the server we are connected to
+	selfServer    string
+	snapshot      *snapshot
+	version       uint64
+	snapshotHooks []snapshotHook
+	snapshotMutex sync.Mutex
+
+	// published holds the latest *snapshot, for commands to read without waiting on a refresh
+	published     atomic.Value
+	inflightBuild *snapshotBuild
+	buildMutex    sync.Mutex
+}
+
+func newNetwork(name string, cfg *networkConfig, global *config) (*network, error) {
+	irccon := irc.IRC(cfg.IRC.Nick, cfg.IRC.User)
+	if irccon == nil {
+		return nil, fmt.Errorf("network %s: nick and user must be set", name)
+	}
+
+	irccon.Debug = cfg.IRC.Debug
+	irccon.UseTLS = cfg.IRC.TLS
+	irccon.RealName = cfg.IRC.RealName
+
+	n := &network{
+		name:        name,
+		cfg:         cfg,
+		refresh:     global.Refresh,
+		ircCon:      irccon,
+		graphMode:   cfg.Sources.GraphMode,
+		userLookups: make(map[string]userLookup),
+		output:      newOutputQueue(irccon, global.Output, cfg.IRC.User, global.Commands.Prefix+"more"),
+	}
+
+	sources := []idSource{
+		mapIDSource{lines: func() []string { _, sMap := n.linksAndMap(); return sMap }},
+		getIDSource{con: irccon, timeout: global.Refresh.GetIDTimeout},
+	}
+
+	if cfg.Sources.IOServURL != "" {
+		n.ioserv = newIOServClient(cfg.Sources.IOServURL)
+		sources = append(sources, jsonIDSource{client: n.ioserv})
+	}
+
+	sources = append(sources, staticIDSource(cfg.Sources.StaticIDs))
+	n.ids = newIDResolver(cfg.Sources.IDCache, irccon.Log, sources...)
+
+	if err := n.setupAuth(); err != nil {
+		return nil, fmt.Errorf("network %s: %w", name, err)
+	}
+
+	n.ircCon.AddCallback("001", func(e *irc.Event) {
+		n.setOper(false)
+		n.resetUsers()
+		n.setSelfServer(e.Source)
+		go n.onWelcome()
+	})
+
+	n.ircCon.AddCallback("CAP", func(e *irc.Event) {
+		if len(e.Arguments) > 2 && e.Arguments[1] == "ACK" && listContains(e.Arguments[2], "account-tag") {
+			n.setAccountTags()
+		}
+	})
+
+	// Anything we know about a user from WHO is stale once they log in or out, or leave. ACCOUNT needs
+	// account-notify. A nick change makes both the old and new nick stale, as someone else may have held the new one.
+	for _, code := range []string{"QUIT", "ACCOUNT"} {
+		n.ircCon.AddCallback(code, func(e *irc.Event) { n.forgetUser(e.Nick) })
+	}
+
+	n.ircCon.AddCallback("NICK", func(e *irc.Event) {
+		n.forgetUser(e.Nick)
+		n.forgetUser(e.Message())
+	})
+
+	return n, nil
+}
+
+// run connects to the network and blocks until the connection is closed for good
+func (n *network) run() {
+	stop := make(chan struct{})
+	defer close(stop)
+	go n.ids.retryPending(stop)
+	go n.poll(stop)
+
+	if err := n.ircCon.Connect(n.cfg.IRC.Server); err != nil {
+		n.ircCon.Log.Printf("Could not connect to %s: %s", n.name, err)
+		return
+	}
+
+	n.ircCon.Loop()
+}
+
+// jsonGraph returns the graph from this network's ioserv JSON
+func (n *network) jsonGraph() (graph, error) {
+	if n.ioserv == nil {
+		return nil, fmt.Errorf("no ioserv JSON is configured for %s", n.name)
+	}
+
+	return n.ioserv.Graph()
+}
+
+// Parsing LINKS and MAP will work to get all the required data.
+
+// linksAndMapTimeout is the default for how long we wait for both RPL_ENDOFMAP and RPL_ENDOFLINKS before giving up
+const linksAndMapTimeout = 30 * time.Second
+
+type linksAndMapUpdate struct {
+	done chan struct{}
+	err  error
+}
+
+// updateLinksAndMap requests MAP and LINKS from the server and stores the results on the bot. If an update is
+// already running, it waits for that update and returns its result instead of starting another.
+func (n *network) updateLinksAndMap() error {
+	n.mapLinksMutex.Lock()
+	if u := n.inflightUpdate; u != nil {
+		n.mapLinksMutex.Unlock()
+		<-u.done
+		return u.err
+	}
+
+	u := &linksAndMapUpdate{done: make(chan struct{})}
+	n.inflightUpdate = u
+	n.mapLinksMutex.Unlock()
+
+	u.err = n.doUpdateLinksAndMap()
+
+	n.mapLinksMutex.Lock()
+	n.inflightUpdate = nil
+	n.mapLinksMutex.Unlock()
+	close(u.done)
+
+	return u.err
+}
+
+func (n *network) doUpdateLinksAndMap() (out error) {
+	defer func() {
+		if err := recover(); err != nil {
+			out = fmt.Errorf("caught panic: %s", err)
+		}
+	}()
+
+	if !n.ircCon.Connected() {
+		return errors.New("not connected to IRC")
+	}
+
+	if !n.isOper() {
+		n.ircCon.Log.Println("Requesting MAP and LINKS without being opered, results may be incomplete")
+	}
+
+	var (
+		resultMutex  sync.Mutex
+		currentLinks = [][]string{}
+		currentMap   = []string{}
+		linksDone    = make(chan struct{})
+		mapDone      = make(chan struct{})
+		linksOnce    sync.Once
+		mapOnce      sync.Once
+		failed       = make(chan error, 1)
+		callbacks    []irc.CallbackID
+	)
+
+	fail := func(err error) {
+		select {
+		case failed <- err:
+		default:
+		}
+	}
+
+	addCallback := func(code string, cb func(*irc.Event)) {
+		callbacks = append(callbacks, irc.CallbackID{EventCode: code, ID: n.ircCon.AddCallback(code, cb)})
+	}
+
+	defer func() {
+		for _, cb := range callbacks {
+			n.ircCon.RemoveCallback(cb.EventCode, cb.ID)
+		}
+	}()
+
+	addCallback(RPL_LINKS, func(e *irc.Event) {
+		line, err := splitLinksReply(e.Arguments)
+		if err != nil {
+			n.ircCon.Log.Printf("Skipping bad LINKS reply %q: %s", e.Raw, err)
+			return
+		}
+
+		resultMutex.Lock()
+		defer resultMutex.Unlock()
+		currentLinks = append(currentLinks, line)
+	})
+
+	addCallback(RPL_ENDOFLINKS, func(_ *irc.Event) { linksOnce.Do(func() { close(linksDone) }) })
+
+	addCallback(RPL_MAP, func(e *irc.Event) {
+		resultMutex.Lock()
+		defer resultMutex.Unlock()
+		currentMap = append(currentMap, e.MessageWithoutFormat())
+	})
+
+	addCallback(RPL_ENDOFMAP, func(_ *irc.Event) { mapOnce.Do(func() { close(mapDone) }) })
+
+	addCallback(ERR_NOPRIVILEGES, func(e *irc.Event) {
+		fail(fmt.Errorf("server refused MAP or LINKS: %s", e.Message()))
+	})
+
+	addCallback(ERR_UNKNOWNCOMMAND, func(e *irc.Event) {
+		if len(e.Arguments) < 2 {
+			return
+		}
+
+		if cmd := strings.ToUpper(e.Arguments[1]); cmd == "MAP" || cmd == "LINKS" {
+			fail(fmt.Errorf("server does not support %s", cmd))
+		}
+	})
+
+	addCallback("ERROR", func(e *irc.Event) {
+		fail(fmt.Errorf("disconnected while waiting for MAP and LINKS: %s", e.Message()))
+	})
+
+	n.ircCon.SendRaw("MAP")
+	n.ircCon.SendRaw("LINKS")
+
+	timeout := time.NewTimer(n.refresh.Timeout)
+	defer timeout.Stop()
+
+	for linksDone != nil || mapDone != nil {
+		select {
+		case <-linksDone:
+			linksDone = nil
+		case <-mapDone:
+			mapDone = nil
+		case err := <-failed:
+			return err
+		case <-timeout.C:
+			return fmt.Errorf("timed out after %s waiting for MAP and LINKS", n.refresh.Timeout)
+		}
+	}
+
+	resultMutex.Lock()
+	defer resultMutex.Unlock()
+
+	n.mapLinksMutex.Lock()
+	n.lastLINKS = currentLinks
+	n.lastMAP = currentMap
+	n.lastUpdate = time.Now()
+	n.mapLinksMutex.Unlock()
+
+	return nil
+}
+
+// refreshLinksAndMap updates LINKS and MAP unless they were collected less than the configured minimum interval ago
+func (n *network) refreshLinksAndMap() error {
+	n.mapLinksMutex.Lock()
+	fresh := n.lastLINKS != nil && time.Since(n.lastUpdate) < n.refresh.MinInterval
+	n.mapLinksMutex.Unlock()
+
+	if fresh {
+		return nil
+	}
+
+	return n.updateLinksAndMap()
+}
+
+// lastUpdated returns when LINKS and MAP were last collected, or the zero time if they never have been
+func (n *network) lastUpdated() time.Time {
+	n.mapLinksMutex.Lock()
+	defer n.mapLinksMutex.Unlock()
+
+	return n.lastUpdate
+}
+
+// linksAndMap returns the most recently collected LINKS and MAP output
+func (n *network) linksAndMap() ([][]string, []string) {
+	n.mapLinksMutex.Lock()
+	defer n.mapLinksMutex.Unlock()
+
+	return n.lastLINKS, n.lastMAP
+}
+
+// ircGraph refreshes LINKS and MAP and builds a graph from them
+func (n *network) ircGraph() (graph, error) {
+	if err := n.refreshLinksAndMap(); err != nil {
+		return nil, err
+	}
+
+	links, sMap := n.linksAndMap()
+	return graphFromLinksAndMap(links, sMap, n.ids.resolve)
+}
+
+// latestSnapshot returns the most recently published snapshot, or nil if no graph has been built yet
+func (n *network) latestSnapshot() *snapshot {
+	s, _ := n.published.Load().(*snapshot)
+	return s
+}
+
+// currentSnapshot returns the latest snapshot if it is younger than refresh.max_age and was built in the current
+// graph mode, and builds a new one otherwise. Commands share snapshots this way, rather than each asking the server
+// for MAP and LINKS and resolving IDs again.
+func (n *network) currentSnapshot() (*snapshot, error) {
+	s := n.latestSnapshot()
+	if s != nil && s.Mode == n.getGraphMode() && time.Since(s.Taken) < n.refresh.MaxAge {
+		return s, nil
+	}
+
+	return n.refreshSnapshot()
+}
+
+type snapshotBuild struct {
+	done chan struct{}
+	snap *snapshot
+	err  error
+}
+
+// refreshSnapshot builds a graph according to the current graph mode, and publishes a snapshot of it. In the
+// default mode, the graph comes from IRC and the ioserv JSON is used if the IRC source is unavailable for any
+// reason. If a snapshot is already being built, it waits for that one instead of starting another.
+func (n *network) refreshSnapshot() (*snapshot, error) {
+	n.buildMutex.Lock()
+	if b := n.inflightBuild; b != nil {
+		n.buildMutex.Unlock()
+		<-b.done
+		return b.snap, b.err
+	}
+
+	b := &snapshotBuild{done: make(chan struct{})}
+	n.inflightBuild = b
+	n.buildMutex.Unlock()
+
+	mode := n.getGraphMode()
+	g, source, err := n.buildGraph(mode)
+	if err != nil {
+		b.err = err
+	} else {
+		b.snap = n.recordSnapshot(g, source, mode)
+	}
+
+	n.buildMutex.Lock()
+	n.inflightBuild = nil
+	n.buildMutex.Unlock()
+	close(b.done)
+
+	return b.snap, b.err
+}
+
+// buildGraph builds a graph for mode and says which source it came from
+func (n *network) buildGraph(mode string) (graph, string, error) {
+	switch mode {
+	case graphModeJSON:
+		g, err := n.jsonGraph()
+		return g, mode, err
+
+	case graphModeMerged:
+		ircG, err := n.ircGraph()
+		if err != nil {
+			return nil, "", fmt.Errorf("could not get IRC graph: %w", err)
+		}
+
+		jsonG, err := n.jsonGraph()
+		if err != nil {
+			return nil, "", fmt.Errorf("could not get ioserv graph: %w", err)
+		}
+
+		return mergeGraphs(ircG, jsonG), mode, nil
+	}
+
+	g, err := n.ircGraph()
+	if err == nil {
+		return g, graphModeIRC, nil
+	}
+
+	if n.ioserv == nil {
+		return nil, "", err
+	}
+
+	n.ircCon.Log.Printf("Could not build graph from LINKS and MAP (%s), falling back to ioserv", err)
+	g, jsonErr := n.jsonGraph()
+	if jsonErr != nil {
+		return nil, "", fmt.Errorf("IRC source failed (%s) and JSON fallback failed: %w", err, jsonErr)
+	}
+
+	return g, graphModeJSON, nil
+}
+
+const (
+	graphModeIRC    = "irc"
+	graphModeJSON   = "json"
+	graphModeMerged = "merged"
+)
+
+func (n *network) getGraphMode() string {
+	n.graphModeMutex.Lock()
+	defer n.graphModeMutex.Unlock()
+
+	if n.graphMode == "" {
+		return graphModeIRC
+	}
+
+	return n.graphMode
+}
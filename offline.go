@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	irc "github.com/thoj/go-ircevent"
+)
+
+// parseRawLine splits a raw IRC line into its command and parameters. Tags, the source, and the ">> " prefix used
+// in our logs are dropped. ok is false if the line doesnt look like a raw IRC line.
+func parseRawLine(line string) (command string, params []string, ok bool) {
+	line = strings.TrimPrefix(strings.TrimSpace(line), ">> ")
+	if !strings.HasPrefix(line, "@") && !strings.HasPrefix(line, ":") {
+		return "", nil, false
+	}
+
+	if strings.HasPrefix(line, "@") {
+		split := strings.SplitN(line, " ", 2)
+		if len(split) != 2 {
+			return "", nil, false
+		}
+
+		line = strings.TrimLeft(split[1], " ")
+	}
+
+	if strings.HasPrefix(line, ":") {
+		split := strings.SplitN(line, " ", 2)
+		if len(split) != 2 {
+			return "", nil, false
+		}
+
+		line = strings.TrimLeft(split[1], " ")
+	}
+
+	trailing := ""
+	hasTrailing := false
+	if idx := strings.Index(line, " :"); idx != -1 {
+		trailing = line[idx+2:]
+		hasTrailing = true
+		line = line[:idx]
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil, false
+	}
+
+	params = fields[1:]
+	if hasTrailing {
+		params = append(params, trailing)
+	}
+
+	return strings.ToUpper(fields[0]), params, true
+}
+
+// dumpLines returns every non-blank, non-comment line in r
+func dumpLines(r io.Reader) ([]string, error) {
+	out := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+
+		out = append(out, line)
+	}
+
+	return out, scanner.Err()
+}
+
+// parseLinksDump reads saved LINKS output, either as raw RPL_LINKS lines or as "<from> <to> [:]<hops> <description>"
+// lines. The result is in the same form updateLinksAndMap collects.
+func parseLinksDump(r io.Reader) ([][]string, error) {
+	lines, err := dumpLines(r)
+	if err != nil {
+		return nil, err
+	}
+
+	out := [][]string{}
+	for _, line := range lines {
+		if command, params, ok := parseRawLine(line); ok {
+			if command != RPL_LINKS {
+				continue
+			}
+
+			links, err := splitLinksReply(params)
+			if err != nil {
+				return nil, fmt.Errorf("malformed RPL_LINKS line: %q: %w", line, err)
+			}
+
+			out = append(out, links)
+			continue
+		}
+
+		split := strings.SplitN(strings.TrimSpace(line), " ", 3)
+		if len(split) < 3 {
+			return nil, fmt.Errorf("malformed LINKS line: %q", line)
+		}
+
+		out = append(out, []string{split[0], split[1], strings.TrimPrefix(split[2], ":")})
+	}
+
+	return out, nil
+}
+
+// parseMapDump reads saved MAP output, either as raw RPL_MAP lines or as the bare text of each line
+func parseMapDump(r io.Reader) ([]string, error) {
+	lines, err := dumpLines(r)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []string{}
+	for _, line := range lines {
+		if command, params, ok := parseRawLine(line); ok {
+			if command != RPL_MAP || len(params) == 0 {
+				continue
+			}
+
+			out = append(out, (&irc.Event{Arguments: params}).MessageWithoutFormat())
+			continue
+		}
+
+		out = append(out, line)
+	}
+
+	return out, nil
+}
+
+func parseDumpFile(path string, parse func(io.Reader) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return parse(f)
+}
+
+// loadGraph loads a graph without touching IRC. source is an ioserv URL, a saved ioserv JSON file, or a pair of
+// saved LINKS and MAP files given as "links.txt+map.txt".
+func loadGraph(source string, resolveIDs func([]string) map[string]string) (graph, error) {
+	switch {
+	case strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://"):
+		return newIOServClient(source).Graph()
+
+	case strings.Contains(source, "+"):
+		split := strings.SplitN(source, "+", 2)
+		var (
+			links [][]string
+			sMap  []string
+		)
+
+		err := parseDumpFile(split[0], func(r io.Reader) (err error) {
+			links, err = parseLinksDump(r)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not read LINKS from %q: %w", split[0], err)
+		}
+
+		err = parseDumpFile(split[1], func(r io.Reader) (err error) {
+			sMap, err = parseMapDump(r)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not read MAP from %q: %w", split[1], err)
+		}
+
+		return graphFromLinksAndMap(links, sMap, resolveIDs)
+	}
+
+	data, err := ioutil.ReadFile(source)
+	if err != nil {
+		return nil, err
+	}
+
+	g, report, err := parseIOServGraph(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if !report.OK() {
+		log.Printf("%s: %s", source, report)
+	}
+
+	return g, nil
+}
+
+// analyzeMain implements the "analyze" subcommand, which runs a graph analysis without connecting to IRC
+func analyzeMain(args []string) int {
+	fs := flag.NewFlagSet("analyze", flag.ContinueOnError)
+	configPath := fs.String("config", defaultConfigFile, "path to the config file")
+	netName := fs.String("net", "", "network whose sources to use, if more than one is configured")
+	source := fs.String("source", "", "ioserv URL, ioserv JSON file, or links.txt+map.txt (default: the configured ioserv URL)")
+	cmd := fs.String("cmd", "", "analysis to run")
+	list := fs.Bool("list", false, "list available analyses")
+	asJSON := fs.Bool("json", false, "print the result as JSON, as --json does for chat commands")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s analyze [--source SOURCE] --cmd ANALYSIS [-- ARGS...]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if *list {
+		for _, name := range analysisNames() {
+			a, _ := findAnalysis(name)
+			fmt.Printf("%s -- %s\n", a.command().usage(""), a.desc)
+		}
+
+		return 0
+	}
+
+	a, exists := findAnalysis(*cmd)
+	if !exists {
+		fmt.Fprintf(os.Stderr, "unknown analysis %q, available: %s\n", *cmd, strings.Join(analysisNames(), ", "))
+		return 2
+	}
+
+	_, cmdArgs, err := parseCommandArgs(a.command(), fs.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\nusage: %s\n", err, a.command().usage(""))
+		return 2
+	}
+
+	cfg, err := loadConfig(*configPath, isFlagSet(fs, "config"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	nc, err := cfg.network(*netName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if *source == "" {
+		*source = nc.Sources.IOServURL
+	}
+
+	// Without IRC, IDs for servers missing from MAP can only come from the static table or a previous cache. The
+	// cache may belong to a running bot, so the fake IDs made up here are not saved to it.
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	resolver := newIDResolver(nc.Sources.IDCache, logger, staticIDSource(nc.Sources.StaticIDs))
+	resolver.readOnly = true
+
+	g, err := loadGraph(*source, resolver.resolve)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not load graph: %s\n", err)
+		return 1
+	}
+
+	res := runAnalysis(a, newTopology(g), cmdArgs, logger)
+	res.Command = a.name
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(res); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	} else if res.OK {
+		for _, line := range res.lines() {
+			fmt.Println(line)
+		}
+	}
+
+	if !res.OK {
+		fmt.Fprintln(os.Stderr, res.Error)
+		return 1
+	}
+
+	return 0
+}
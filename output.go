@@ -0,0 +1,339 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	irc "github.com/thoj/go-ircevent"
+)
+
+const (
+	// ircLineLimit is the most bytes a line may have, including the trailing CRLF
+	ircLineLimit = 512
+	// assumedHostLen is used for our own hostname until the server shows it to us
+	assumedHostLen = 63
+	overflowMore   = "more"
+	overflowPaste  = "paste"
+	// minLineBudget stops absurdly long targets from leaving no room for text at all
+	minLineBudget = 64
+	// idleTargetLimit is how many per-target rate limiters are kept before idle ones are dropped
+	idleTargetLimit = 256
+)
+
+// lineSeparators are the places long lines are split at, most preferred first
+var lineSeparators = []string{" -> ", " | ", "; ", ", ", " "}
+
+type outputConfig struct {
+	// PageLines is how many lines a reply may use. The rest are held back for the more command.
+	PageLines int `toml:"page_lines"`
+	// Burst lines can be sent to a target at once, after which one more is allowed every Rate
+	Burst int           `toml:"burst"`
+	Rate  time.Duration `toml:"rate"`
+	// PageExpiry is how long held back lines are kept
+	PageExpiry time.Duration `toml:"page_expiry"`
+	// Overflow is what happens to replies longer than a page: "more" pages them, "paste" puts them on the built in
+	// pastebin and replies with a link
+	Overflow string `toml:"overflow"`
+}
+
+// splitMessage splits message into pieces of at most budget bytes, breaking after separators where it can and
+// never inside a UTF-8 sequence
+func splitMessage(message string, budget int) []string {
+	out := []string{}
+	for len(message) > budget {
+		cut := splitPoint(message, budget)
+		out = append(out, strings.TrimRight(message[:cut], " "))
+		message = strings.TrimLeft(message[cut:], " ")
+	}
+
+	if message != "" || len(out) == 0 {
+		out = append(out, message)
+	}
+
+	return out
+}
+
+// splitPoint returns where to cut message so the first piece fits in budget bytes
+func splitPoint(message string, budget int) int {
+	head := message[:budget]
+	for _, sep := range lineSeparators {
+		// Only break early for a preferred separator if that doesnt waste most of the line
+		idx := strings.LastIndex(head, sep)
+		if idx > 0 && (idx >= budget/2 || sep == " ") {
+			return idx + len(sep)
+		}
+	}
+
+	return runeCut(message, budget)
+}
+
+// runeCut returns the last place at or before budget that message can be cut without splitting a UTF-8 sequence
+func runeCut(message string, budget int) int {
+	cut := budget
+	for cut > 0 && !utf8.RuneStart(message[cut]) {
+		cut--
+	}
+
+	if cut == 0 {
+		return budget
+	}
+
+	return cut
+}
+
+// tokenBucket allows a burst of sends, then one send every rate
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// take blocks until a send is allowed
+func (t *tokenBucket) take(burst int, rate time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.tokens = math.Min(float64(burst), t.tokens+float64(now.Sub(t.last))/float64(rate))
+	t.last = now
+
+	if t.tokens < 1 {
+		time.Sleep(time.Duration((1 - t.tokens) * float64(rate)))
+		t.tokens = 1
+		t.last = time.Now()
+	}
+
+	t.tokens--
+}
+
+// outputTarget is the state kept for each channel or nick we send to
+type outputTarget struct {
+	// sending is held for the whole of a reply so replies to the same target dont interleave
+	sending sync.Mutex
+	bucket  tokenBucket
+	used    time.Time
+
+	pending        []string
+	pendingExpires time.Time
+}
+
+// outputQueue sends replies on a connection. Lines are split to fit what the server will relay, sends are rate
+// limited per target, and replies that are too long are paged with the more command.
+type outputQueue struct {
+	con         *irc.Connection
+	cfg         outputConfig
+	moreCommand string
+	// paste, if set, stores a long reply somewhere and returns a link to it
+	paste func(target string, lines []string) (string, error)
+
+	mu       sync.Mutex
+	targets  map[string]*outputTarget
+	selfUser string
+	selfHost string
+}
+
+func newOutputQueue(con *irc.Connection, cfg outputConfig, user, moreCommand string) *outputQueue {
+	q := &outputQueue{
+		con:         con,
+		cfg:         cfg,
+		moreCommand: moreCommand,
+		targets:     make(map[string]*outputTarget),
+		// Servers often add a ~ for users without ident, assume the worst until we know
+		selfUser: "~" + user,
+	}
+
+	con.AddCallback("JOIN", func(e *irc.Event) {
+		if strings.EqualFold(e.Nick, con.GetNick()) {
+			q.setSelf(e.User, e.Host)
+		}
+	})
+
+	con.AddCallback("CHGHOST", func(e *irc.Event) {
+		if strings.EqualFold(e.Nick, con.GetNick()) && len(e.Arguments) > 1 {
+			q.setSelf(e.Arguments[0], e.Arguments[1])
+		}
+	})
+
+	// A new connection may well get a different host
+	con.AddCallback("001", func(_ *irc.Event) { q.setSelf("~"+user, "") })
+
+	return q
+}
+
+func (q *outputQueue) setSelf(user, host string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.selfUser, q.selfHost = user, host
+}
+
+// budget returns how many bytes of text fit in a PRIVMSG to target, once the server has added our prefix
+func (q *outputQueue) budget(target string) int {
+	q.mu.Lock()
+	user, hostLen := q.selfUser, len(q.selfHost)
+	q.mu.Unlock()
+
+	if hostLen == 0 {
+		hostLen = assumedHostLen
+	}
+
+	// :nick!user@host PRIVMSG target :text\r\n
+	overhead := len(":!@ PRIVMSG  :\r\n") + len(q.con.GetNick()) + len(user) + hostLen + len(target)
+	if budget := ircLineLimit - overhead; budget > minLineBudget {
+		return budget
+	}
+
+	return minLineBudget
+}
+
+func (q *outputQueue) target(name string) *outputTarget {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	key := strings.ToLower(name)
+	t, exists := q.targets[key]
+	if !exists {
+		if len(q.targets) >= idleTargetLimit {
+			q.dropIdleTargets()
+		}
+
+		t = &outputTarget{bucket: tokenBucket{tokens: float64(q.cfg.Burst), last: time.Now()}}
+		q.targets[key] = t
+	}
+
+	t.used = time.Now()
+	return t
+}
+
+// dropIdleTargets forgets targets that have nothing pending and whose rate limit has fully recovered. q.mu must be
+// held.
+func (q *outputQueue) dropIdleTargets() {
+	idle := time.Duration(q.cfg.Burst) * q.cfg.Rate
+	for key, t := range q.targets {
+		if len(t.pending) == 0 && time.Since(t.used) > idle {
+			delete(q.targets, key)
+		}
+	}
+}
+
+// send sends lines to target. If they take more than a page once split, the rest are held back for more.
+func (q *outputQueue) send(target string, lines []string) {
+	budget := q.budget(target)
+	chunks := []string{}
+	for _, line := range lines {
+		// Servers reject empty messages
+		if line != "" {
+			chunks = append(chunks, splitMessage(line, budget)...)
+		}
+	}
+
+	if len(chunks) == 0 {
+		return
+	}
+
+	if len(chunks) > q.cfg.PageLines && q.paste != nil {
+		link, err := q.paste(target, lines)
+		if err == nil {
+			chunks = []string{chunks[0], fmt.Sprintf("Full output (%d lines): %s", len(lines), link)}
+		} else {
+			q.con.Log.Printf("Could not paste reply to %s, paging it instead: %s", target, err)
+		}
+	}
+
+	t := q.target(target)
+	t.sending.Lock()
+	defer t.sending.Unlock()
+
+	q.write(target, t, q.page(t, chunks))
+}
+
+// sendRaw sends message to target cut only where the byte budget requires, without trimming or paging, for replies
+// that must be put back together exactly
+func (q *outputQueue) sendRaw(target, message string) {
+	budget := q.budget(target)
+	chunks := []string{}
+	for len(message) > budget {
+		cut := runeCut(message, budget)
+		chunks = append(chunks, message[:cut])
+		message = message[cut:]
+	}
+
+	chunks = append(chunks, message)
+
+	t := q.target(target)
+	t.sending.Lock()
+	defer t.sending.Unlock()
+
+	q.write(target, t, chunks)
+}
+
+// more sends the next page of held back lines for target
+func (q *outputQueue) more(target string) {
+	t := q.target(target)
+	t.sending.Lock()
+	defer t.sending.Unlock()
+
+	q.mu.Lock()
+	pending := t.pending
+	if time.Now().After(t.pendingExpires) {
+		pending = nil
+	}
+
+	t.pending = nil
+	q.mu.Unlock()
+
+	if len(pending) == 0 {
+		q.write(target, t, []string{"Nothing more to show"})
+		return
+	}
+
+	q.write(target, t, q.page(t, pending))
+}
+
+// page returns the first page of chunks, holding back the rest on t
+func (q *outputQueue) page(t *outputTarget, chunks []string) []string {
+	if len(chunks) <= q.cfg.PageLines {
+		return chunks
+	}
+
+	held := chunks[q.cfg.PageLines:]
+	q.mu.Lock()
+	t.pending = held
+	t.pendingExpires = time.Now().Add(q.cfg.PageExpiry)
+	q.mu.Unlock()
+
+	return append(chunks[:q.cfg.PageLines:q.cfg.PageLines], fmt.Sprintf("(%d more lines, say %s)", len(held), q.moreCommand))
+}
+
+// notice sends lines to target as notices. Notices are for alerts nobody asked for just now, so they are never
+// paged or pasted.
+func (q *outputQueue) notice(target string, lines []string) {
+	budget := q.budget(target)
+	chunks := []string{}
+	for _, line := range lines {
+		if line != "" {
+			chunks = append(chunks, splitMessage(line, budget)...)
+		}
+	}
+
+	t := q.target(target)
+	t.sending.Lock()
+	defer t.sending.Unlock()
+
+	q.writeWith(q.con.Notice, target, t, chunks)
+}
+
+func (q *outputQueue) write(target string, t *outputTarget, lines []string) {
+	q.writeWith(q.con.Privmsg, target, t, lines)
+}
+
+func (q *outputQueue) writeWith(send func(target, message string), target string, t *outputTarget, lines []string) {
+	for _, line := range lines {
+		t.bucket.take(q.cfg.Burst, q.cfg.Rate)
+		send(target, line)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const pastePath = "/paste/"
+
+type pasteConfig struct {
+	// Expiry is how long a paste can be fetched for
+	Expiry time.Duration `toml:"expiry"`
+	// MaxPastes limits how many pastes are kept at once. The oldest are dropped first.
+	MaxPastes int `toml:"max_pastes"`
+}
+
+type paste struct {
+	id      string
+	title   string
+	lines   []string
+	created time.Time
+	expires time.Time
+}
+
+// pasteStore keeps long command output in memory so it can be served over HTTP instead of flooding IRC
+type pasteStore struct {
+	cfg  pasteConfig
+	http *httpServer
+
+	mu     sync.Mutex
+	pastes map[string]*paste
+	order  []string
+}
+
+func newPasteStore(cfg pasteConfig, h *httpServer) *pasteStore {
+	s := &pasteStore{cfg: cfg, http: h, pastes: make(map[string]*paste)}
+	h.handle(pastePath, s.serve)
+	return s
+}
+
+// add stores lines and returns a link to them
+func (s *pasteStore) add(title string, lines []string) (string, error) {
+	raw := make([]byte, 8)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("could not create paste ID: %w", err)
+	}
+
+	now := time.Now()
+	p := &paste{
+		id:      hex.EncodeToString(raw),
+		title:   title,
+		lines:   lines,
+		created: now,
+		expires: now.Add(s.cfg.Expiry),
+	}
+
+	s.mu.Lock()
+	s.expire()
+	for len(s.order) >= s.cfg.MaxPastes {
+		delete(s.pastes, s.order[0])
+		s.order = s.order[1:]
+	}
+
+	s.pastes[p.id] = p
+	s.order = append(s.order, p.id)
+	s.mu.Unlock()
+
+	return s.http.url(pastePath + p.id), nil
+}
+
+func (s *pasteStore) get(id string) (*paste, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire()
+	p, exists := s.pastes[id]
+	return p, exists
+}
+
+// expire drops every expired paste. s.mu must be held.
+func (s *pasteStore) expire() {
+	now := time.Now()
+	for len(s.order) > 0 && now.After(s.pastes[s.order[0]].expires) {
+		delete(s.pastes, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+var pasteTemplate = template.Must(template.New("paste").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Created {{.Created}}, expires {{.Expires}}. <a href="{{.ID}}">Plain text</a></p>
+<pre>{{range .Lines}}{{.}}
+{{end}}</pre>
+</body>
+</html>
+`))
+
+// serve renders a paste as plain text, or as HTML with ?format=html or a .html suffix
+func (s *pasteStore) serve(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, pastePath)
+	html := r.URL.Query().Get("format") == "html"
+	if strings.HasSuffix(id, ".html") {
+		id = strings.TrimSuffix(id, ".html")
+		html = true
+	}
+
+	p, exists := s.get(id)
+	if !exists {
+		http.Error(w, "no such paste, it may have expired", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if !html {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "%s\n\n%s\n", p.title, strings.Join(p.lines, "\n"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := pasteTemplate.Execute(w, struct {
+		ID, Title, Created, Expires string
+		Lines                       []string
+	}{
+		ID:      p.id,
+		Title:   p.title,
+		Created: p.created.UTC().Format(time.RFC1123),
+		Expires: p.expires.UTC().Format(time.RFC1123),
+		Lines:   p.lines,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
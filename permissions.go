@@ -0,0 +1,650 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	irc "github.com/thoj/go-ircevent"
+)
+
+const (
+	// roleEveryone is a built in role that matches anyone
+	roleEveryone = "everyone"
+	// channelPrivate is the rule channel that matches private messages to the bot
+	channelPrivate         = "private"
+	defaultPermissionsFile = "permissions.json"
+	userLookupTimeout      = 5 * time.Second
+	// userLookupTTL is how long the account and oper status found with WHO are trusted
+	userLookupTTL = time.Minute
+	// whoxToken tags our WHOX queries so their replies can be told apart from anyone else's
+	whoxToken = "616"
+)
+
+type permissionsConfig struct {
+	// File is where roles granted at runtime are saved
+	File  string                `toml:"file"`
+	Roles map[string]roleConfig `toml:"roles"`
+	Rules []aclRule             `toml:"rules"`
+}
+
+// roleConfig describes who holds a role. Anyone matching any of the hostmasks or accounts, or any IRC operator if
+// Opers is set, holds it.
+type roleConfig struct {
+	Hostmasks []string `toml:"hostmasks" json:"hostmasks,omitempty"`
+	Accounts  []string `toml:"accounts" json:"accounts,omitempty"`
+	Opers     bool     `toml:"opers" json:"opers,omitempty"`
+	// Networks limits the role to the named networks, as accounts and opers on one network mean nothing on another
+	Networks []string `toml:"networks" json:"networks,omitempty"`
+}
+
+// aclRule gives the listed roles access to a command in a channel. Command and Channel may be "*" or empty to
+// match anything, and Channel may be "private" for private messages. Networks limits the rule to messages from and
+// commands against the named networks. A channel only exists on one network, so a rule naming a channel and no
+// networks only covers commands against the network the message came from. The most specific matching rule wins.
+type aclRule struct {
+	Command  string   `toml:"command"`
+	Channel  string   `toml:"channel"`
+	Networks []string `toml:"networks"`
+	Roles    []string `toml:"roles"`
+}
+
+func defaultACLRules() []aclRule {
+	return []aclRule{
+		{Command: "*", Roles: []string{"admin"}},
+		{Command: "*", Channel: "#opers", Roles: []string{roleEveryone}},
+		{Command: "help", Roles: []string{roleEveryone}},
+		{Command: "more", Roles: []string{roleEveryone}},
+		{Command: "grant", Roles: []string{"admin"}},
+		{Command: "revoke", Roles: []string{"admin"}},
+	}
+}
+
+// matches checks whether the rule covers command sent in channel on network from, to be run against network to
+func (r aclRule) matches(command, channel, from, to string) bool {
+	if !isWildcard(r.Command) && r.Command != command {
+		return false
+	}
+
+	if !isWildcard(r.Channel) && !strings.EqualFold(r.Channel, channel) {
+		return false
+	}
+
+	if len(r.Networks) > 0 {
+		return stringSliceContains(from, r.Networks) && stringSliceContains(to, r.Networks)
+	}
+
+	return isWildcard(r.Channel) || from == to
+}
+
+// specificity ranks rules naming a command above rules naming a channel, and both above catch-all rules
+func (r aclRule) specificity() int {
+	out := 0
+	if !isWildcard(r.Command) {
+		out += 2
+	}
+
+	if !isWildcard(r.Channel) {
+		out++
+	}
+
+	return out
+}
+
+func isWildcard(s string) bool { return s == "" || s == "*" }
+
+// identity is what we know about the user behind a command
+type identity struct {
+	Hostmask string `json:"hostmask"`
+	Account  string `json:"account"`
+	Oper     bool   `json:"oper"`
+}
+
+// holds checks whether id holds the role on the given network
+func (r roleConfig) holds(network string, id identity) bool {
+	if len(r.Networks) > 0 && !stringSliceContains(network, r.Networks) {
+		return false
+	}
+
+	if r.Opers && id.Oper {
+		return true
+	}
+
+	for _, mask := range r.Hostmasks {
+		if ircGlobMatch(mask, id.Hostmask) {
+			return true
+		}
+	}
+
+	if id.Account == "" {
+		return false
+	}
+
+	for _, account := range r.Accounts {
+		if strings.EqualFold(account, id.Account) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// needsLookup reports whether the role could match on details only WHO can tell us
+func (r roleConfig) needsLookup() bool { return r.Opers || len(r.Accounts) > 0 }
+
+// permissions decides who may use which commands. Roles come from the config, plus grants made at runtime which
+// are saved to a file.
+type permissions struct {
+	rules []aclRule
+	file  string
+
+	mu         sync.Mutex
+	configured map[string]roleConfig
+	// granted maps network name to role to who was granted it there, as an account or hostmask on one network says
+	// nothing about who is behind it on another
+	granted map[string]map[string]roleConfig
+}
+
+func newPermissions(cfg permissionsConfig) (*permissions, error) {
+	p := &permissions{
+		rules:      cfg.Rules,
+		file:       cfg.File,
+		configured: cfg.Roles,
+		granted:    make(map[string]map[string]roleConfig),
+	}
+
+	if err := p.load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("could not load permissions from %q: %w", p.file, err)
+	}
+
+	return p, nil
+}
+
+func (p *permissions) load() error {
+	if p.file == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(p.file)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return json.Unmarshal(data, &p.granted)
+}
+
+func (p *permissions) save() error {
+	if p.file == "" {
+		return nil
+	}
+
+	p.mu.Lock()
+	data, err := json.MarshalIndent(p.granted, "", "\t")
+	p.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(p.file, data, 0o600)
+}
+
+// rolesFor returns the roles allowed to use command in channel on network from against network to. channel is
+// empty for private messages. nil means nobody may.
+func (p *permissions) rolesFor(command, channel, from, to string) []string {
+	if channel == "" {
+		channel = channelPrivate
+	}
+
+	var best *aclRule
+	for i, rule := range p.rules {
+		if rule.matches(command, channel, from, to) && (best == nil || rule.specificity() > best.specificity()) {
+			best = &p.rules[i]
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+
+	return best.Roles
+}
+
+// role returns how a role is configured and who was granted it at runtime on network
+func (p *permissions) role(network, name string) (configured, granted roleConfig, exists bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	configured, inConfig := p.configured[name]
+	granted, inGrants := p.granted[network][name]
+
+	return configured, granted, inConfig || inGrants
+}
+
+// roleNames returns the name of every known role, sorted
+func (p *permissions) roleNames() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	out := []string{roleEveryone}
+	for name := range p.configured {
+		out = append(out, name)
+	}
+
+	seen := make(map[string]bool)
+	for _, roles := range p.granted {
+		for name := range roles {
+			if _, exists := p.configured[name]; !exists && !seen[name] {
+				seen[name] = true
+				out = append(out, name)
+			}
+		}
+	}
+
+	sort.Strings(out)
+	return out
+}
+
+// matchingRoles returns which of roles id holds on network
+func (p *permissions) matchingRoles(network string, roles []string, id identity) []string {
+	out := []string{}
+	for _, name := range roles {
+		if name == roleEveryone {
+			out = append(out, name)
+			continue
+		}
+
+		configured, granted, _ := p.role(network, name)
+		if configured.holds(network, id) || granted.holds(network, id) {
+			out = append(out, name)
+		}
+	}
+
+	return out
+}
+
+// anyNeedsLookup reports whether any of roles could match once WHO has told us more about the user
+func (p *permissions) anyNeedsLookup(network string, roles []string) bool {
+	for _, name := range roles {
+		configured, granted, _ := p.role(network, name)
+		if granted.needsLookup() {
+			return true
+		}
+
+		if configured.needsLookup() && (len(configured.Networks) == 0 || stringSliceContains(network, configured.Networks)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// grant adds who to a role on network. who is a nick!user@host mask, or a services account name.
+func (p *permissions) grant(network, role, who string) error {
+	if role == roleEveryone {
+		return fmt.Errorf("%q cannot be granted", roleEveryone)
+	}
+
+	p.mu.Lock()
+	if p.granted[network] == nil {
+		p.granted[network] = make(map[string]roleConfig)
+	}
+
+	r := p.granted[network][role]
+	list := &r.Accounts
+	if isHostmask(who) {
+		list = &r.Hostmasks
+	}
+
+	for _, v := range *list {
+		if strings.EqualFold(v, who) {
+			p.mu.Unlock()
+			return fmt.Errorf("%s already has %s on %s", who, role, network)
+		}
+	}
+
+	*list = append(*list, who)
+	p.granted[network][role] = r
+	p.mu.Unlock()
+
+	return p.save()
+}
+
+// revoke removes who from a role on network. Only runtime grants can be revoked, the config file is left alone.
+func (p *permissions) revoke(network, role, who string) error {
+	p.mu.Lock()
+	r, exists := p.granted[network][role]
+	list := &r.Accounts
+	if isHostmask(who) {
+		list = &r.Hostmasks
+	}
+
+	out := []string{}
+	for _, v := range *list {
+		if !strings.EqualFold(v, who) {
+			out = append(out, v)
+		}
+	}
+
+	if !exists || len(out) == len(*list) {
+		p.mu.Unlock()
+		return fmt.Errorf(
+			"%s was not granted %s on %s at runtime (roles in the config file must be changed there)", who, role, network,
+		)
+	}
+
+	*list = out
+	switch {
+	case len(r.Accounts) > 0 || len(r.Hostmasks) > 0:
+		p.granted[network][role] = r
+	case len(p.granted[network]) > 1:
+		delete(p.granted[network], role)
+	default:
+		delete(p.granted, network)
+	}
+
+	p.mu.Unlock()
+
+	return p.save()
+}
+
+func isHostmask(s string) bool { return strings.ContainsAny(s, "!@") }
+
+// ircGlobMatch matches s against an IRC style mask, where * matches any run of characters and ? any single one.
+// Matching is case insensitive.
+func ircGlobMatch(mask, s string) bool {
+	mask, s = strings.ToLower(mask), strings.ToLower(s)
+	// Index of the last * seen in mask, and the position in s it was tried at
+	star, starS := -1, 0
+	m, i := 0, 0
+	for i < len(s) {
+		switch {
+		// * comes first, as s may have a literal * where the mask has one
+		case m < len(mask) && mask[m] == '*':
+			star, starS = m, i
+			m++
+		case m < len(mask) && (mask[m] == '?' || mask[m] == s[i]):
+			m++
+			i++
+		case star != -1:
+			starS++
+			m, i = star+1, starS
+		default:
+			return false
+		}
+	}
+
+	for m < len(mask) && mask[m] == '*' {
+		m++
+	}
+
+	return m == len(mask)
+}
+
+// identify works out who sent e. Only the hostmask and any IRCv3 account tag are filled in.
+func identify(e *irc.Event) identity {
+	return identity{Hostmask: e.Source, Account: e.Tags["account"]}
+}
+
+// authorize checks whether the sender of e may use command on n. WHO may be sent, so this must not be called
+// from a callback directly.
+func (b *bot) authorize(n, target *network, e *irc.Event, command string) bool {
+	roles := b.perms.rolesFor(command, eventChannel(e), n.name, target.name)
+	if len(roles) == 0 {
+		return false
+	}
+
+	id := identify(e)
+	if len(b.perms.matchingRoles(n.name, roles, id)) > 0 {
+		return true
+	}
+
+	if !b.perms.anyNeedsLookup(n.name, roles) {
+		return false
+	}
+
+	id, err := n.lookupUser(e.Nick, id)
+	if err != nil {
+		n.ircCon.Log.Printf("Could not look up %s: %s", e.Nick, err)
+		return false
+	}
+
+	return len(b.perms.matchingRoles(n.name, roles, id)) > 0
+}
+
+// eventChannel returns the channel e was sent to, or an empty string for private messages
+func eventChannel(e *irc.Event) string {
+	if len(e.Arguments) == 0 || strings.EqualFold(e.Arguments[0], e.Connection.GetNick()) {
+		return ""
+	}
+
+	return e.Arguments[0]
+}
+
+type userLookup struct {
+	account string
+	oper    bool
+	updated time.Time
+}
+
+// lookupUser fills in the account and oper status of nick using WHOX, or plain WHO if the server lacks WHOX, in
+// which case only oper status is found. Results are cached for userLookupTTL. Once the server sends account-tag, the
+// account on the message is the only one trusted, as a cached one may belong to whoever held the nick before.
+func (n *network) lookupUser(nick string, id identity) (identity, error) {
+	key := strings.ToLower(nick)
+	n.userLookupMutex.Lock()
+	cached, exists := n.userLookups[key]
+	accountTags := n.accountTags
+	n.userLookupMutex.Unlock()
+
+	if !exists || time.Since(cached.updated) > userLookupTTL {
+		res, err := n.who(nick)
+		if err != nil {
+			return id, err
+		}
+
+		cached = res
+		n.userLookupMutex.Lock()
+		n.userLookups[key] = cached
+		n.userLookupMutex.Unlock()
+	}
+
+	// A tag sent with the message is newer than anything we have cached
+	if id.Account == "" && !accountTags {
+		id.Account = cached.account
+	}
+
+	id.Oper = cached.oper
+	return id, nil
+}
+
+func (n *network) who(nick string) (userLookup, error) {
+	var (
+		mu  sync.Mutex
+		res = userLookup{}
+	)
+
+	done := make(chan struct{})
+	var once sync.Once
+
+	callbacks := []irc.CallbackID{}
+	addCallback := func(code string, cb func(*irc.Event)) {
+		callbacks = append(callbacks, irc.CallbackID{EventCode: code, ID: n.ircCon.AddCallback(code, cb)})
+	}
+
+	defer func() {
+		for _, cb := range callbacks {
+			n.ircCon.RemoveCallback(cb.EventCode, cb.ID)
+		}
+	}()
+
+	// :server 354 me <token> <nick> <flags> <account>
+	addCallback(RPL_WHOSPCRPL, func(e *irc.Event) {
+		if len(e.Arguments) < 5 || e.Arguments[1] != whoxToken || !strings.EqualFold(e.Arguments[2], nick) {
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		res.oper = strings.Contains(e.Arguments[3], "*")
+		if e.Arguments[4] != "0" {
+			res.account = e.Arguments[4]
+		}
+	})
+
+	// :server 352 me <channel> <user> <host> <server> <nick> <flags> :<hops> <realname>
+	addCallback(RPL_WHOREPLY, func(e *irc.Event) {
+		if len(e.Arguments) < 7 || !strings.EqualFold(e.Arguments[5], nick) {
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		res.oper = strings.Contains(e.Arguments[6], "*")
+	})
+
+	addCallback(RPL_ENDOFWHO, func(e *irc.Event) {
+		if len(e.Arguments) > 1 && strings.EqualFold(e.Arguments[1], nick) {
+			once.Do(func() { close(done) })
+		}
+	})
+
+	n.ircCon.SendRawf("WHO %s %%tnfa,%s", nick, whoxToken)
+
+	select {
+	case <-done:
+	case <-time.After(userLookupTimeout):
+		return userLookup{}, errors.New("timed out waiting for WHO")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	res.updated = time.Now()
+	return res, nil
+}
+
+// forgetUser drops anything cached about nick, for when they change nick, log in or out, or leave
+func (n *network) forgetUser(nick string) {
+	n.userLookupMutex.Lock()
+	defer n.userLookupMutex.Unlock()
+
+	delete(n.userLookups, strings.ToLower(nick))
+}
+
+// resetUsers forgets every user and which capabilities the server agreed to, for a new connection
+func (n *network) resetUsers() {
+	n.userLookupMutex.Lock()
+	defer n.userLookupMutex.Unlock()
+
+	n.userLookups = make(map[string]userLookup)
+	n.accountTags = false
+}
+
+func (n *network) setAccountTags() {
+	n.userLookupMutex.Lock()
+	defer n.userLookupMutex.Unlock()
+
+	n.accountTags = true
+}
+
+type grantResult struct {
+	Role    string `json:"role"`
+	Who     string `json:"who"`
+	Network string `json:"network"`
+}
+
+func (b *bot) grant(n *network, _ *irc.Event, args *commandArgs) *commandResult {
+	role, who := args.str("role"), args.str("who")
+	if err := b.perms.grant(n.name, role, who); err != nil {
+		return errorResult(err)
+	}
+
+	return resultf(grantResult{role, who, n.name}, "Granted %s to %s on %s", role, who, n.name)
+}
+
+func (b *bot) revoke(n *network, _ *irc.Event, args *commandArgs) *commandResult {
+	role, who := args.str("role"), args.str("who")
+	if err := b.perms.revoke(n.name, role, who); err != nil {
+		return errorResult(err)
+	}
+
+	return resultf(grantResult{role, who, n.name}, "Revoked %s from %s on %s", role, who, n.name)
+}
+
+type roleResult struct {
+	roleConfig
+	Network string     `json:"network"`
+	Granted roleConfig `json:"granted"`
+}
+
+func (b *bot) listRoles(n *network, _ *irc.Event, args *commandArgs) *commandResult {
+	if !args.has("role") {
+		names := b.perms.roleNames()
+		return resultf(names, "Roles: %s", strings.Join(names, ", "))
+	}
+
+	name := args.str("role")
+	r, granted, exists := b.perms.role(n.name, name)
+	if !exists {
+		return errorf("unknown role %q", name)
+	}
+
+	parts := []string{}
+	if len(r.Hostmasks) > 0 {
+		parts = append(parts, "hostmasks: "+strings.Join(r.Hostmasks, ", "))
+	}
+
+	if len(r.Accounts) > 0 {
+		parts = append(parts, "accounts: "+strings.Join(r.Accounts, ", "))
+	}
+
+	if r.Opers {
+		parts = append(parts, "all opers")
+	}
+
+	if len(r.Networks) > 0 {
+		parts = append(parts, "on "+strings.Join(r.Networks, ", "))
+	}
+
+	if who := append(append([]string(nil), granted.Hostmasks...), granted.Accounts...); len(who) > 0 {
+		parts = append(parts, fmt.Sprintf("granted on %s: %s", n.name, strings.Join(who, ", ")))
+	}
+
+	if len(parts) == 0 {
+		parts = append(parts, "nobody")
+	}
+
+	return resultf(roleResult{r, n.name, granted}, "%s: %s", name, strings.Join(parts, "; "))
+}
+
+func (b *bot) whoami(n *network, e *irc.Event, _ *commandArgs) *commandResult {
+	if e == nil {
+		return errorf("whoami only works on IRC")
+	}
+
+	id, err := n.lookupUser(e.Nick, identify(e))
+	if err != nil {
+		return errorResult(err)
+	}
+
+	account := id.Account
+	if account == "" {
+		account = "none"
+	}
+
+	roles := b.perms.matchingRoles(n.name, b.perms.roleNames(), id)
+	return resultf(struct {
+		identity
+		Roles []string `json:"roles"`
+	}{id, roles}, "%s: account %s, oper %t, roles: %s", id.Hostmask, account, id.Oper, strings.Join(roles, ", "))
+}
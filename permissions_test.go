@@ -0,0 +1,151 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestRuleNetworks(t *testing.T) {
+	p, err := newPermissions(permissionsConfig{Rules: []aclRule{
+		{Command: "*", Roles: []string{"admin"}},
+		{Command: "*", Channel: "#opers", Roles: []string{roleEveryone}},
+		{Command: "count", Channel: "#staff", Networks: []string{"a", "b"}, Roles: []string{"staff"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		command, channel, from, to string
+		want                       string
+	}{
+		{"count", "#opers", "a", "a", roleEveryone},
+		{"count", "#opers", "a", "b", "admin"},
+		{"count", "#staff", "a", "b", "staff"},
+		{"count", "#staff", "a", "c", "admin"},
+		{"count", "#staff", "c", "c", "admin"},
+	}
+
+	for _, tt := range tests {
+		roles := p.rolesFor(tt.command, tt.channel, tt.from, tt.to)
+		if len(roles) != 1 || roles[0] != tt.want {
+			t.Errorf("%s in %s on %s against %s: got %v, want [%s]", tt.command, tt.channel, tt.from, tt.to, roles, tt.want)
+		}
+	}
+}
+
+func TestGrantNetworks(t *testing.T) {
+	cfg := permissionsConfig{
+		File:  filepath.Join(t.TempDir(), "permissions.json"),
+		Roles: map[string]roleConfig{"staff": {Accounts: []string{"carol"}, Networks: []string{"b"}}},
+	}
+
+	p, err := newPermissions(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.grant("a", "admin", "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.grant("a", "staff", "bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reload from the file to check grants keep their network
+	if p, err = newPermissions(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		network, account, role string
+		want                   bool
+	}{
+		{"a", "alice", "admin", true},
+		{"b", "alice", "admin", false},
+		{"a", "bob", "staff", true},
+		{"b", "bob", "staff", false},
+		{"a", "carol", "staff", false},
+		{"b", "carol", "staff", true},
+	}
+
+	for _, tt := range tests {
+		got := len(p.matchingRoles(tt.network, []string{tt.role}, identity{Account: tt.account})) == 1
+		if got != tt.want {
+			t.Errorf("%s holds %s on %s: got %v, want %v", tt.account, tt.role, tt.network, got, tt.want)
+		}
+	}
+
+	if err := p.revoke("b", "admin", "alice"); err == nil {
+		t.Error("revoking a grant made on another network succeeded")
+	}
+
+	if err := p.revoke("a", "admin", "alice"); err != nil {
+		t.Error(err)
+	}
+
+	if len(p.matchingRoles("a", []string{"admin"}, identity{Account: "alice"})) != 0 {
+		t.Error("alice still holds admin after revoke")
+	}
+}
+
+func TestIRCGlobMatch(t *testing.T) {
+	tests := []struct {
+		mask, s string
+		want    bool
+	}{
+		{"*", "", true},
+		{"*", "*x", true},
+		{"a*", "a*b", true},
+		{"*!*@host", "n!*u@host", true},
+		{"*!*@*.example.net", "Nick!user@staff.EXAMPLE.net", true},
+		{"*!*@*.example.net", "nick!user@example.net", false},
+		{"nick!?ser@host", "nick!user@host", true},
+		{"nick!?ser@host", "nick!ser@host", false},
+		{"a*b*c", "aXXbYYc", true},
+		{"a*b*c", "aXXbYY", false},
+		{"**", "anything", true},
+		{"", "", true},
+		{"", "x", false},
+	}
+
+	for _, tt := range tests {
+		if got := ircGlobMatch(tt.mask, tt.s); got != tt.want {
+			t.Errorf("ircGlobMatch(%q, %q) = %v, want %v", tt.mask, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestServerFilter(t *testing.T) {
+	srv := &Server{Name: "leaf1.test.net", Description: "Leaf *one* [EU]"}
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{"leaf*", true},
+		{"*.test.net", true},
+		{"LEAF?.test.net", true},
+		{"hub*", false},
+		{"!hub*", true},
+		{"!leaf*", false},
+		{"desc:*one*", true},
+		{"desc:*[eu]", true},
+		{"!desc:*[US]", true},
+	}
+
+	for _, tt := range tests {
+		f, err := parseServerFilter(tt.filter)
+		if err != nil {
+			t.Fatalf("%q: %s", tt.filter, err)
+		}
+
+		if got := f.match(srv); got != tt.want {
+			t.Errorf("%q on %s: got %v, want %v", tt.filter, srv.Name, got, tt.want)
+		}
+	}
+
+	if _, err := parseServerFilter("!desc:"); err == nil {
+		t.Error("an empty filter was accepted")
+	}
+}
@@ -0,0 +1,644 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	irc "github.com/thoj/go-ircevent"
+)
+
+const (
+	defaultPresenceFile = "presence.json"
+	// presenceSaveInterval is how often presence is saved when nothing but the time last seen has changed
+	presenceSaveInterval = 10 * time.Minute
+	defaultUptimeWindow  = 7 * 24 * time.Hour
+	defaultSLATarget     = 99.9
+	defaultFlappersTop   = 5
+)
+
+type presenceConfig struct {
+	// File is where presence is saved so it survives restarts. Empty keeps it in memory only.
+	File string `toml:"file"`
+	// MaxGap is the longest time between two refreshes that still counts as watching the network. Longer gaps,
+	// such as while the bot was down, count as neither up nor down. 0 means three refresh intervals.
+	MaxGap time.Duration `toml:"max_gap"`
+}
+
+// presenceSpan is a stretch of time, both ends included
+type presenceSpan struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// overlap returns how much of the spans falls between from and to
+func overlap(spans []presenceSpan, from, to time.Time) time.Duration {
+	var out time.Duration
+	for _, s := range spans {
+		start, end := s.From, s.To
+		if start.Before(from) {
+			start = from
+		}
+
+		if end.After(to) {
+			end = to
+		}
+
+		if end.After(start) {
+			out += end.Sub(start)
+		}
+	}
+
+	return out
+}
+
+// presence is when a server or link was seen. Up holds the stretches it was in every refresh, oldest first.
+type presence struct {
+	FirstSeen time.Time      `json:"first_seen"`
+	LastSeen  time.Time      `json:"last_seen"`
+	Up        []presenceSpan `json:"up"`
+}
+
+// seen marks it as present at t. If it was also present at the refresh before, last, and nothing was missed in
+// between, its current stretch is extended, otherwise a new one starts and seen returns true.
+func (p *presence) seen(t, last time.Time, continuous bool) bool {
+	if p.FirstSeen.IsZero() {
+		p.FirstSeen = t
+	}
+
+	p.LastSeen = t
+	if continuous && len(p.Up) > 0 && p.Up[len(p.Up)-1].To.Equal(last) {
+		p.Up[len(p.Up)-1].To = t
+		return false
+	}
+
+	p.Up = append(p.Up, presenceSpan{From: t, To: t})
+	return true
+}
+
+// uptime returns the percentage of the time between from and to that the bot was watching and it was present.
+// Time before it was first seen does not count. ok is false if the bot was not watching at all.
+func (p *presence) uptime(watched []presenceSpan, from, to time.Time) (pct float64, ok bool) {
+	if p.FirstSeen.After(from) {
+		from = p.FirstSeen
+	}
+
+	total := overlap(watched, from, to)
+	if total <= 0 {
+		return 0, false
+	}
+
+	return 100 * float64(overlap(p.Up, from, to)) / float64(total), true
+}
+
+// flaps returns how many times it came back after dropping out while the bot was watching, since from
+func (p *presence) flaps(watched []presenceSpan, from time.Time) int {
+	starts := make(map[int64]bool, len(watched))
+	for _, w := range watched {
+		starts[w.From.UnixNano()] = true
+	}
+
+	out := 0
+	for i, s := range p.Up {
+		// A stretch that starts when the bot started watching is not a return
+		if i > 0 && !s.From.Before(from) && !starts[s.From.UnixNano()] {
+			out++
+		}
+	}
+
+	return out
+}
+
+// expire drops stretches that ended before cutoff
+func (p *presence) expire(cutoff time.Time) {
+	i := sort.Search(len(p.Up), func(i int) bool { return !p.Up[i].To.Before(cutoff) })
+	p.Up = p.Up[i:]
+}
+
+type serverPresence struct {
+	Name string `json:"name"`
+	ID   string `json:"id,omitempty"`
+	presence
+}
+
+type linkPresence struct {
+	// Servers are the names at either end, as last seen
+	Servers [2]string `json:"servers"`
+	presence
+}
+
+func (l *linkPresence) String() string {
+	return l.Servers[0] + " <-> " + l.Servers[1]
+}
+
+// networkPresence is everything known about when one network's servers and links were present
+type networkPresence struct {
+	// Watched holds the stretches the bot was refreshing the network, oldest first
+	Watched []presenceSpan `json:"watched"`
+	// Source is where the last graph came from. A different source starts a new stretch, as sources rarely agree.
+	Source string `json:"source"`
+	// Servers are keyed by ID, or by lowercased name for servers without one
+	Servers map[string]*serverPresence `json:"servers"`
+	// Links are keyed by the keys of the servers at either end, sorted and joined with a space
+	Links map[string]*linkPresence `json:"links"`
+
+	// names maps lowercased names to server keys
+	names map[string]string
+}
+
+func newNetworkPresence() *networkPresence {
+	return &networkPresence{
+		Servers: make(map[string]*serverPresence),
+		Links:   make(map[string]*linkPresence),
+		names:   make(map[string]string),
+	}
+}
+
+func (np *networkPresence) index() {
+	np.names = make(map[string]string, len(np.Servers))
+	for key, srv := range np.Servers {
+		np.names[strings.ToLower(srv.Name)] = key
+	}
+}
+
+// serverKey returns the key srv is tracked under. Servers are tracked by ID, falling back to their name when they
+// have none, so a server that gains an ID keeps its history, and so does one that is renamed. The resolver's fake
+// IDs are only stand-ins for a name, so they count as none.
+func (np *networkPresence) serverKey(srv *Server) string {
+	lower := strings.ToLower(srv.Name)
+	byName, known := np.names[lower]
+	id := presenceID(srv)
+	if id == "" {
+		if known {
+			return byName
+		}
+
+		return "name:" + lower
+	}
+
+	// Older files may still have servers under a fake ID
+	key := "id:" + id
+	byNameOnly := strings.HasPrefix(byName, "name:") || strings.HasPrefix(byName, "id:"+fakeIDPrefix)
+	if _, exists := np.Servers[key]; !exists && known && byNameOnly {
+		np.rekey(byName, key)
+	}
+
+	return key
+}
+
+// presenceID returns the ID of srv, or an empty string if it has none or only a fake one
+func presenceID(srv *Server) string {
+	if strings.HasPrefix(srv.ID, fakeIDPrefix) {
+		return ""
+	}
+
+	return srv.ID
+}
+
+// rekey moves the server tracked under old, and its links, to key
+func (np *networkPresence) rekey(old, key string) {
+	np.Servers[key] = np.Servers[old]
+	delete(np.Servers, old)
+
+	for linkKey, l := range np.Links {
+		ends := strings.Split(linkKey, " ")
+		if len(ends) != 2 || (ends[0] != old && ends[1] != old) {
+			continue
+		}
+
+		for i := range ends {
+			if ends[i] == old {
+				ends[i] = key
+			}
+		}
+
+		delete(np.Links, linkKey)
+		np.Links[presenceLinkKey(ends[0], ends[1])] = l
+	}
+}
+
+func presenceLinkKey(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+
+	return a + " " + b
+}
+
+// lookup finds a server by name or ID
+func (np *networkPresence) lookup(nameOrID string) *serverPresence {
+	if key, exists := np.names[strings.ToLower(nameOrID)]; exists {
+		return np.Servers[key]
+	}
+
+	return np.Servers["id:"+nameOrID]
+}
+
+// expire drops everything last seen before cutoff
+func (np *networkPresence) expire(cutoff time.Time) {
+	i := sort.Search(len(np.Watched), func(i int) bool { return !np.Watched[i].To.Before(cutoff) })
+	np.Watched = np.Watched[i:]
+
+	for key, srv := range np.Servers {
+		srv.expire(cutoff)
+		if srv.LastSeen.Before(cutoff) {
+			delete(np.Servers, key)
+			delete(np.names, strings.ToLower(srv.Name))
+		}
+	}
+
+	for key, l := range np.Links {
+		l.expire(cutoff)
+		if l.LastSeen.Before(cutoff) {
+			delete(np.Links, key)
+		}
+	}
+}
+
+// presenceStore tracks when every server and link was present, for uptime and flapping. It is fed from snapshots,
+// so it is only as fine grained as the refresh interval.
+type presenceStore struct {
+	cfg       presenceConfig
+	retention time.Duration
+
+	mu       sync.Mutex
+	networks map[string]*networkPresence
+	lastSave time.Time
+}
+
+func newPresenceStore(cfg presenceConfig, retention time.Duration) (*presenceStore, error) {
+	s := &presenceStore{cfg: cfg, retention: retention, networks: make(map[string]*networkPresence)}
+	if err := s.load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("could not load presence from %q: %w", cfg.File, err)
+	}
+
+	return s, nil
+}
+
+func (s *presenceStore) load() error {
+	if s.cfg.File == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(s.cfg.File)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := json.Unmarshal(data, &s.networks); err != nil {
+		return err
+	}
+
+	for name, np := range s.networks {
+		if np == nil {
+			np = newNetworkPresence()
+			s.networks[name] = np
+		}
+
+		if np.Servers == nil {
+			np.Servers = make(map[string]*serverPresence)
+		}
+
+		if np.Links == nil {
+			np.Links = make(map[string]*linkPresence)
+		}
+
+		np.index()
+	}
+
+	return nil
+}
+
+// save writes everything to the file. s.mu must be held.
+func (s *presenceStore) save() error {
+	s.lastSave = time.Now()
+	if s.cfg.File == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(s.networks)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(s.cfg.File, data, 0o600)
+}
+
+// network returns what is known about the named network. s.mu must be held.
+func (s *presenceStore) network(name string) *networkPresence {
+	np, exists := s.networks[name]
+	if !exists {
+		np = newNetworkPresence()
+		s.networks[name] = np
+	}
+
+	return np
+}
+
+// record marks every server and link in cur as present
+func (s *presenceStore) record(network string, cur *snapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	np := s.network(network)
+	var last time.Time
+	if len(np.Watched) > 0 {
+		last = np.Watched[len(np.Watched)-1].To
+		if !cur.Taken.After(last) {
+			return
+		}
+	}
+
+	continuous := !last.IsZero() && np.Source == cur.Source && cur.Taken.Sub(last) <= s.cfg.MaxGap
+	changed := !continuous
+	if continuous {
+		np.Watched[len(np.Watched)-1].To = cur.Taken
+	} else {
+		np.Watched = append(np.Watched, presenceSpan{From: cur.Taken, To: cur.Taken})
+	}
+
+	np.Source = cur.Source
+
+	keys := make(map[string]string, len(cur.graph))
+	for _, srv := range cur.graph {
+		key := np.serverKey(srv)
+		keys[strings.ToLower(srv.Name)] = key
+
+		sp, exists := np.Servers[key]
+		if !exists {
+			sp = &serverPresence{}
+			np.Servers[key] = sp
+		}
+
+		if sp.Name != srv.Name {
+			delete(np.names, strings.ToLower(sp.Name))
+			sp.Name = srv.Name
+			changed = true
+		}
+
+		if id := presenceID(srv); id != "" {
+			sp.ID = id
+		}
+
+		np.names[strings.ToLower(srv.Name)] = key
+		if sp.seen(cur.Taken, last, continuous) {
+			changed = true
+		}
+	}
+
+	byName := cur.graph.byName()
+	for link := range cur.graph.links() {
+		key := presenceLinkKey(keys[link[0]], keys[link[1]])
+		lp, exists := np.Links[key]
+		if !exists {
+			lp = &linkPresence{}
+			np.Links[key] = lp
+		}
+
+		lp.Servers = [2]string{byName[link[0]].Name, byName[link[1]].Name}
+		if lp.seen(cur.Taken, last, continuous) {
+			changed = true
+		}
+	}
+
+	if !changed && time.Since(s.lastSave) < presenceSaveInterval {
+		return
+	}
+
+	np.expire(cur.Taken.Add(-s.retention))
+	if err := s.save(); err != nil {
+		log.Printf("Presence: could not save to %s: %s", s.cfg.File, err)
+	}
+}
+
+// presenceHook returns the snapshot hook that records which of n's servers and links are present
+func (b *bot) presenceHook(n *network) snapshotHook {
+	return func(_, cur *snapshot) { b.presence.record(n.name, cur) }
+}
+
+type serverUptime struct {
+	Name      string    `json:"name"`
+	ID        string    `json:"id,omitempty"`
+	Window    string    `json:"window"`
+	Uptime    *float64  `json:"uptime"`
+	Flaps     int       `json:"flaps"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Present   bool      `json:"present"`
+}
+
+// uptime shows how much of a window a server was present, and when it was first and last seen
+func (b *bot) uptime(n *network, _ *irc.Event, args *commandArgs) *commandResult {
+	window := args.duration("window", defaultUptimeWindow)
+	if window <= 0 {
+		return errorf("window must be positive")
+	}
+
+	b.presence.mu.Lock()
+	defer b.presence.mu.Unlock()
+
+	np := b.presence.network(n.name)
+	srv := np.lookup(args.str("server"))
+	if srv == nil {
+		return errorf("%s has not been seen on %s", args.str("server"), n.name)
+	}
+
+	now := time.Now()
+	from := now.Add(-window)
+	out := serverUptime{
+		Name: srv.Name, ID: srv.ID, Window: formatDuration(window), Flaps: srv.flaps(np.Watched, from),
+		FirstSeen: srv.FirstSeen, LastSeen: srv.LastSeen,
+		Present: len(np.Watched) > 0 && srv.LastSeen.Equal(np.Watched[len(np.Watched)-1].To),
+	}
+
+	upText := "unknown, as I was not watching"
+	if pct, ok := srv.uptime(np.Watched, from, now); ok {
+		out.Uptime = &pct
+		upText = formatPercent(pct)
+	}
+
+	lastSeen := srv.LastSeen.Local().Format(reportTimeFormat)
+	if out.Present {
+		lastSeen = "now"
+	}
+
+	return resultf(out,
+		"%s (%s) over the last %s: up %s, %d flaps. First seen %s, last seen %s",
+		srv.Name, orNone(srv.ID), out.Window, upText, out.Flaps, srv.FirstSeen.Local().Format(reportTimeFormat), lastSeen,
+	)
+}
+
+func formatPercent(pct float64) string {
+	if pct >= 99.995 && pct < 100 {
+		// Do not round a little downtime away
+		return "99.99%"
+	}
+
+	return fmt.Sprintf("%.2f%%", pct)
+}
+
+type flapCount struct {
+	Name  string `json:"name"`
+	Flaps int    `json:"flaps"`
+}
+
+type flappersResult struct {
+	Window  string      `json:"window"`
+	Servers []flapCount `json:"servers"`
+	Links   []flapCount `json:"links"`
+}
+
+func sortFlaps(counts []flapCount, top int) []flapCount {
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Flaps != counts[j].Flaps {
+			return counts[i].Flaps > counts[j].Flaps
+		}
+
+		return counts[i].Name < counts[j].Name
+	})
+
+	if top < 0 {
+		top = 0
+	}
+
+	if len(counts) > top {
+		counts = counts[:top]
+	}
+
+	return counts
+}
+
+func (f flapCount) String() string {
+	return fmt.Sprintf("%s (%d)", f.Name, f.Flaps)
+}
+
+// flappers lists the servers and links that dropped out and came back most often
+func (b *bot) flappers(n *network, _ *irc.Event, args *commandArgs) *commandResult {
+	window := args.duration("window", defaultUptimeWindow)
+	if window <= 0 {
+		return errorf("window must be positive")
+	}
+
+	top := args.int("top", defaultFlappersTop)
+	from := time.Now().Add(-window)
+
+	b.presence.mu.Lock()
+	np := b.presence.network(n.name)
+	out := flappersResult{Window: formatDuration(window), Servers: []flapCount{}, Links: []flapCount{}}
+	for _, srv := range np.Servers {
+		if flaps := srv.flaps(np.Watched, from); flaps > 0 {
+			out.Servers = append(out.Servers, flapCount{Name: srv.Name, Flaps: flaps})
+		}
+	}
+
+	for _, l := range np.Links {
+		if flaps := l.flaps(np.Watched, from); flaps > 0 {
+			out.Links = append(out.Links, flapCount{Name: l.String(), Flaps: flaps})
+		}
+	}
+
+	b.presence.mu.Unlock()
+
+	out.Servers = sortFlaps(out.Servers, top)
+	out.Links = sortFlaps(out.Links, top)
+
+	servers, links := []string{}, []string{}
+	for _, f := range out.Servers {
+		servers = append(servers, f.String())
+	}
+
+	for _, f := range out.Links {
+		links = append(links, f.String())
+	}
+
+	return newResult(out,
+		fmt.Sprintf("Most flapping servers on %s over the last %s: %s", n.name, out.Window, listOrNone(servers)),
+		fmt.Sprintf("Most flapping links: %s", listOrNone(links)),
+	)
+}
+
+type linkSLA struct {
+	Link   [2]string `json:"link"`
+	Uptime float64   `json:"uptime"`
+	Flaps  int       `json:"flaps"`
+}
+
+type slaResult struct {
+	Window string  `json:"window"`
+	Target float64 `json:"target"`
+	Links  int     `json:"links"`
+	// Below are the links under the target, worst first
+	Below []linkSLA `json:"below"`
+}
+
+// sla reports the links whose uptime over a window is below a target
+func (b *bot) sla(n *network, _ *irc.Event, args *commandArgs) *commandResult {
+	window := args.duration("window", defaultUptimeWindow)
+	if window <= 0 {
+		return errorf("window must be positive")
+	}
+
+	target := defaultSLATarget
+	if args.has("target") {
+		v, err := strconv.ParseFloat(args.str("target"), 64)
+		if err != nil || v <= 0 || v > 100 {
+			return errorf("target must be a percentage above 0, not %q", args.str("target"))
+		}
+
+		target = v
+	}
+
+	now := time.Now()
+	from := now.Add(-window)
+	out := slaResult{Window: formatDuration(window), Target: target, Below: []linkSLA{}}
+
+	b.presence.mu.Lock()
+	np := b.presence.network(n.name)
+	for _, l := range np.Links {
+		pct, ok := l.uptime(np.Watched, from, now)
+		if !ok || l.LastSeen.Before(from) {
+			continue
+		}
+
+		out.Links++
+		if pct < target {
+			out.Below = append(out.Below, linkSLA{Link: l.Servers, Uptime: pct, Flaps: l.flaps(np.Watched, from)})
+		}
+	}
+
+	b.presence.mu.Unlock()
+
+	if out.Links == 0 {
+		return errorf("I have not watched %s in the last %s", n.name, out.Window)
+	}
+
+	sort.Slice(out.Below, func(i, j int) bool {
+		if out.Below[i].Uptime != out.Below[j].Uptime {
+			return out.Below[i].Uptime < out.Below[j].Uptime
+		}
+
+		return out.Below[i].Link[0]+" "+out.Below[i].Link[1] < out.Below[j].Link[0]+" "+out.Below[j].Link[1]
+	})
+
+	lines := []string{fmt.Sprintf(
+		"%d of %d links on %s were up less than %s of the last %s",
+		len(out.Below), out.Links, n.name, formatPercent(target), out.Window,
+	)}
+
+	for _, l := range out.Below {
+		lines = append(lines, fmt.Sprintf("%s <-> %s: %s, %d flaps", l.Link[0], l.Link[1], formatPercent(l.Uptime), l.Flaps))
+	}
+
+	return newResult(out, lines...)
+}
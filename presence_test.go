@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func presenceSnapshot(taken time.Time, hubID, leafID string) *snapshot {
+	hub := &Server{Name: "hub.test.net", ID: hubID}
+	leaf := &Server{Name: "leaf.test.net", ID: leafID}
+	hub.Peers, leaf.Peers = []*Server{leaf}, []*Server{hub}
+
+	return &snapshot{Taken: taken, Source: graphModeIRC, graph: graph{hubID: hub, leafID: leaf}}
+}
+
+func TestPresenceFakeIDs(t *testing.T) {
+	s, err := newPresenceStore(presenceConfig{MaxGap: time.Hour}, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// leaf is only known by a fake ID until GETID answers
+	start := time.Now().Add(-time.Hour)
+	s.record("test", presenceSnapshot(start, "001", fakeIDPrefix+"leaf.test.net"))
+	s.record("test", presenceSnapshot(start.Add(time.Minute), "001", "002"))
+
+	np := s.network("test")
+	if len(np.Servers) != 2 || len(np.Links) != 1 {
+		t.Fatalf("got %d servers and %d links, want 2 and 1: %v", len(np.Servers), len(np.Links), np.Servers)
+	}
+
+	leaf := np.Servers["id:002"]
+	if leaf == nil || leaf.ID != "002" || !leaf.FirstSeen.Equal(start) || len(leaf.Up) != 1 {
+		t.Errorf("leaf lost its history when its real ID arrived: %+v", leaf)
+	}
+
+	for key := range np.Links {
+		if key != "id:001 id:002" {
+			t.Errorf("link is tracked as %q", key)
+		}
+	}
+}
+
+func TestSortFlaps(t *testing.T) {
+	counts := []flapCount{{"a", 1}, {"b", 3}, {"c", 2}}
+	for top, want := range map[int]int{-1: 0, 0: 0, 2: 2, 10: 3} {
+		got := sortFlaps(append([]flapCount(nil), counts...), top)
+		if len(got) != want {
+			t.Errorf("top %d: got %d, want %d", top, len(got), want)
+		}
+
+		if len(got) > 0 && got[0].Name != "b" {
+			t.Errorf("top %d: %s is first, want b", top, got[0].Name)
+		}
+	}
+}
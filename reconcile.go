@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	sourceIRC  = "irc"
+	sourceJSON = "ioserv"
+	sourceBoth = "both"
+)
+
+// serverConflict is a pair of servers that were matched between the IRC and ioserv graphs, but disagree on
+// something
+type serverConflict struct {
+	IRC  *Server `json:"irc"`
+	JSON *Server `json:"ioserv"`
+}
+
+// reconcileReport lists every difference between the ioserv JSON graph and the graph built from LINKS and MAP
+type reconcileReport struct {
+	IRCCount  int `json:"irc_count"`
+	JSONCount int `json:"ioserv_count"`
+
+	OnlyInIRC  []*Server `json:"only_in_irc"`
+	OnlyInJSON []*Server `json:"only_in_ioserv"`
+
+	IDConflicts          []serverConflict `json:"id_conflicts"`   // same name, different ID
+	NameConflicts        []serverConflict `json:"name_conflicts"` // same ID, different name
+	DescriptionConflicts []serverConflict `json:"description_conflicts"`
+
+	LinksOnlyInIRC  [][2]string `json:"links_only_in_irc"`
+	LinksOnlyInJSON [][2]string `json:"links_only_in_ioserv"`
+}
+
+// linksHopCountRe matches the hop count that RPL_LINKS puts in front of server descriptions
+var linksHopCountRe = regexp.MustCompile(`^\d+\s`)
+
+// cleanDescription strips the RPL_LINKS hop count from a description, if present
+func cleanDescription(desc string) string {
+	return strings.TrimSpace(linksHopCountRe.ReplaceAllString(desc, ""))
+}
+
+// linkKey returns a stable key for the link between two servers, by name
+func linkKey(one, two *Server) [2]string {
+	a, b := strings.ToLower(one.Name), strings.ToLower(two.Name)
+	if a > b {
+		a, b = b, a
+	}
+
+	return [2]string{a, b}
+}
+
+// links returns every link in the graph, keyed by server name. The local server's link to itself in LINKS is
+// skipped.
+func (g graph) links() map[[2]string]bool {
+	out := make(map[[2]string]bool)
+	for _, srv := range g {
+		for _, peer := range srv.Peers {
+			if peer == srv {
+				continue
+			}
+
+			out[linkKey(srv, peer)] = true
+		}
+	}
+
+	return out
+}
+
+// byName indexes the graph by lowercased server name
+func (g graph) byName() map[string]*Server {
+	out := make(map[string]*Server, len(g))
+	for _, srv := range g {
+		out[strings.ToLower(srv.Name)] = srv
+	}
+
+	return out
+}
+
+// reconcileGraphs compares the graph built from IRC with the one from the ioserv JSON. Servers are matched by name.
+func reconcileGraphs(ircGraph, jsonGraph graph) *reconcileReport {
+	out := &reconcileReport{IRCCount: len(ircGraph), JSONCount: len(jsonGraph)}
+	ircNames, jsonNames := ircGraph.byName(), jsonGraph.byName()
+
+	for _, srv := range ircGraph.values() {
+		other, exists := jsonNames[strings.ToLower(srv.Name)]
+		if !exists {
+			if byID, idExists := jsonGraph[srv.ID]; idExists {
+				out.NameConflicts = append(out.NameConflicts, serverConflict{IRC: srv, JSON: byID})
+				continue
+			}
+
+			out.OnlyInIRC = append(out.OnlyInIRC, srv)
+			continue
+		}
+
+		if srv.ID != other.ID {
+			out.IDConflicts = append(out.IDConflicts, serverConflict{IRC: srv, JSON: other})
+		}
+
+		if cleanDescription(srv.Description) != cleanDescription(other.Description) {
+			out.DescriptionConflicts = append(out.DescriptionConflicts, serverConflict{IRC: srv, JSON: other})
+		}
+	}
+
+	for _, srv := range jsonGraph.values() {
+		if _, exists := ircNames[strings.ToLower(srv.Name)]; exists {
+			continue
+		}
+
+		if byID, idExists := ircGraph[srv.ID]; idExists && !strings.EqualFold(byID.Name, srv.Name) {
+			continue // already reported as a name conflict
+		}
+
+		out.OnlyInJSON = append(out.OnlyInJSON, srv)
+	}
+
+	ircLinks, jsonLinks := ircGraph.links(), jsonGraph.links()
+	for l := range ircLinks {
+		if !jsonLinks[l] {
+			out.LinksOnlyInIRC = append(out.LinksOnlyInIRC, l)
+		}
+	}
+
+	for l := range jsonLinks {
+		if !ircLinks[l] {
+			out.LinksOnlyInJSON = append(out.LinksOnlyInJSON, l)
+		}
+	}
+
+	sortLinks(out.LinksOnlyInIRC)
+	sortLinks(out.LinksOnlyInJSON)
+
+	return out
+}
+
+func sortLinks(links [][2]string) {
+	sort.Slice(links, func(i, j int) bool {
+		if links[i][0] != links[j][0] {
+			return links[i][0] < links[j][0]
+		}
+
+		return links[i][1] < links[j][1]
+	})
+}
+
+// Matches reports whether both sources agree completely
+func (r *reconcileReport) Matches() bool {
+	return len(r.OnlyInIRC) == 0 && len(r.OnlyInJSON) == 0 && len(r.IDConflicts) == 0 &&
+		len(r.NameConflicts) == 0 && len(r.DescriptionConflicts) == 0 &&
+		len(r.LinksOnlyInIRC) == 0 && len(r.LinksOnlyInJSON) == 0
+}
+
+// Summary returns a single line describing the report
+func (r *reconcileReport) Summary() string {
+	if r.Matches() {
+		return fmt.Sprintf("IRC and ioserv agree completely (%d servers)", r.IRCCount)
+	}
+
+	return fmt.Sprintf(
+		"IRC: %d servers, ioserv: %d servers | only in IRC: %d | only in ioserv: %d | ID conflicts: %d | "+
+			"name conflicts: %d | description differences: %d | links only in IRC: %d | links only in ioserv: %d",
+		r.IRCCount, r.JSONCount, len(r.OnlyInIRC), len(r.OnlyInJSON), len(r.IDConflicts), len(r.NameConflicts),
+		len(r.DescriptionConflicts), len(r.LinksOnlyInIRC), len(r.LinksOnlyInJSON),
+	)
+}
+
+// Details returns one line per non-empty category in the report
+func (r *reconcileReport) Details() []string {
+	out := []string{}
+	addServers := func(title string, servers []*Server) {
+		if len(servers) == 0 {
+			return
+		}
+
+		names := []string{}
+		for _, s := range servers {
+			names = append(names, s.NameID())
+		}
+
+		out = append(out, fmt.Sprintf("%s: %s", title, strings.Join(names, ", ")))
+	}
+
+	addConflicts := func(title string, conflicts []serverConflict, format func(serverConflict) string) {
+		if len(conflicts) == 0 {
+			return
+		}
+
+		res := []string{}
+		for _, c := range conflicts {
+			res = append(res, format(c))
+		}
+
+		out = append(out, fmt.Sprintf("%s: %s", title, strings.Join(res, ", ")))
+	}
+
+	addLinks := func(title string, links [][2]string) {
+		if len(links) == 0 {
+			return
+		}
+
+		res := []string{}
+		for _, l := range links {
+			res = append(res, l[0]+" <-> "+l[1])
+		}
+
+		out = append(out, fmt.Sprintf("%s: %s", title, strings.Join(res, ", ")))
+	}
+
+	addServers("Only in IRC", r.OnlyInIRC)
+	addServers("Only in ioserv", r.OnlyInJSON)
+	addConflicts("ID conflicts", r.IDConflicts, func(c serverConflict) string {
+		return fmt.Sprintf("%s (IRC: %s, ioserv: %s)", c.IRC.Name, c.IRC.ID, c.JSON.ID)
+	})
+	addConflicts("Name conflicts", r.NameConflicts, func(c serverConflict) string {
+		return fmt.Sprintf("%s (IRC: %s, ioserv: %s)", c.IRC.ID, c.IRC.Name, c.JSON.Name)
+	})
+	addConflicts("Description differences", r.DescriptionConflicts, func(c serverConflict) string {
+		return fmt.Sprintf("%s (IRC: %q, ioserv: %q)", c.IRC.Name, cleanDescription(c.IRC.Description), c.JSON.Description)
+	})
+	addLinks("Links only in IRC", r.LinksOnlyInIRC)
+	addLinks("Links only in ioserv", r.LinksOnlyInJSON)
+
+	return out
+}
+
+// mergeGraphs combines the IRC and ioserv graphs into one. IRC data wins where both sources have a value, as it is
+// live. Every server records which source each of its fields came from in Provenance.
+func mergeGraphs(ircGraph, jsonGraph graph) graph {
+	out := make(graph, len(ircGraph))
+	byName := make(map[string]*Server)
+
+	mergeField := func(srv *Server, field, ircValue, jsonValue string) string {
+		switch {
+		case ircValue != "" && ircValue == jsonValue:
+			srv.Provenance[field] = sourceBoth
+			return ircValue
+		case ircValue != "":
+			srv.Provenance[field] = sourceIRC
+			return ircValue
+		default:
+			srv.Provenance[field] = sourceJSON
+			return jsonValue
+		}
+	}
+
+	jsonNames := jsonGraph.byName()
+	for _, ircSrv := range ircGraph.values() {
+		jsonSrv := jsonNames[strings.ToLower(ircSrv.Name)]
+		if jsonSrv == nil {
+			jsonSrv = &Server{}
+		}
+
+		version := ircSrv.Version
+		if version == "Unknown" {
+			version = ""
+		}
+
+		srv := &Server{Provenance: make(map[string]string)}
+		srv.Name = mergeField(srv, "name", ircSrv.Name, jsonSrv.Name)
+		srv.ID = mergeField(srv, "id", ircSrv.ID, jsonSrv.ID)
+		srv.Description = mergeField(srv, "description", cleanDescription(ircSrv.Description), jsonSrv.Description)
+		srv.Version = mergeField(srv, "version", version, jsonSrv.Version)
+		srv.Users = ircSrv.Users
+		srv.Provenance["users"] = sourceIRC
+		if srv.Users == 0 && jsonSrv.Users != 0 {
+			srv.Users = jsonSrv.Users
+			srv.Provenance["users"] = sourceJSON
+		}
+
+		out[srv.ID] = srv
+		byName[strings.ToLower(srv.Name)] = srv
+	}
+
+	for _, jsonSrv := range jsonGraph.values() {
+		if _, exists := byName[strings.ToLower(jsonSrv.Name)]; exists {
+			continue
+		}
+
+		srv := &Server{
+			Name:        jsonSrv.Name,
+			ID:          jsonSrv.ID,
+			Description: jsonSrv.Description,
+			Version:     jsonSrv.Version,
+			Users:       jsonSrv.Users,
+			Provenance: map[string]string{
+				"name": sourceJSON, "id": sourceJSON, "description": sourceJSON, "version": sourceJSON,
+				"users": sourceJSON,
+			},
+		}
+
+		if _, exists := out[srv.ID]; exists {
+			srv.ID = fakeIDPrefix + srv.Name // ID collision with a differently named IRC server
+		}
+
+		out[srv.ID] = srv
+		byName[strings.ToLower(srv.Name)] = srv
+	}
+
+	for _, g := range []graph{ircGraph, jsonGraph} {
+		for _, s := range g {
+			for _, p := range s.Peers {
+				one, two := byName[strings.ToLower(s.Name)], byName[strings.ToLower(p.Name)]
+				if !one.HasPeer(two) {
+					one.Peers = append(one.Peers, two)
+				}
+			}
+		}
+	}
+
+	return out
+}
+
+// ProvenanceString describes where each field of a merged server came from
+func (s *Server) ProvenanceString() string {
+	if len(s.Provenance) == 0 {
+		return "no provenance recorded"
+	}
+
+	fields := []string{}
+	for field, source := range s.Provenance {
+		fields = append(fields, field+": "+source)
+	}
+
+	sort.Strings(fields)
+
+	return strings.Join(fields, ", ")
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// replayOptions control how a recorded session is played back to the bot
+type replayOptions struct {
+	// speed is how many times faster than recorded the lines are sent. 0 sends them without pausing.
+	speed float64
+	// maxPause caps the pause between two lines, so quiet stretches of a log dont stall the replay
+	maxPause time.Duration
+	// wait is how long to wait for the bot to send each line the log shows the original client sending, which
+	// keeps the replay in step with requests such as MAP. 0 ignores those lines.
+	wait time.Duration
+	// linger is how long the connection is kept open once the log is done, for the bot to finish replying
+	linger time.Duration
+}
+
+// replayLine is a line from a recorded session, in the format of the >> lines in the comments
+type replayLine struct {
+	fromServer bool
+	// raw is the line as it was sent, without the >> or << marker
+	raw string
+	// at is when the line was sent, from its time tag. It is zero if the line has none.
+	at time.Time
+}
+
+// readReplayLog reads a recorded session. Lines marked >> came from the server and << from the client. Unmarked
+// lines are taken to be from the server if they look like raw IRC lines.
+func readReplayLog(r io.Reader) ([]replayLine, error) {
+	lines, err := dumpLines(r)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []replayLine{}
+	for _, line := range lines {
+		l := replayLine{}
+		switch {
+		case strings.HasPrefix(line, ">> "):
+			l.fromServer, l.raw = true, strings.TrimPrefix(line, ">> ")
+
+		case strings.HasPrefix(line, "<< "):
+			l.raw = strings.TrimPrefix(line, "<< ")
+
+		default:
+			if _, _, ok := parseRawLine(line); !ok {
+				return nil, fmt.Errorf("not a raw IRC line: %q", line)
+			}
+
+			l.fromServer, l.raw = true, line
+		}
+
+		l.at = lineTime(l.raw)
+		out = append(out, l)
+	}
+
+	return out, nil
+}
+
+// lineTime returns the time tag of a raw line, or the zero time if it has none
+func lineTime(raw string) time.Time {
+	if !strings.HasPrefix(raw, "@") {
+		return time.Time{}
+	}
+
+	tags := strings.SplitN(raw[1:], " ", 2)[0]
+	for _, tag := range strings.Split(tags, ";") {
+		if strings.HasPrefix(tag, "time=") {
+			t, _ := time.Parse(time.RFC3339Nano, strings.TrimPrefix(tag, "time="))
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// lineCommand returns the command of a raw line, which need not have a source
+func lineCommand(raw string) string {
+	fields := strings.Fields(raw)
+	for len(fields) > 0 && (strings.HasPrefix(fields[0], "@") || strings.HasPrefix(fields[0], ":")) {
+		fields = fields[1:]
+	}
+
+	if len(fields) == 0 {
+		return ""
+	}
+
+	return strings.ToUpper(fields[0])
+}
+
+// redactedCommands carry passwords, keys or SASL credentials in their parameters
+var redactedCommands = []string{"OPER", "AUTHENTICATE", "PASS", "CHALLENGE"}
+
+// redactLine hides the parameters of a line the bot sent if they could hold a secret, so that transcripts are safe
+// to share
+func redactLine(raw string) string {
+	command := lineCommand(raw)
+	if !stringSliceContains(command, redactedCommands) {
+		return raw
+	}
+
+	fields := strings.Fields(raw)
+	for i, f := range fields {
+		if strings.EqualFold(f, command) {
+			return strings.Join(fields[:i+1], " ") + " <redacted>"
+		}
+	}
+
+	return raw
+}
+
+// replayer plays a recorded session to a network's connection from a local listener, so everything the server
+// sent goes through go-ircevent and the bot's callbacks just as it would live. A transcript of both directions,
+// in the same format as the log, is written to out.
+type replayer struct {
+	opts replayOptions
+
+	outMutex sync.Mutex
+	out      io.Writer
+
+	// sent has the command of every line the bot sends, and pending counts those not yet matched to the log
+	sent    chan string
+	pending map[string]int
+}
+
+// replay connects n to a local listener, plays lines to it, and disconnects once they are done
+func replay(n *network, lines []replayLine, out io.Writer, opts replayOptions) error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+
+	defer ln.Close()
+
+	// The listener speaks plain text, whatever the config says
+	n.ircCon.UseTLS = false
+	n.ircCon.UseSASL = false
+	if err := n.ircCon.Connect(ln.Addr().String()); err != nil {
+		return fmt.Errorf("could not connect to the replay listener: %w", err)
+	}
+
+	conn, err := ln.Accept()
+	if err != nil {
+		return err
+	}
+
+	r := &replayer{opts: opts, out: out, sent: make(chan string, 1000), pending: make(map[string]int)}
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		r.readBot(conn)
+	}()
+
+	err = r.play(conn, lines, readDone)
+	if err == nil {
+		select {
+		case <-time.After(opts.linger):
+		case <-readDone:
+		}
+	}
+
+	n.ircCon.Quit()
+	select {
+	case <-readDone:
+	case <-time.After(time.Second):
+	}
+
+	conn.Close()
+	<-readDone
+	n.ircCon.Disconnect()
+	return err
+}
+
+// readBot copies what the bot sends into the transcript until the connection closes
+func (r *replayer) readBot(conn net.Conn) {
+	defer close(r.sent)
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		r.writef("<< @time=%s %s", time.Now().UTC().Format("2006-01-02T15:04:05.000Z"), redactLine(line))
+
+		command := lineCommand(line)
+		select {
+		case r.sent <- command:
+		default:
+		}
+
+		if command == "QUIT" {
+			return
+		}
+	}
+}
+
+func (r *replayer) writef(format string, args ...interface{}) {
+	r.outMutex.Lock()
+	defer r.outMutex.Unlock()
+
+	fmt.Fprintf(r.out, format+"\n", args...)
+}
+
+// play sends every line from the server, pausing as the log did, and waits for the bot wherever the log shows the
+// original client sending something
+func (r *replayer) play(conn net.Conn, lines []replayLine, readDone <-chan struct{}) error {
+	var last time.Time
+	for _, l := range lines {
+		if !l.fromServer {
+			if r.opts.wait > 0 && !r.waitFor(lineCommand(l.raw)) {
+				r.writef("# the bot did not send %s within %s", lineCommand(l.raw), r.opts.wait)
+			}
+
+			continue
+		}
+
+		if !l.at.IsZero() {
+			if !last.IsZero() {
+				r.pause(l.at.Sub(last))
+			}
+
+			last = l.at
+		}
+
+		select {
+		case <-readDone:
+			return errors.New("the bot disconnected before the log was done")
+		default:
+		}
+
+		r.writef(">> %s", l.raw)
+		if _, err := fmt.Fprintf(conn, "%s\r\n", l.raw); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pause waits for the gap between two recorded lines, scaled by the replay speed
+func (r *replayer) pause(gap time.Duration) {
+	if r.opts.speed <= 0 || gap <= 0 {
+		return
+	}
+
+	gap = time.Duration(float64(gap) / r.opts.speed)
+	if r.opts.maxPause > 0 && gap > r.opts.maxPause {
+		gap = r.opts.maxPause
+	}
+
+	time.Sleep(gap)
+}
+
+// waitFor waits for the bot to send command, returning false if it does not in time. Commands the bot sent that
+// the log has not asked for yet are remembered, as the bot may send things in a different order.
+func (r *replayer) waitFor(command string) bool {
+	if r.pending[command] > 0 {
+		r.pending[command]--
+		return true
+	}
+
+	timeout := time.NewTimer(r.opts.wait)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case sent, ok := <-r.sent:
+			if !ok {
+				return false
+			}
+
+			if sent == command {
+				return true
+			}
+
+			r.pending[sent]++
+
+		case <-timeout.C:
+			return false
+		}
+	}
+}
+
+// replayMain implements the "replay" subcommand, which plays a recorded session to the bot as if it were live.
+// The bot's state files are kept in a temporary directory unless --state names one, so that a replay never touches
+// the live ones.
+func replayMain(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	configPath := fs.String("config", defaultConfigFile, "path to the config file")
+	netName := fs.String("net", "", "network to replay the log on, if more than one is configured")
+	speed := fs.Float64("speed", 1, "how many times faster than recorded to play the log, or 0 to not pause at all")
+	maxPause := fs.Duration("max-pause", 10*time.Second, "longest pause between two lines, or 0 for no limit")
+	wait := fs.Duration("wait", 10*time.Second, "how long to wait for the bot to send each line the log shows it sending, or 0 to not wait")
+	linger := fs.Duration("linger", 5*time.Second, "how long to wait for the bot to finish once the log is done")
+	stateDir := fs.String("state", "", "directory for the bot's state files, which may hold copies of the live ones to start from (default a new temporary directory)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s replay [--config FILE] [--net NETWORK] [--speed N] [--state DIR] LOG\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() != 1 || *speed < 0 {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := loadConfig(*configPath, isFlagSet(fs, "config"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if _, err := cfg.network(*netName); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if *netName == "" {
+		*netName = cfg.networkNames()[0]
+	}
+
+	var lines []replayLine
+	err = parseDumpFile(fs.Arg(0), func(r io.Reader) (err error) {
+		lines, err = readReplayLog(r)
+		return err
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not read %q: %s\n", fs.Arg(0), err)
+		return 1
+	}
+
+	if *stateDir == "" {
+		if *stateDir, err = ioutil.TempDir("", "pngraphbot-replay-"); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		defer os.RemoveAll(*stateDir)
+	}
+
+	cfg.useStateDir(*stateDir)
+
+	// Neither is possible against the replay listener, and TLS would otherwise load certificates for nothing
+	nc := cfg.networks[*netName]
+	nc.IRC.TLS = false
+	nc.IRC.SASL = saslConfig{}
+
+	b, err := NewBot(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	// Keep stdout for the transcript. It already has everything the bot sends, without the secrets debug logging
+	// would print.
+	n := b.networks[*netName]
+	n.ircCon.Log = log.New(os.Stderr, "", log.LstdFlags)
+	n.ircCon.Debug = false
+	n.ids.log = n.ircCon.Log
+
+	opts := replayOptions{speed: *speed, maxPause: *maxPause, wait: *wait, linger: *linger}
+	if err := replay(n, lines, os.Stdout, opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
+
+// useStateDir moves every file the bot keeps state in to dir, keeping their names
+func (c *config) useStateDir(dir string) {
+	files := []*string{&c.Permissions.File, &c.Watch.File, &c.History.File, &c.Presence.File}
+	for _, nc := range c.networks {
+		files = append(files, &nc.Sources.IDCache)
+	}
+
+	for _, file := range files {
+		if *file != "" {
+			*file = filepath.Join(dir, filepath.Base(*file))
+		}
+	}
+}
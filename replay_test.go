@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func replayTestLog(t *testing.T, path string, opts replayOptions) string {
+	t.Helper()
+	silenceLog(t)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	lines, err := readReplayLog(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewBot(testConfig(t, "replay.invalid:6667", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := b.networks[defaultNetworkName]
+	n.ircCon.Log.SetOutput(&testLog{})
+
+	out := &bytes.Buffer{}
+	if err := replay(n, lines, out, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	return out.String()
+}
+
+func TestReplay(t *testing.T) {
+	out := replayTestLog(t, "testdata/replay/count.log", replayOptions{wait: 5 * time.Second})
+
+	for _, want := range []string{
+		">> @time=2023-02-11T18:30:12.480Z :alice!alice@user.host PRIVMSG #opers :~count",
+		" OPER <redacted>\n",
+		" PRIVMSG #opers :Currently there are 3 servers on the network\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("transcript is missing %q:\n%s", want, out)
+		}
+	}
+
+	if strings.Contains(out, "hunter2") {
+		t.Errorf("the transcript has the oper password in it:\n%s", out)
+	}
+
+	if strings.Contains(out, "# the bot did not send") {
+		t.Errorf("the replay lost step with the bot:\n%s", out)
+	}
+}
+
+func TestReplayWaitTimeout(t *testing.T) {
+	path := t.TempDir() + "/session.log"
+	session := ">> :hub.example.org 001 graphbot :Welcome\n<< PRIVMSG #opers :nobody asked\n>> :hub.example.org PING :done\n"
+	if err := os.WriteFile(path, []byte(session), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	out := replayTestLog(t, path, replayOptions{wait: 100 * time.Millisecond, linger: time.Second})
+	if !strings.Contains(out, "# the bot did not send PRIVMSG within 100ms") {
+		t.Errorf("no note about the missing PRIVMSG:\n%s", out)
+	}
+
+	// The log carries on regardless
+	if !strings.Contains(out, "PONG :done") {
+		t.Errorf("the rest of the log was not played:\n%s", out)
+	}
+}
+
+func TestRedactLine(t *testing.T) {
+	tests := map[string]string{
+		"OPER graphbot hunter2":                 "OPER <redacted>",
+		"AUTHENTICATE Z3JhcGhib3QAaHVudGVyMg==": "AUTHENTICATE <redacted>",
+		"PASS :secret":                          "PASS <redacted>",
+		"CHALLENGE +c29tZSByZXNwb25zZQ==":       "CHALLENGE <redacted>",
+		"@label=1 oper graphbot hunter2":        "@label=1 oper <redacted>",
+		"PRIVMSG #opers :OPER graphbot hunter2": "PRIVMSG #opers :OPER graphbot hunter2",
+	}
+
+	for line, want := range tests {
+		if got := redactLine(line); got != want {
+			t.Errorf("redactLine(%q) = %q, want %q", line, got, want)
+		}
+	}
+}
+
+func TestReadReplayLog(t *testing.T) {
+	lines, err := readReplayLog(strings.NewReader(strings.Join([]string{
+		"# a comment",
+		">> @time=2021-06-09T12:08:37.995Z :irc.awesome-dragon.science 365 A_Dragon * :End of /LINKS list.",
+		"<< @time=2021-06-09T12:08:38.000Z LINKS",
+		":irc.awesome-dragon.science PING :unmarked",
+	}, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		fromServer bool
+		command    string
+		at         string
+	}{
+		{true, RPL_ENDOFLINKS, "2021-06-09T12:08:37.995Z"},
+		{false, "LINKS", "2021-06-09T12:08:38Z"},
+		{true, "PING", "0001-01-01T00:00:00Z"},
+	}
+
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d", len(lines), len(want))
+	}
+
+	for i, w := range want {
+		l := lines[i]
+		if l.fromServer != w.fromServer || lineCommand(l.raw) != w.command || l.at.Format(time.RFC3339Nano) != w.at {
+			t.Errorf("line %d: got %v %s %s, want %+v", i, l.fromServer, lineCommand(l.raw), l.at.Format(time.RFC3339Nano), w)
+		}
+	}
+
+	if _, err := readReplayLog(strings.NewReader("not irc at all")); err == nil {
+		t.Error("a line that is not IRC was accepted")
+	}
+}
+
+func TestReplayMainStateFiles(t *testing.T) {
+	silenceLog(t)
+
+	dir := t.TempDir()
+	config := filepath.Join(dir, "pngraphbot.toml")
+	err := os.WriteFile(config, []byte(fmt.Sprintf(`
+[irc]
+server = "replay.invalid:6667"
+tls = false
+nick = "graphbot"
+user = "graphs"
+debug = false
+
+[irc.oper]
+name = "graphbot"
+password = "hunter2"
+
+[sources]
+id_cache = %[1]q
+graph_mode = "irc"
+
+[permissions]
+file = %[2]q
+
+[watch]
+file = %[3]q
+
+[history]
+file = %[4]q
+
+[presence]
+file = %[5]q
+`, filepath.Join(dir, "live", "serverids.json"), filepath.Join(dir, "live", "permissions.json"),
+		filepath.Join(dir, "live", "watches.json"), filepath.Join(dir, "live", "history.json"),
+		filepath.Join(dir, "live", "presence.json"))), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	defer func() { os.Stdout = stdout }()
+
+	live, state := filepath.Join(dir, "live"), filepath.Join(dir, "state")
+	for _, d := range []string{live, state} {
+		if err := os.Mkdir(d, 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	args := []string{"--config", config, "--speed", "0", "--wait", "5s", "--linger", "1s", "testdata/replay/count.log"}
+	if code := replayMain(append([]string{"--state", state}, args...)); code != 0 {
+		t.Fatalf("replay exited with %d", code)
+	}
+
+	if code := replayMain(args); code != 0 {
+		t.Fatalf("replay exited with %d", code)
+	}
+
+	if written, _ := filepath.Glob(filepath.Join(live, "*")); len(written) > 0 {
+		t.Errorf("the replay wrote to the live state files: %v", written)
+	}
+
+	if written, _ := filepath.Glob(filepath.Join(state, "*")); len(written) == 0 {
+		t.Error("nothing was written to --state")
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	irc "github.com/thoj/go-ircevent"
+)
+
+const (
+	defaultReportPeriod = 24 * time.Hour
+	defaultReportTop    = 5
+	reportTimeFormat    = "Jan 2 15:04 MST"
+)
+
+// reportConfig posts a summary of how a network changed to channels on a schedule
+type reportConfig struct {
+	Name string `toml:"name"`
+	// Schedule is a cron expression, in the bot's local time zone
+	Schedule string `toml:"schedule"`
+	// Period is how far back the report looks. Defaults to a day.
+	Period   time.Duration `toml:"period"`
+	Channels []string      `toml:"channels"`
+	// Networks limits the report to the named networks
+	Networks []string `toml:"networks"`
+	// Top is how many links and hubs are listed. Defaults to 5.
+	Top int `toml:"top"`
+}
+
+func (r reportConfig) period() time.Duration {
+	if r.Period <= 0 {
+		return defaultReportPeriod
+	}
+
+	return r.Period
+}
+
+func (r reportConfig) top() int {
+	if r.Top <= 0 {
+		return defaultReportTop
+	}
+
+	return r.Top
+}
+
+func (r reportConfig) validate() error {
+	switch {
+	case r.Name == "":
+		return fmt.Errorf("reports need a name")
+	case len(r.Channels) == 0:
+		return fmt.Errorf("report %s has no channels", r.Name)
+	case r.Period < 0 || r.Top < 0:
+		return fmt.Errorf("report %s: period and top cannot be negative", r.Name)
+	}
+
+	if _, err := parseCron(r.Schedule); err != nil {
+		return fmt.Errorf("report %s: %w", r.Name, err)
+	}
+
+	return nil
+}
+
+type linkChanges struct {
+	Link    [2]string `json:"link"`
+	Changes int       `json:"changes"`
+}
+
+type hubPeers struct {
+	Name  string `json:"name"`
+	Peers int    `json:"peers"`
+}
+
+// networkReport summarises how a network changed over a period, from its history
+type networkReport struct {
+	Network        string        `json:"network"`
+	From           time.Time     `json:"from"`
+	To             time.Time     `json:"to"`
+	Servers        int           `json:"servers"`
+	ServersBefore  int           `json:"servers_before"`
+	New            []string      `json:"new"`
+	Lost           []string      `json:"lost"`
+	Diameter       int           `json:"diameter"`
+	DiameterBefore int           `json:"diameter_before"`
+	DiameterMin    int           `json:"diameter_min"`
+	DiameterMax    int           `json:"diameter_max"`
+	ChangedLinks   []linkChanges `json:"changed_links"`
+	TopHubs        []hubPeers    `json:"top_hubs"`
+}
+
+// buildReport summarises entries, which must be in order, listing top links and hubs
+func buildReport(network string, entries []*historyEntry, top int) (*networkReport, error) {
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("there is no history for %s in that period yet", network)
+	}
+
+	first, last := entries[0], entries[len(entries)-1]
+	r := &networkReport{
+		Network:        network,
+		From:           first.Taken,
+		To:             last.Taken,
+		Servers:        last.Servers,
+		ServersBefore:  first.Servers,
+		New:            stringsMissing(last.Topology.Servers, first.Topology.Servers),
+		Lost:           stringsMissing(first.Topology.Servers, last.Topology.Servers),
+		Diameter:       last.Diameter,
+		DiameterBefore: first.Diameter,
+		DiameterMin:    first.Diameter,
+		DiameterMax:    first.Diameter,
+		ChangedLinks:   []linkChanges{},
+		TopHubs:        []hubPeers{},
+	}
+
+	changes := make(map[[2]string]int)
+	for i, entry := range entries {
+		if entry.Diameter < r.DiameterMin {
+			r.DiameterMin = entry.Diameter
+		}
+
+		if entry.Diameter > r.DiameterMax {
+			r.DiameterMax = entry.Diameter
+		}
+
+		// Entries share their topology until it changes
+		if i == 0 || entry.Topology == entries[i-1].Topology {
+			continue
+		}
+
+		before := linkSet(entries[i-1].Topology.Links)
+		after := linkSet(entry.Topology.Links)
+		for link := range after {
+			if !before[link] {
+				changes[link]++
+			}
+		}
+
+		for link := range before {
+			if !after[link] {
+				changes[link]++
+			}
+		}
+	}
+
+	for link, n := range changes {
+		r.ChangedLinks = append(r.ChangedLinks, linkChanges{Link: link, Changes: n})
+	}
+
+	sort.Slice(r.ChangedLinks, func(i, j int) bool {
+		a, b := r.ChangedLinks[i], r.ChangedLinks[j]
+		if a.Changes != b.Changes {
+			return a.Changes > b.Changes
+		}
+
+		return a.Link[0]+" "+a.Link[1] < b.Link[0]+" "+b.Link[1]
+	})
+
+	r.TopHubs = topHubs(last.Topology)
+	if top < 0 {
+		top = 0
+	}
+
+	if len(r.ChangedLinks) > top {
+		r.ChangedLinks = r.ChangedLinks[:top]
+	}
+
+	if len(r.TopHubs) > top {
+		r.TopHubs = r.TopHubs[:top]
+	}
+
+	return r, nil
+}
+
+// stringsMissing returns the strings in want that are not in have
+func stringsMissing(want, have []string) []string {
+	seen := make(map[string]bool, len(have))
+	for _, s := range have {
+		seen[s] = true
+	}
+
+	out := []string{}
+	for _, s := range want {
+		if !seen[s] {
+			out = append(out, s)
+		}
+	}
+
+	return out
+}
+
+func linkSet(links [][2]string) map[[2]string]bool {
+	out := make(map[[2]string]bool, len(links))
+	for _, l := range links {
+		out[l] = true
+	}
+
+	return out
+}
+
+// topHubs returns every server in t with its number of peers, those with the most first
+func topHubs(t *historyTopology) []hubPeers {
+	names := make(map[string]string, len(t.Servers))
+	for _, name := range t.Servers {
+		names[strings.ToLower(name)] = name
+	}
+
+	peers := make(map[string]int)
+	for _, link := range t.Links {
+		peers[link[0]]++
+		peers[link[1]]++
+	}
+
+	out := []hubPeers{}
+	for key, n := range peers {
+		name, exists := names[key]
+		if !exists {
+			name = key
+		}
+
+		out = append(out, hubPeers{Name: name, Peers: n})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Peers != out[j].Peers {
+			return out[i].Peers > out[j].Peers
+		}
+
+		return out[i].Name < out[j].Name
+	})
+
+	return out
+}
+
+func (r *networkReport) lines() []string {
+	out := []string{fmt.Sprintf(
+		"Report for %s, %s to %s: %d servers (%+d)",
+		r.Network, r.From.Local().Format(reportTimeFormat), r.To.Local().Format(reportTimeFormat), r.Servers,
+		r.Servers-r.ServersBefore,
+	)}
+
+	switch {
+	case len(r.New) == 0 && len(r.Lost) == 0:
+		out = append(out, "No servers joined or left")
+	default:
+		out = append(out, fmt.Sprintf("New servers: %s. Lost servers: %s", listOrNone(r.New), listOrNone(r.Lost)))
+	}
+
+	out = append(out, fmt.Sprintf(
+		"Diameter %d (was %d, ranged from %d to %d)", r.Diameter, r.DiameterBefore, r.DiameterMin, r.DiameterMax,
+	))
+
+	if len(r.ChangedLinks) == 0 {
+		out = append(out, "No links changed")
+	} else {
+		links := []string{}
+		for _, l := range r.ChangedLinks {
+			links = append(links, fmt.Sprintf("%s <-> %s (%d)", l.Link[0], l.Link[1], l.Changes))
+		}
+
+		out = append(out, "Most changed links: "+strings.Join(links, ", "))
+	}
+
+	hubs := []string{}
+	for _, h := range r.TopHubs {
+		hubs = append(hubs, fmt.Sprintf("%s (%d)", h.Name, h.Peers))
+	}
+
+	return append(out, "Top hubs: "+listOrNone(hubs))
+}
+
+func listOrNone(list []string) string {
+	if len(list) == 0 {
+		return "none"
+	}
+
+	return strings.Join(list, ", ")
+}
+
+// runReports posts scheduled reports. Schedules are checked at the start of every minute, in local time.
+func (b *bot) runReports() {
+	schedules := make([]*cronSchedule, len(b.cfg.Reports))
+	for i, r := range b.cfg.Reports {
+		// Already checked when the config was loaded
+		schedules[i], _ = parseCron(r.Schedule)
+	}
+
+	for {
+		next := time.Now().Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(time.Until(next))
+
+		for i, r := range b.cfg.Reports {
+			if schedules[i].matches(next) {
+				b.postReport(r, next)
+			}
+		}
+	}
+}
+
+// postReport sends report r for every network it covers to its channels
+func (b *bot) postReport(r reportConfig, now time.Time) {
+	for _, name := range b.cfg.networkNames() {
+		if len(r.Networks) > 0 && !stringSliceContains(name, r.Networks) {
+			continue
+		}
+
+		n := b.networks[name]
+		rep, err := buildReport(name, b.history.window(name, now.Add(-r.period())), r.top())
+		if err != nil {
+			log.Printf("Report %s for %s: %s", r.Name, name, err)
+			continue
+		}
+
+		for _, channel := range r.Channels {
+			go n.output.send(channel, rep.lines())
+		}
+	}
+}
+
+// report runs a report on demand, over the given period
+func (b *bot) report(n *network, _ *irc.Event, args *commandArgs) *commandResult {
+	period := args.duration("period", defaultReportPeriod)
+	rep, err := buildReport(n.name, b.history.window(n.name, time.Now().Add(-period)), args.int("top", defaultReportTop))
+	if err != nil {
+		return errorResult(err)
+	}
+
+	return newResult(rep, rep.lines()...)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBuildReportTop(t *testing.T) {
+	before := &historyTopology{Servers: []string{"a", "b", "c"}, Links: [][2]string{{"a", "b"}, {"a", "c"}}}
+	after := &historyTopology{Servers: []string{"a", "b", "c"}, Links: [][2]string{{"a", "b"}, {"b", "c"}}}
+	now := time.Now()
+	entries := []*historyEntry{
+		{Taken: now.Add(-time.Hour), Servers: 3, Topology: before},
+		{Taken: now, Servers: 3, Topology: after},
+	}
+
+	// The link from a to c went down and the one from b to c came up
+	for top, want := range map[int][2]int{-1: {0, 0}, 0: {0, 0}, 1: {1, 1}, 100: {2, 3}} {
+		r, err := buildReport("test", entries, top)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(r.ChangedLinks) != want[0] || len(r.TopHubs) != want[1] {
+			t.Errorf("top %d: got %d links and %d hubs, want %v", top, len(r.ChangedLinks), len(r.TopHubs), want)
+		}
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	irc "github.com/thoj/go-ircevent"
+)
+
+const (
+	fakeIDPrefix       = "FAKEID_"
+	defaultIDCacheFile = "serverids.json"
+	getIDTimeout       = 5 * time.Second
+	// failedLookupTTL is how long a name that could not be resolved keeps its fake ID before we ask again
+	failedLookupTTL    = 5 * time.Minute
+	pendingRetryPeriod = time.Minute
+	// maxPendingRetries is how many times a name with a fake ID is retried in the background, waiting twice as long
+	// each time. After that it is only looked up again when a refresh needs it and its fake ID has expired.
+	maxPendingRetries = 8
+)
+
+// idSource is a single step in the server ID resolver chain
+type idSource interface {
+	Name() string
+	// LookupIDs returns IDs for as many of the given server names as it can
+	LookupIDs(names []string) (map[string]string, error)
+}
+
+type idCacheEntry struct {
+	ID      string    `json:"id"`
+	Source  string    `json:"source"`
+	Updated time.Time `json:"updated"`
+}
+
+func (e idCacheEntry) isFake() bool { return strings.HasPrefix(e.ID, fakeIDPrefix) }
+
+// idResolver resolves server names to IDs by walking a chain of sources, remembering everything it learns in
+// a persistent cache. Names that no source knows get a fake ID, which is replaced once a real one turns up.
+type idResolver struct {
+	sources []idSource
+	log     *log.Logger
+
+	cacheFile string
+	// readOnly keeps the cache file as it is, for tools that share it with a running bot
+	readOnly   bool
+	cacheMutex sync.Mutex
+	cache      map[string]idCacheEntry
+	// retries tracks the background retries of names with fake IDs
+	retries map[string]pendingRetry
+}
+
+type pendingRetry struct {
+	count int
+	next  time.Time
+}
+
+func newIDResolver(cacheFile string, logger *log.Logger, sources ...idSource) *idResolver {
+	r := &idResolver{
+		sources:   sources,
+		log:       logger,
+		cacheFile: cacheFile,
+		cache:     make(map[string]idCacheEntry),
+		retries:   make(map[string]pendingRetry),
+	}
+
+	if err := r.load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		r.log.Printf("Could not load server ID cache from %q: %s", cacheFile, err)
+	}
+
+	return r
+}
+
+func (r *idResolver) load() error {
+	if r.cacheFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(r.cacheFile)
+	if err != nil {
+		return err
+	}
+
+	r.cacheMutex.Lock()
+	defer r.cacheMutex.Unlock()
+
+	return json.Unmarshal(data, &r.cache)
+}
+
+func (r *idResolver) save() error {
+	if r.cacheFile == "" || r.readOnly {
+		return nil
+	}
+
+	r.cacheMutex.Lock()
+	data, err := json.MarshalIndent(r.cache, "", "\t")
+	r.cacheMutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(r.cacheFile, data, 0o644)
+}
+
+// cached returns the cache entry for name, if any. Expired fake IDs are treated as missing.
+func (r *idResolver) cached(name string) (idCacheEntry, bool) {
+	r.cacheMutex.Lock()
+	defer r.cacheMutex.Unlock()
+
+	entry, exists := r.cache[strings.ToLower(name)]
+	if exists && entry.isFake() && time.Since(entry.Updated) > failedLookupTTL {
+		return entry, false
+	}
+
+	return entry, exists
+}
+
+func (r *idResolver) store(name, id, source string) {
+	r.cacheMutex.Lock()
+	defer r.cacheMutex.Unlock()
+
+	key := strings.ToLower(name)
+	if old, exists := r.cache[key]; exists && old.isFake() && !strings.HasPrefix(id, fakeIDPrefix) {
+		r.log.Printf("Reconciled server %q: %s -> %s (from %s)", name, old.ID, id, source)
+	}
+
+	r.cache[key] = idCacheEntry{ID: id, Source: source, Updated: time.Now()}
+}
+
+// resolve returns an ID for every name given. Names that could not be resolved get a fake ID.
+func (r *idResolver) resolve(names []string) map[string]string {
+	out := make(map[string]string, len(names))
+	remaining := []string{}
+
+	for _, name := range names {
+		if entry, ok := r.cached(name); ok {
+			out[name] = entry.ID
+			continue
+		}
+
+		remaining = append(remaining, name)
+	}
+
+	if len(remaining) == 0 {
+		return out
+	}
+
+	for _, name := range r.lookup(remaining) {
+		id := fakeIDPrefix + name
+		r.log.Printf("UNKNOWN SERVER %s! Creating fake ID %q", name, id)
+		r.store(name, id, "fake")
+	}
+
+	for _, name := range remaining {
+		entry, _ := r.cached(name)
+		out[name] = entry.ID
+	}
+
+	if err := r.save(); err != nil {
+		r.log.Printf("Could not save server ID cache to %q: %s", r.cacheFile, err)
+	}
+
+	return out
+}
+
+// lookup asks each source in turn for the names still unresolved, caching what it learns. It returns the names
+// that no source knew about.
+func (r *idResolver) lookup(names []string) []string {
+	return r.lookupFrom(r.sources, names)
+}
+
+func (r *idResolver) lookupFrom(sources []idSource, names []string) []string {
+	remaining := names
+	for _, source := range sources {
+		if len(remaining) == 0 {
+			break
+		}
+
+		found, err := source.LookupIDs(remaining)
+		if err != nil {
+			r.log.Printf("ID source %s failed: %s", source.Name(), err)
+		}
+
+		next := []string{}
+		for _, name := range remaining {
+			if id, ok := found[name]; ok && id != "" {
+				r.store(name, id, source.Name())
+				continue
+			}
+
+			next = append(next, name)
+		}
+
+		remaining = next
+	}
+
+	return remaining
+}
+
+// due returns the names that only have a fake ID and are due a background retry at now, counting the attempt
+func (r *idResolver) due(now time.Time) []string {
+	r.cacheMutex.Lock()
+	defer r.cacheMutex.Unlock()
+
+	out := []string{}
+	for name, entry := range r.cache {
+		if !entry.isFake() {
+			delete(r.retries, name)
+			continue
+		}
+
+		retry := r.retries[name]
+		if retry.count >= maxPendingRetries || now.Before(retry.next) {
+			continue
+		}
+
+		retry.next = now.Add(pendingRetryPeriod << uint(retry.count))
+		retry.count++
+		r.retries[name] = retry
+		out = append(out, name)
+	}
+
+	return out
+}
+
+// backgroundSources returns the sources that are cheap enough to retry in the background. GETID costs a round trip
+// to the server for every name, so it is left to refreshes.
+func (r *idResolver) backgroundSources() []idSource {
+	out := []idSource{}
+	for _, source := range r.sources {
+		if _, isGetID := source.(getIDSource); !isGetID {
+			out = append(out, source)
+		}
+	}
+
+	return out
+}
+
+// retryPending periodically retries names with fake IDs so they are reconciled as soon as a source learns them.
+// Each name is retried less often every time, and not at all after maxPendingRetries.
+func (r *idResolver) retryPending(stop <-chan struct{}) {
+	ticker := time.NewTicker(pendingRetryPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			r.retryDue(now)
+		}
+	}
+}
+
+// retryDue looks up the names due a retry at now
+func (r *idResolver) retryDue(now time.Time) {
+	names := r.due(now)
+	if len(names) == 0 {
+		return
+	}
+
+	if len(r.lookupFrom(r.backgroundSources(), names)) < len(names) {
+		if err := r.save(); err != nil {
+			r.log.Printf("Could not save server ID cache to %q: %s", r.cacheFile, err)
+		}
+	}
+}
+
+// mapIDSource pulls IDs out of MAP output
+type mapIDSource struct {
+	lines func() []string
+}
+
+func (mapIDSource) Name() string { return "MAP" }
+
+func (m mapIDSource) LookupIDs(names []string) (map[string]string, error) {
+	known := make(map[string]string)
+	for _, line := range m.lines() {
+		if name, id, _, ok := parseMapLine(line); ok {
+			known[strings.ToLower(name)] = id
+		}
+	}
+
+	out := make(map[string]string)
+	for _, name := range names {
+		if id, ok := known[strings.ToLower(name)]; ok {
+			out[name] = id
+		}
+	}
+
+	return out, nil
+}
+
+var getIDRe = regexp.MustCompile(`^GETID: (\S+) is (\S+)$`)
+
+// getIDSource asks the IRC server with the nonstandard GETID command. All names are queried at once and share a
+// single set of callbacks, which are always removed when the lookup finishes.
+type getIDSource struct {
+	con     *irc.Connection
+	timeout time.Duration
+}
+
+func (getIDSource) Name() string { return "GETID" }
+
+func (g getIDSource) LookupIDs(names []string) (map[string]string, error) {
+	if !g.con.Connected() {
+		return nil, errors.New("not connected to IRC")
+	}
+
+	var (
+		mu      sync.Mutex
+		out     = make(map[string]string)
+		waiting = make(map[string]string, len(names))
+		done    = make(chan struct{})
+		once    sync.Once
+	)
+
+	for _, name := range names {
+		waiting[strings.ToLower(name)] = name
+	}
+
+	// answer records a reply for a name we asked about. An empty ID means the server does not exist.
+	answer := func(retName, id string) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		name, ok := waiting[strings.ToLower(retName)]
+		if !ok {
+			return // wasnt us
+		}
+
+		delete(waiting, strings.ToLower(retName))
+		if id != "" {
+			out[name] = id
+		}
+
+		if len(waiting) == 0 {
+			once.Do(func() { close(done) })
+		}
+	}
+
+	noticeID := g.con.AddCallback(NOTICE, func(e *irc.Event) {
+		if pair := getIDRe.FindStringSubmatch(e.Message()); pair != nil {
+			answer(pair[1], pair[2])
+		}
+	})
+	defer g.con.RemoveCallback(NOTICE, noticeID)
+
+	noSuchNickID := g.con.AddCallback(RPL_NOSUCHNICK, func(e *irc.Event) {
+		if len(e.Arguments) > 1 {
+			answer(e.Arguments[1], "")
+		}
+	})
+	defer g.con.RemoveCallback(RPL_NOSUCHNICK, noSuchNickID)
+
+	for _, name := range names {
+		g.con.SendRawf("GETID %s", name)
+	}
+
+	timer := time.NewTimer(g.timeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+	case <-timer.C:
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(waiting) > 0 {
+		return out, fmt.Errorf("timed out waiting for %d of %d GETID replies", len(waiting), len(names))
+	}
+
+	return out, nil
+}
+
+// jsonIDSource looks names up in the ioserv JSON
+type jsonIDSource struct {
+	client *ioservClient
+}
+
+func (jsonIDSource) Name() string { return "ioserv" }
+
+func (j jsonIDSource) LookupIDs(names []string) (map[string]string, error) {
+	g, err := j.client.Graph()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]string)
+	for _, name := range names {
+		if srv := g.getServer(name); srv != nil {
+			out[name] = srv.ID
+		}
+	}
+
+	return out, nil
+}
+
+// staticIDSource is a fixed table of server names to IDs
+type staticIDSource map[string]string
+
+func (staticIDSource) Name() string { return "static" }
+
+func (s staticIDSource) LookupIDs(names []string) (map[string]string, error) {
+	out := make(map[string]string)
+	for _, name := range names {
+		for known, id := range s {
+			if strings.EqualFold(known, name) {
+				out[name] = id
+				break
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// parseStaticIDs parses a list of name=ID pairs separated by commas
+func parseStaticIDs(s string) staticIDSource {
+	out := make(staticIDSource)
+	for _, pair := range strings.Split(s, ",") {
+		split := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(split) != 2 || split[0] == "" || split[1] == "" {
+			continue
+		}
+
+		out[split[0]] = split[1]
+	}
+
+	return out
+}
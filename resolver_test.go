@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+// countingSource knows no IDs, and counts how often it was asked
+type countingSource struct{ calls *int }
+
+func (countingSource) Name() string { return "counting" }
+
+func (c countingSource) LookupIDs([]string) (map[string]string, error) {
+	*c.calls++
+	return nil, nil
+}
+
+func TestRetryPendingBacksOff(t *testing.T) {
+	calls := 0
+	r := newIDResolver("", log.New(ioutil.Discard, "", 0), countingSource{&calls})
+	r.resolve([]string{"lost.test.net"})
+
+	// GETID is never asked in the background. This one has no connection, so it would panic if it were.
+	r.sources = append(r.sources, getIDSource{})
+	start := time.Now()
+	retried := []int{}
+	for minute := 1; minute <= 24*60; minute++ {
+		before := calls
+		r.retryDue(start.Add(time.Duration(minute) * time.Minute))
+		if calls > before {
+			retried = append(retried, minute)
+		}
+	}
+
+	if fmt.Sprint(retried) != "[1 2 4 8 16 32 64 128]" {
+		t.Errorf("retried at minutes %v over a day", retried)
+	}
+}
+
+func TestReadOnlyResolver(t *testing.T) {
+	path := t.TempDir() + "/serverids.json"
+	cache := `{"known.test.net": {"id": "001", "source": "MAP", "updated": "2023-01-01T00:00:00Z"}}`
+	if err := ioutil.WriteFile(path, []byte(cache), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newIDResolver(path, log.New(ioutil.Discard, "", 0))
+	r.readOnly = true
+	ids := r.resolve([]string{"known.test.net", "lost.test.net"})
+	if ids["known.test.net"] != "001" || ids["lost.test.net"] != fakeIDPrefix+"lost.test.net" {
+		t.Errorf("got %v", ids)
+	}
+
+	if data, _ := ioutil.ReadFile(path); string(data) != cache {
+		t.Errorf("the cache file was changed to %s", data)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	irc "github.com/thoj/go-ircevent"
+)
+
+// commandResult is what a command produces. text is the reply people see on IRC, and Data holds the same
+// information for machines. --json replies are the whole result encoded as JSON.
+type commandResult struct {
+	Command  string      `json:"command"`
+	Network  string      `json:"network,omitempty"`
+	OK       bool        `json:"ok"`
+	Error    string      `json:"error,omitempty"`
+	Warnings []string    `json:"warnings,omitempty"`
+	Data     interface{} `json:"data,omitempty"`
+
+	text []string
+}
+
+func newResult(data interface{}, text ...string) *commandResult {
+	return &commandResult{OK: true, Data: data, text: text}
+}
+
+func resultf(data interface{}, format string, args ...interface{}) *commandResult {
+	return newResult(data, fmt.Sprintf(format, args...))
+}
+
+func errorResult(err error) *commandResult {
+	return &commandResult{Error: err.Error()}
+}
+
+func errorf(format string, args ...interface{}) *commandResult {
+	return errorResult(fmt.Errorf(format, args...))
+}
+
+func (r *commandResult) warn(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// lines returns the reply to send on IRC
+func (r *commandResult) lines() []string {
+	out := []string{}
+	for _, w := range r.Warnings {
+		out = append(out, "Warning: "+w)
+	}
+
+	if r.Error != "" {
+		return append(out, "Error: "+r.Error)
+	}
+
+	return append(out, r.text...)
+}
+
+// serverRef identifies a server in result data without all of its details
+type serverRef struct {
+	Name string `json:"name"`
+	ID   string `json:"id"`
+}
+
+func (s *Server) ref() serverRef { return serverRef{Name: s.Name, ID: s.ID} }
+
+// tookMS returns the time since start in milliseconds, for the timings in result data
+func tookMS(start time.Time) float64 {
+	return float64(time.Since(start)) / float64(time.Millisecond)
+}
+
+// reply sends res in reply to e, as text or as JSON. JSON replies are never paged or pasted. If one does not fit on
+// a line it is split over several, which arrive together and in order, so readers should join lines until the
+// JSON is complete.
+func (b *bot) reply(e *irc.Event, res *commandResult, asJSON bool) {
+	if !asJSON {
+		b.replyLines(e, res.lines())
+		return
+	}
+
+	data, err := json.Marshal(res)
+	if err != nil {
+		data, _ = json.Marshal(&commandResult{Command: res.Command, Network: res.Network, Error: err.Error()})
+	}
+
+	n := b.networkFor(e)
+	if n == nil {
+		e.Connection.Privmsg(replyTarget(e), string(data))
+		return
+	}
+
+	n.output.sendRaw(replyTarget(e), string(data))
+}
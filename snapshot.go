@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// snapshot is what the network looked like when a graph was built. Comparing one snapshot with the next shows which
+// servers came, went or moved.
+//
+// Snapshots are immutable once published, so every command and hook can share one, along with everything worked
+// out from its topology. Version counts up with every snapshot of a network.
+type snapshot struct {
+	Version uint64    `json:"version"`
+	Taken   time.Time `json:"taken"`
+	Source  string    `json:"source"`
+	// Mode is the graph mode the snapshot was built for. Source differs from it when IRC fell back to ioserv.
+	Mode string `json:"mode"`
+	// Root is the server uplinks are worked out from: the one we are connected to if it is in the graph, otherwise
+	// the one with the most peers
+	Root    string                    `json:"root"`
+	Servers map[string]snapshotServer `json:"servers"`
+
+	// graph is the graph the snapshot was taken from, for hooks that need more than the snapshot itself
+	graph graph
+	topo  *topology
+}
+
+type snapshotServer struct {
+	Name string `json:"name"`
+	ID   string `json:"id"`
+	// Uplink is the next server towards Root, empty for Root itself
+	Uplink string `json:"uplink,omitempty"`
+}
+
+// snapshotHook is called with the previous and current snapshot every time a graph is built. prev is nil for the
+// first snapshot after starting.
+type snapshotHook func(prev, cur *snapshot)
+
+func newSnapshot(g graph, source, selfServer string, taken time.Time) *snapshot {
+	t := newTopology(g)
+	root := t.getServer(selfServer)
+	if root == nil {
+		root = g.mostPeers()
+	}
+
+	s := &snapshot{Taken: taken, Source: source, Servers: make(map[string]snapshotServer, len(g)), graph: g, topo: t}
+	if root == nil {
+		return s
+	}
+
+	s.Root = root.Name
+	uplinks := g.uplinks(root)
+	for _, srv := range g {
+		ss := snapshotServer{Name: srv.Name, ID: srv.ID}
+		if up := uplinks[srv]; up != nil {
+			ss.Uplink = up.Name
+		}
+
+		s.Servers[strings.ToLower(srv.Name)] = ss
+	}
+
+	return s
+}
+
+// uplinks returns the next server towards root for every server that can reach it
+func (g graph) uplinks(root *Server) map[*Server]*Server {
+	out := map[*Server]*Server{root: nil}
+	queue := []*Server{root}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, peer := range cur.Peers {
+			if _, seen := out[peer]; !seen {
+				out[peer] = cur
+				queue = append(queue, peer)
+			}
+		}
+	}
+
+	return out
+}
+
+const (
+	changeGone  = "gone"
+	changeBack  = "back"
+	changeMoved = "moved"
+)
+
+// serverChange is a difference between two snapshots for one server
+type serverChange struct {
+	Kind   string         `json:"kind"`
+	Server snapshotServer `json:"server"`
+	// OldUplink is the uplink before the change, for servers that moved or are gone
+	OldUplink string `json:"old_uplink,omitempty"`
+}
+
+func (c serverChange) String() string {
+	switch c.Kind {
+	case changeGone:
+		return fmt.Sprintf("%s (%s) is gone, it was linked to %s", c.Server.Name, c.Server.ID, orNone(c.OldUplink))
+	case changeBack:
+		return fmt.Sprintf("%s (%s) is back, linked to %s", c.Server.Name, c.Server.ID, orNone(c.Server.Uplink))
+	}
+
+	return fmt.Sprintf("%s (%s) moved from %s to %s", c.Server.Name, c.Server.ID, orNone(c.OldUplink), orNone(c.Server.Uplink))
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "nothing"
+	}
+
+	return s
+}
+
+// diffSnapshots returns what changed between prev and cur, sorted by server name. Snapshots from different sources
+// are not compared, since the sources rarely agree exactly and the differences are not real changes. Uplinks are
+// only compared when both snapshots were rooted at the same server.
+func diffSnapshots(prev, cur *snapshot) []serverChange {
+	out := []serverChange{}
+	if prev == nil || cur == nil || prev.Source != cur.Source {
+		return out
+	}
+
+	for key, old := range prev.Servers {
+		now, exists := cur.Servers[key]
+		switch {
+		case !exists:
+			out = append(out, serverChange{Kind: changeGone, Server: old, OldUplink: old.Uplink})
+		case prev.Root == cur.Root && old.Uplink != now.Uplink:
+			out = append(out, serverChange{Kind: changeMoved, Server: now, OldUplink: old.Uplink})
+		}
+	}
+
+	for key, now := range cur.Servers {
+		if _, existed := prev.Servers[key]; !existed {
+			out = append(out, serverChange{Kind: changeBack, Server: now})
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Server.Name < out[j].Server.Name })
+	return out
+}
+
+// onSnapshot adds a hook that is called every time a graph is built
+func (n *network) onSnapshot(hook snapshotHook) {
+	n.snapshotMutex.Lock()
+	defer n.snapshotMutex.Unlock()
+
+	n.snapshotHooks = append(n.snapshotHooks, hook)
+}
+
+// topology returns the snapshot's graph indexed for analyses. It is shared, as are the results it remembers.
+func (s *snapshot) topology() *topology {
+	return s.topo
+}
+
+// recordSnapshot takes a snapshot of g, publishes it, and passes it to the hooks along with the one before it.
+// Hooks are called one snapshot at a time and in order.
+func (n *network) recordSnapshot(g graph, source, mode string) *snapshot {
+	n.snapshotMutex.Lock()
+	defer n.snapshotMutex.Unlock()
+
+	cur := newSnapshot(g, source, n.selfServer, time.Now())
+	n.version++
+	cur.Version, cur.Mode = n.version, mode
+	prev := n.snapshot
+	n.snapshot = cur
+	n.published.Store(cur)
+
+	for _, hook := range n.snapshotHooks {
+		hook(prev, cur)
+	}
+
+	return cur
+}
+
+func (n *network) setSelfServer(name string) {
+	n.snapshotMutex.Lock()
+	defer n.snapshotMutex.Unlock()
+
+	n.selfServer = name
+}
+
+// poll builds a graph every refresh interval, so that snapshot hooks see changes without anyone running a command
+func (n *network) poll(stop <-chan struct{}) {
+	if n.refresh.Interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(n.refresh.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if _, err := n.refreshSnapshot(); err != nil {
+				n.ircCon.Log.Printf("Scheduled refresh of %s failed: %s", n.name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// maxCachedDistances is how many servers a topology remembers the distances from. Each one costs four bytes per
+// server, so all pairs would be too much for large networks.
+const maxCachedDistances = 256
+
+// topology is a graph flattened onto dense integer indices, for analyses that walk the whole network. Servers are
+// numbered in the order of their keys in the graph, and adjacency is kept in compressed sparse row form, so a
+// breadth first search touches only a few flat slices and allocates nothing once its buffers exist.
+//
+// A topology must not be changed once built, and the graph it was built from must not change either. That lets it
+// remember expensive results, such as eccentricities and centrality, for everyone using the same snapshot.
+type topology struct {
+	g       graph
+	servers []*Server
+	// offsets and adj hold the peers of each server: the peers of server i are adj[offsets[i]:offsets[i+1]].
+	// Self links and duplicate links are left out.
+	offsets []int32
+	adj     []int32
+
+	index  map[*Server]int32
+	byName map[string]int32 // lowercased name
+	byID   map[string]int32
+
+	forest forest
+
+	memoMutex sync.Mutex
+	memos     map[string]*memoEntry
+	distances map[int32][]int32
+}
+
+func newTopology(g graph) *topology {
+	t := &topology{
+		g:       g,
+		servers: g.values(),
+		index:   make(map[*Server]int32, len(g)),
+		byName:  make(map[string]int32, len(g)),
+		byID:    make(map[string]int32, len(g)),
+	}
+
+	for i, srv := range t.servers {
+		t.index[srv] = int32(i)
+		t.byName[strings.ToLower(srv.Name)] = int32(i)
+		if srv.ID != "" {
+			t.byID[srv.ID] = int32(i)
+		}
+	}
+
+	t.offsets = make([]int32, len(t.servers)+1)
+	// added[j] is one more than the last server j was added as a peer of, to skip duplicate links
+	added := make([]int32, len(t.servers))
+	for i, srv := range t.servers {
+		for _, peer := range srv.Peers {
+			j, exists := t.index[peer]
+			if !exists || j == int32(i) || added[j] == int32(i)+1 {
+				continue
+			}
+
+			added[j] = int32(i) + 1
+			t.adj = append(t.adj, j)
+		}
+
+		t.offsets[i+1] = int32(len(t.adj))
+	}
+
+	t.findForest()
+	return t
+}
+
+type memoEntry struct {
+	once  sync.Once
+	value interface{}
+}
+
+// memo returns the result of compute, which is only called the first time key is asked for. Callers asking for
+// the same key at the same time wait for the one computing it. Results are shared, so they must not be changed.
+func (t *topology) memo(key string, compute func() interface{}) interface{} {
+	t.memoMutex.Lock()
+	if t.memos == nil {
+		t.memos = make(map[string]*memoEntry)
+	}
+
+	entry, exists := t.memos[key]
+	if !exists {
+		entry = &memoEntry{}
+		t.memos[key] = entry
+	}
+
+	t.memoMutex.Unlock()
+
+	entry.once.Do(func() { entry.value = compute() })
+	return entry.value
+}
+
+func (t *topology) len() int {
+	return len(t.servers)
+}
+
+// peers returns the indices of the peers of server i
+func (t *topology) peers(i int32) []int32 {
+	return t.adj[t.offsets[i]:t.offsets[i+1]]
+}
+
+// degree returns the number of peers of server i
+func (t *topology) degree(i int32) int {
+	return int(t.offsets[i+1] - t.offsets[i])
+}
+
+// lookup returns the index of a server by its key in the graph, its ID or its name, which is not case sensitive
+func (t *topology) lookup(nameOrID string) (int32, bool) {
+	if srv, exists := t.g[nameOrID]; exists {
+		i, ok := t.index[srv]
+		return i, ok
+	}
+
+	if i, exists := t.byID[nameOrID]; exists {
+		return i, true
+	}
+
+	i, exists := t.byName[strings.ToLower(nameOrID)]
+	return i, exists
+}
+
+// getServer looks up a server like lookup does, returning nil if there is none
+func (t *topology) getServer(nameOrID string) *Server {
+	if i, exists := t.lookup(nameOrID); exists {
+		return t.servers[i]
+	}
+
+	return nil
+}
+
+// bfs fills dist with the number of hops from src to every server, or -1 for servers it cannot reach. dist must
+// have a slot for every server. The servers reached are appended to queue in the order they were found, so the
+// last one is as far as any from src, and the grown queue is returned to be reused.
+func (t *topology) bfs(src int32, dist []int32, queue []int32) []int32 {
+	for i := range dist {
+		dist[i] = -1
+	}
+
+	return t.search(src, dist, queue)
+}
+
+// distancesFrom returns the number of hops from src to every server, by index, with -1 for those it cannot reach.
+// The result may be shared and must not be changed.
+func (t *topology) distancesFrom(src int32) []int32 {
+	t.memoMutex.Lock()
+	dist, cached := t.distances[src]
+	t.memoMutex.Unlock()
+
+	if cached {
+		return dist
+	}
+
+	dist = make([]int32, t.len())
+	t.bfs(src, dist, nil)
+
+	t.memoMutex.Lock()
+	if t.distances == nil {
+		t.distances = make(map[int32][]int32)
+	}
+
+	if len(t.distances) < maxCachedDistances {
+		t.distances[src] = dist
+	}
+
+	t.memoMutex.Unlock()
+	return dist
+}
+
+// distance returns the number of hops between a and b, or -1 if there is no path
+func (t *topology) distance(a, b *Server) int {
+	i, j := t.index[a], t.index[b]
+	if i == j {
+		return 0
+	}
+
+	return int(t.distancesFrom(i)[j])
+}
+
+// path returns the servers on a shortest path from a to b, both included, or nil if there is none
+func (t *topology) path(a, b *Server) []*Server {
+	src, dst := t.index[a], t.index[b]
+	parent := make([]int32, t.len())
+	for i := range parent {
+		parent[i] = -1
+	}
+
+	parent[src] = src
+	queue := []int32{src}
+	for head := 0; head < len(queue) && parent[dst] < 0; head++ {
+		cur := queue[head]
+		for _, peer := range t.peers(cur) {
+			if parent[peer] < 0 {
+				parent[peer] = cur
+				queue = append(queue, peer)
+			}
+		}
+	}
+
+	if parent[dst] < 0 {
+		return nil
+	}
+
+	out := []*Server{}
+	for cur := dst; cur != src; cur = parent[cur] {
+		out = append(out, t.servers[cur])
+	}
+
+	out = append(out, a)
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+
+	return out
+}
+
+// largestDistanceFrom returns the server furthest from source, among those keep allows, and its distance. keep may
+// be nil to allow every server. Ties go to the first server in key order.
+func (t *topology) largestDistanceFrom(source *Server, keep func(*Server) bool) (int, *Server) {
+	src, exists := t.index[source]
+	if !exists {
+		return -1, nil
+	}
+
+	dist := t.distancesFrom(src)
+	best := int32(-1)
+	var bestServer *Server
+	for i, d := range dist {
+		if d > best && (keep == nil || keep(t.servers[i])) {
+			best, bestServer = d, t.servers[i]
+		}
+	}
+
+	return int(best), bestServer
+}
+
+// diameter returns the largest distance between two servers that keep allows, and the servers at either end. keep
+// may be nil to allow every server, and that result is remembered. The distance is -1 if there are no servers to
+// compare.
+func (t *topology) diameter(keep func(*Server) bool) (int, *Server, *Server) {
+	if keep != nil {
+		return t.findDiameter(keep, keep)
+	}
+
+	d := t.memo("diameter", func() interface{} {
+		d, one, two := t.findDiameter(nil, nil)
+		return diameterResult{d, one, two}
+	}).(diameterResult)
+
+	return d.hops, d.one, d.two
+}
+
+// diameterFrom is diameter where only one end of the path has to be allowed by from as well as by keep. Either may
+// be nil to allow every server. The end from allows is returned first.
+func (t *topology) diameterFrom(from, keep func(*Server) bool) (int, *Server, *Server) {
+	return t.findDiameter(from, keep)
+}
+
+type diameterResult struct {
+	hops     int
+	one, two *Server
+}
+
+// findDiameter works out what diameter and diameterFrom return. Trees take linear time, anything else searches from
+// every server from allows.
+func (t *topology) findDiameter(from, keep func(*Server) bool) (int, *Server, *Server) {
+	kept := make([]bool, t.len())
+	starts := make([]bool, t.len())
+	for i, srv := range t.servers {
+		kept[i] = keep == nil || keep(srv)
+		starts[i] = kept[i] && (from == nil || from(srv))
+	}
+
+	if t.acyclic() {
+		return t.forestDiameter(starts, kept)
+	}
+
+	best := int32(-1)
+	var one, two *Server
+	dist := make([]int32, t.len())
+	var queue []int32
+	for i := range t.servers {
+		if !starts[i] {
+			continue
+		}
+
+		queue = t.bfs(int32(i), dist, queue)
+		for _, j := range queue {
+			if dist[j] > best && kept[j] {
+				best, one, two = dist[j], t.servers[i], t.servers[j]
+			}
+		}
+	}
+
+	return int(best), one, two
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var benchmarkSizes = []int{100, 1000, 5000}
+
+// generateNetwork builds a network of n servers shaped like a real one: a spanning tree where most servers hang off
+// a few hubs, plus extra links that add cycles. It returns the LINKS and MAP lines graphFromLinksAndMap takes.
+func generateNetwork(n, extra int, seed int64) (links [][]string, sMap []string) {
+	rng := rand.New(rand.NewSource(seed))
+	name := func(i int) string { return fmt.Sprintf("irc%d.example.net", i) }
+
+	for i := 0; i < n; i++ {
+		sMap = append(sMap, fmt.Sprintf("%s ---- | Users: %d (1.0%%) [%03X]", name(i), rng.Intn(500), i))
+	}
+
+	hubs := n/50 + 1
+	for i := 1; i < n; i++ {
+		// Hubs link to each other, everything else mostly links to a hub
+		parent := rng.Intn(i)
+		if i >= hubs && rng.Intn(4) > 0 {
+			parent = rng.Intn(hubs)
+		}
+
+		links = append(links, []string{name(i), name(parent), "generated server"})
+	}
+
+	for i := 0; i < extra && n > 1; i++ {
+		a, b := rng.Intn(n), rng.Intn(n)
+		if a != b {
+			links = append(links, []string{name(a), name(b), "generated server"})
+		}
+	}
+
+	return links, sMap
+}
+
+// silenceLog drops log output until tb ends, as building a graph logs every line of MAP and LINKS
+func silenceLog(tb testing.TB) {
+	out := log.Writer()
+	log.SetOutput(ioutil.Discard)
+	tb.Cleanup(func() { log.SetOutput(out) })
+}
+
+func generateGraph(tb testing.TB, n, extra int) graph {
+	tb.Helper()
+
+	links, sMap := generateNetwork(n, extra, int64(n))
+	return buildGeneratedGraph(tb, links, sMap)
+}
+
+func buildGeneratedGraph(tb testing.TB, links [][]string, sMap []string) graph {
+	tb.Helper()
+
+	g, err := graphFromLinksAndMap(links, sMap, func(names []string) map[string]string {
+		tb.Fatalf("servers missing from MAP: %s", strings.Join(names, ", "))
+		return nil
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return g
+}
+
+// testGraph is a generated network for checking the topology against a plain search
+type testGraph struct {
+	name string
+	g    graph
+}
+
+// testGraphs returns trees, forests and graphs with cycles of a few sizes. Around a third of the servers have a
+// description starting with ~.
+func testGraphs(t *testing.T) []testGraph {
+	t.Helper()
+	silenceLog(t)
+
+	out := []testGraph{}
+	for _, n := range []int{1, 2, 3, 10, 60} {
+		for seed := int64(0); seed < 4; seed++ {
+			for _, shape := range []struct {
+				name    string
+				extra   int
+				dropped int
+			}{{"tree", 0, 0}, {"forest", 0, n / 5}, {"cycles", n / 4, 0}, {"cyclic forest", n / 4, n / 5}} {
+				links, sMap := generateNetwork(n, shape.extra, seed)
+				// Servers whose only link is dropped are still in MAP, so they are left on their own
+				links = links[shape.dropped:]
+				g := buildGeneratedGraph(t, links, sMap)
+
+				rng := rand.New(rand.NewSource(seed))
+				for _, key := range g.keys() {
+					if rng.Intn(3) == 0 {
+						g[key].Description = "~" + g[key].Description
+					}
+				}
+
+				out = append(out, testGraph{fmt.Sprintf("%s/%d/%d", shape.name, n, seed), g})
+			}
+		}
+	}
+
+	return out
+}
+
+// bruteDistances finds the distance from src to every server it can reach by following peers, without the topology
+func bruteDistances(src *Server) map[*Server]int {
+	dist := map[*Server]int{src: 0}
+	queue := []*Server{src}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, peer := range cur.Peers {
+			if _, seen := dist[peer]; !seen {
+				dist[peer] = dist[cur] + 1
+				queue = append(queue, peer)
+			}
+		}
+	}
+
+	return dist
+}
+
+func notTilde(srv *Server) bool { return !strings.HasPrefix(srv.Description, "~") }
+
+// bruteDiameter is the largest distance from a server from and keep allow to one keep allows
+func bruteDiameter(g graph, from, keep func(*Server) bool) int {
+	best := -1
+	for _, a := range g {
+		if !keep(a) || !from(a) {
+			continue
+		}
+
+		for b, d := range bruteDistances(a) {
+			if keep(b) && d > best {
+				best = d
+			}
+		}
+	}
+
+	return best
+}
+
+func TestTopologyMatchesSearch(t *testing.T) {
+	all := func(*Server) bool { return true }
+	for _, tg := range testGraphs(t) {
+		g, top := tg.g, newTopology(tg.g)
+		servers := g.values()
+		odd := func(srv *Server) bool { return srv.ID[len(srv.ID)-1]%2 == 1 }
+
+		for _, tt := range []struct {
+			name       string
+			from, keep func(*Server) bool
+		}{{"all", all, all}, {"not ~", notTilde, notTilde}, {"one end not ~", notTilde, all}, {"odd IDs", notTilde, odd}} {
+			want := bruteDiameter(g, tt.from, tt.keep)
+			var hops int
+			var one, two *Server
+			if tt.name == "all" {
+				hops, one, two = top.diameter(nil)
+			} else {
+				hops, one, two = top.diameterFrom(tt.from, tt.keep)
+			}
+
+			if hops != want {
+				t.Errorf("%s: diameter of %s is %d, want %d", tg.name, tt.name, hops, want)
+				continue
+			}
+
+			if hops >= 0 && (!tt.from(one) || !tt.keep(one) || !tt.keep(two) || bruteDistances(one)[two] != hops) {
+				t.Errorf("%s: diameter of %s is %d between %s and %s, which do not fit", tg.name, tt.name, hops,
+					one.NameID(), two.NameID())
+			}
+		}
+
+		if hops, _, _ := top.diameter(notTilde); hops != bruteDiameter(g, notTilde, notTilde) {
+			t.Errorf("%s: diameter between servers without ~ is %d, want %d", tg.name, hops, bruteDiameter(g, notTilde, notTilde))
+		}
+
+		for _, a := range servers {
+			dist := bruteDistances(a)
+			want := 0
+			for _, d := range dist {
+				if d > want {
+					want = d
+				}
+			}
+
+			if hops, far := top.largestDistanceFrom(a, nil); hops != want || dist[far] != want {
+				t.Errorf("%s: furthest from %s is %d hops, want %d", tg.name, a.NameID(), hops, want)
+			}
+
+			for _, b := range servers {
+				want, reachable := dist[b]
+				if !reachable {
+					want = -1
+				}
+
+				if got := top.distance(a, b); got != want {
+					t.Errorf("%s: %s to %s is %d hops, want %d", tg.name, a.NameID(), b.NameID(), got, want)
+				}
+
+				checkPath(t, tg.name, top.path(a, b), a, b, want)
+			}
+		}
+	}
+}
+
+// checkPath fails if path is not a shortest path of hops from a to b, or if it is not nil when there is none
+func checkPath(t *testing.T, name string, path []*Server, a, b *Server, hops int) {
+	t.Helper()
+
+	if hops < 0 {
+		if path != nil {
+			t.Errorf("%s: got a path from %s to %s, which are not connected", name, a.NameID(), b.NameID())
+		}
+
+		return
+	}
+
+	if len(path) != hops+1 || path[0] != a || path[len(path)-1] != b {
+		t.Errorf("%s: path from %s to %s has %d servers, want %d", name, a.NameID(), b.NameID(), len(path), hops+1)
+		return
+	}
+
+	for i := 1; i < len(path); i++ {
+		if !path[i-1].HasPeer(path[i]) {
+			t.Errorf("%s: path from %s to %s jumps from %s to %s", name, a.NameID(), b.NameID(), path[i-1].NameID(), path[i].NameID())
+		}
+	}
+}
+
+// benchmarkGraphs runs f against a tree and a graph with cycles of every size
+func benchmarkGraphs(b *testing.B, f func(b *testing.B, g graph)) {
+	for _, n := range benchmarkSizes {
+		for _, shape := range []struct {
+			name  string
+			extra int
+		}{{"tree", 0}, {"cycles", n / 20}} {
+			g := generateGraph(b, n, shape.extra)
+			b.Run(fmt.Sprintf("%s/%d", shape.name, n), func(b *testing.B) {
+				b.ReportAllocs()
+				f(b, g)
+			})
+		}
+	}
+}
+
+func BenchmarkGraphFromLinksAndMap(b *testing.B) {
+	silenceLog(b)
+	for _, n := range benchmarkSizes {
+		links, sMap := generateNetwork(n, n/20, int64(n))
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := graphFromLinksAndMap(links, sMap, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkNewTopology(b *testing.B) {
+	silenceLog(b)
+	benchmarkGraphs(b, func(b *testing.B, g graph) {
+		for i := 0; i < b.N; i++ {
+			newTopology(g)
+		}
+	})
+}
+
+func BenchmarkDiameter(b *testing.B) {
+	silenceLog(b)
+	benchmarkGraphs(b, func(b *testing.B, g graph) {
+		t := newTopology(g)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			t.diameter(nil)
+		}
+	})
+}
+
+func BenchmarkLargestDistanceFrom(b *testing.B) {
+	silenceLog(b)
+	benchmarkGraphs(b, func(b *testing.B, g graph) {
+		t := newTopology(g)
+		from := t.servers[t.len()-1]
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			t.largestDistanceFrom(from, nil)
+		}
+	})
+}
+
+func BenchmarkBiggestHop(b *testing.B) {
+	silenceLog(b)
+	a, _ := findAnalysis("biggesthop")
+	benchmarkGraphs(b, func(b *testing.B, g graph) {
+		for i := 0; i < b.N; i++ {
+			res := runAnalysis(a, newTopology(g), &commandArgs{values: map[string]interface{}{}}, log.New(ioutil.Discard, "", 0))
+			if !res.OK {
+				b.Fatal(res.Error)
+			}
+		}
+	})
+}
+
+func BenchmarkShowHopsBetween(b *testing.B) {
+	silenceLog(b)
+	a, _ := findAnalysis("showhopsbetween")
+	benchmarkGraphs(b, func(b *testing.B, g graph) {
+		t := newTopology(g)
+		from, to := t.servers[0].Name, t.servers[t.len()-1].Name
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			args := &commandArgs{values: map[string]interface{}{"a": serverName(from), "b": serverName(to)}}
+			if res := runAnalysis(a, t, args, log.New(ioutil.Discard, "", 0)); !res.OK {
+				b.Fatal(res.Error)
+			}
+		}
+	})
+}
+
+// bruteReach returns every server src can reach without passing through avoid, which may be nil
+func bruteReach(src, avoid *Server) map[*Server]bool {
+	out := map[*Server]bool{src: true}
+	queue := []*Server{src}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, peer := range cur.Peers {
+			if peer != avoid && !out[peer] {
+				out[peer] = true
+				queue = append(queue, peer)
+			}
+		}
+	}
+
+	return out
+}
+
+// bruteParts returns the sizes of the parts srv's component falls into without it, the largest first
+func bruteParts(srv *Server) []int {
+	out := []int{}
+	seen := map[*Server]bool{}
+	for _, peer := range srv.Peers {
+		if peer == srv || seen[peer] {
+			continue
+		}
+
+		part := bruteReach(peer, srv)
+		for s := range part {
+			seen[s] = true
+		}
+
+		out = append(out, len(part))
+	}
+
+	sort.Sort(sort.Reverse(sort.IntSlice(out)))
+	return out
+}
+
+// TestTreeAlgorithms checks the linear time tree algorithms, and the general ones used when there are cycles,
+// against plain searches from every server
+func TestTreeAlgorithms(t *testing.T) {
+	for _, tg := range testGraphs(t) {
+		g, top := tg.g, newTopology(tg.g)
+		servers := g.values()
+
+		// A forest has one link fewer than servers in each component
+		links := map[[2]*Server]bool{}
+		components := map[*Server]map[*Server]bool{}
+		largest := 0
+		for _, srv := range servers {
+			for _, peer := range srv.Peers {
+				if srv != peer && !links[[2]*Server{peer, srv}] {
+					links[[2]*Server{srv, peer}] = true
+				}
+			}
+
+			components[srv] = bruteReach(srv, nil)
+			if len(components[srv]) > largest {
+				largest = len(components[srv])
+			}
+		}
+
+		roots := map[*Server]bool{}
+		for _, srv := range servers {
+			root := srv
+			for s := range components[srv] {
+				if s.ID < root.ID {
+					root = s
+				}
+			}
+
+			roots[root] = true
+		}
+
+		acyclic := len(links) == len(servers)-len(roots)
+		if top.acyclic() != acyclic || len(top.forest.roots) != len(roots) {
+			t.Fatalf("%s: acyclic %v with %d components, want %v with %d", tg.name, top.acyclic(), len(top.forest.roots),
+				acyclic, len(roots))
+		}
+
+		res := &commandResult{}
+		if top.warnCycles(res); (len(res.Warnings) > 0) == acyclic {
+			t.Errorf("%s: got warnings %q for a network that is acyclic: %v", tg.name, res.Warnings, acyclic)
+		}
+
+		ecc := top.eccentricities()
+		for _, srv := range servers {
+			want := 0
+			for _, d := range bruteDistances(srv) {
+				if d > want {
+					want = d
+				}
+			}
+
+			if got := ecc[top.index[srv]]; int(got) != want {
+				t.Errorf("%s: eccentricity of %s is %d, want %d", tg.name, srv.NameID(), got, want)
+			}
+		}
+
+		centers := top.centers(ecc)
+		if len(centers) == 0 {
+			t.Fatalf("%s: no centers", tg.name)
+		}
+
+		component := components[centers[0]]
+		radius := -1
+		for s := range component {
+			if e := int(ecc[top.index[s]]); radius < 0 || e < radius {
+				radius = e
+			}
+		}
+
+		wantCenters := 0
+		for s := range component {
+			if int(ecc[top.index[s]]) == radius {
+				wantCenters++
+			}
+		}
+
+		if len(component) != largest || len(centers) != wantCenters {
+			t.Errorf("%s: %d centers in a component of %d, want %d in one of %d", tg.name, len(centers), len(component),
+				wantCenters, largest)
+		}
+
+		for _, c := range centers {
+			if !component[c] || int(ecc[top.index[c]]) != radius {
+				t.Errorf("%s: center %s is not at the radius %d of the largest component", tg.name, c.NameID(), radius)
+			}
+		}
+
+		if acyclic {
+			checkForest(t, tg.name, top, servers, largest)
+		} else if _, _, ok := top.centroid(); ok {
+			t.Errorf("%s: got a centroid for a network with cycles", tg.name)
+		}
+	}
+}
+
+// checkForest checks subtree sizes, branches and the centroid of an acyclic topology
+func checkForest(t *testing.T, name string, top *topology, servers []*Server, largest int) {
+	t.Helper()
+
+	sizes := top.subtreeSizes()
+	for _, srv := range servers {
+		i := top.index[srv]
+		var parent *Server
+		if p := top.forest.parent[i]; p >= 0 {
+			parent = top.servers[p]
+		}
+
+		if want := len(bruteReach(srv, parent)); int(sizes[i]) != want {
+			t.Errorf("%s: %d servers below %s, want %d", name, sizes[i], srv.NameID(), want)
+		}
+
+		if got, want := top.branches(i, sizes), bruteParts(srv); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: branches of %s are %v, want %v", name, srv.NameID(), got, want)
+		}
+	}
+
+	srv, part, ok := top.centroid()
+	if !ok || len(bruteReach(srv, nil)) != largest {
+		t.Fatalf("%s: centroid %v is not in the largest tree", name, srv)
+	}
+
+	want := -1
+	for s := range bruteReach(srv, nil) {
+		parts := append(bruteParts(s), 0)
+		if want < 0 || parts[0] < want {
+			want = parts[0]
+		}
+	}
+
+	if part != want || part > largest/2 {
+		t.Errorf("%s: centroid %s leaves a part of %d, want %d", name, srv.NameID(), part, want)
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// IRC networks are spanning trees, so most analyses have linear time answers. Every topology records a spanning
+// forest of itself when it is built, and the links left over, which close cycles. With none left over the tree
+// algorithms below are used, otherwise the general ones in topology.go.
+
+// forest is a breadth first spanning forest of a topology
+type forest struct {
+	// roots holds the first server of each connected component, the largest component first
+	roots []int32
+	// component is the index into roots of each server's component. starts and sizes give where each component's
+	// servers are in order, and how many there are.
+	component []int32
+	starts    []int32
+	sizes     []int32
+	// parent is each server's parent in the forest, -1 for roots
+	parent []int32
+	// order lists servers component by component, each in breadth first order from its root
+	order []int32
+	// extra are the links that are not part of the forest. Each one closes a cycle.
+	extra [][2]int32
+}
+
+// findForest fills in t.forest. It is called once by newTopology.
+func (t *topology) findForest() {
+	n := t.len()
+	f := forest{component: make([]int32, n), parent: make([]int32, n), order: make([]int32, 0, n)}
+	for i := range f.component {
+		f.component[i] = -1
+	}
+
+	for root := int32(0); root < int32(n); root++ {
+		if f.component[root] >= 0 {
+			continue
+		}
+
+		c := int32(len(f.roots))
+		f.roots = append(f.roots, root)
+		f.component[root], f.parent[root] = c, -1
+		start := len(f.order)
+		f.order = append(f.order, root)
+		for head := start; head < len(f.order); head++ {
+			cur := f.order[head]
+			for _, peer := range t.peers(cur) {
+				if f.component[peer] < 0 {
+					f.component[peer], f.parent[peer] = c, cur
+					f.order = append(f.order, peer)
+				}
+			}
+		}
+
+		f.starts = append(f.starts, int32(start))
+		f.sizes = append(f.sizes, int32(len(f.order)-start))
+	}
+
+	for i := int32(0); i < int32(n); i++ {
+		for _, peer := range t.peers(i) {
+			if i < peer && f.parent[peer] != i && f.parent[i] != peer {
+				f.extra = append(f.extra, [2]int32{i, peer})
+			}
+		}
+	}
+
+	// The largest component is the network itself, anything else is usually a stray link in the data
+	if len(f.roots) > 1 {
+		byComponent := make([]int32, len(f.roots))
+		for i := range byComponent {
+			byComponent[i] = int32(i)
+		}
+
+		sort.SliceStable(byComponent, func(i, j int) bool { return f.sizes[byComponent[i]] > f.sizes[byComponent[j]] })
+		renumber := make([]int32, len(f.roots))
+		roots, starts, sizes := make([]int32, len(f.roots)), make([]int32, len(f.roots)), make([]int32, len(f.roots))
+		for newC, oldC := range byComponent {
+			renumber[oldC] = int32(newC)
+			roots[newC], starts[newC], sizes[newC] = f.roots[oldC], f.starts[oldC], f.sizes[oldC]
+		}
+
+		for i := range f.component {
+			f.component[i] = renumber[f.component[i]]
+		}
+
+		f.roots, f.starts, f.sizes = roots, starts, sizes
+	}
+
+	t.forest = f
+}
+
+// acyclic reports whether the topology is a tree, or several trees if it is not connected
+func (t *topology) acyclic() bool {
+	return len(t.forest.extra) == 0
+}
+
+// isTree reports whether the topology is a single tree
+func (t *topology) isTree() bool {
+	return t.acyclic() && len(t.forest.roots) <= 1
+}
+
+// cycleLinks returns the links that close cycles, as pairs of servers. Which link of a cycle is named depends on
+// the order servers were found in, so these show where the cycles are rather than which link is wrong.
+func (t *topology) cycleLinks() [][2]*Server {
+	out := make([][2]*Server, 0, len(t.forest.extra))
+	for _, l := range t.forest.extra {
+		out = append(out, [2]*Server{t.servers[l[0]], t.servers[l[1]]})
+	}
+
+	return out
+}
+
+// search is bfs without resetting dist first: every server src can reach must have a distance of -1
+func (t *topology) search(src int32, dist []int32, queue []int32) []int32 {
+	dist[src] = 0
+	queue = append(queue[:0], src)
+	for head := 0; head < len(queue); head++ {
+		cur := queue[head]
+		for _, peer := range t.peers(cur) {
+			if dist[peer] < 0 {
+				dist[peer] = dist[cur] + 1
+				queue = append(queue, peer)
+			}
+		}
+	}
+
+	return queue
+}
+
+// farthest returns the first server in queue that is furthest away by dist among those kept, or -1 if none are
+func farthest(queue, dist []int32, kept []bool) int32 {
+	best := int32(-1)
+	for _, i := range queue {
+		if kept[i] && (best < 0 || dist[i] > dist[best]) {
+			best = i
+		}
+	}
+
+	return best
+}
+
+// forestDiameter finds the diameter of each tree with two searches, the first from any kept server and the second
+// from the kept server furthest from it. In a tree, the kept server furthest from any other is always at one end of
+// a longest path between kept servers, so a third search from the other end gives how far the furthest kept server
+// is from each of starts.
+func (t *topology) forestDiameter(starts, kept []bool) (int, *Server, *Server) {
+	fromEnd := make([]int32, t.len())
+	fromOther := make([]int32, t.len())
+	for i := range fromEnd {
+		fromEnd[i], fromOther[i] = -1, -1
+	}
+
+	best := int32(-1)
+	var one, two *Server
+	var queue []int32
+	reset := func() {
+		for _, i := range queue {
+			fromEnd[i], fromOther[i] = -1, -1
+		}
+	}
+
+	for c := range t.forest.roots {
+		start := int32(-1)
+		for _, i := range t.componentServers(c) {
+			if kept[i] {
+				start = i
+				break
+			}
+		}
+
+		if start < 0 {
+			continue
+		}
+
+		queue = t.search(start, fromEnd, queue)
+		end := farthest(queue, fromEnd, kept)
+		reset()
+
+		queue = t.search(end, fromEnd, queue)
+		other := farthest(queue, fromEnd, kept)
+		queue = t.search(other, fromOther, queue)
+		for _, i := range queue {
+			if !starts[i] {
+				continue
+			}
+
+			if fromEnd[i] > best {
+				best, one, two = fromEnd[i], t.servers[i], t.servers[end]
+			}
+
+			if fromOther[i] > best {
+				best, one, two = fromOther[i], t.servers[i], t.servers[other]
+			}
+		}
+
+		reset()
+	}
+
+	return int(best), one, two
+}
+
+// componentServers returns the servers in component c, in breadth first order from its root
+func (t *topology) componentServers(c int) []int32 {
+	start := t.forest.starts[c]
+	return t.forest.order[start : start+t.forest.sizes[c]]
+}
+
+// eccentricities returns how far each server is from the server furthest from it. The result is remembered and
+// must not be changed.
+func (t *topology) eccentricities() []int32 {
+	return t.memo("eccentricities", func() interface{} { return t.findEccentricities() }).([]int32)
+}
+
+// findEccentricities works out what eccentricities returns. In a tree that is the further of the two ends of a
+// longest path, so three searches per tree are enough, otherwise every server is searched from.
+func (t *topology) findEccentricities() []int32 {
+	out := make([]int32, t.len())
+	if !t.acyclic() {
+		dist := make([]int32, t.len())
+		var queue []int32
+		for i := range out {
+			queue = t.bfs(int32(i), dist, queue)
+			out[i] = dist[queue[len(queue)-1]]
+		}
+
+		return out
+	}
+
+	fromRoot := make([]int32, t.len())
+	fromEnd := make([]int32, t.len())
+	fromOther := make([]int32, t.len())
+	for i := range out {
+		fromRoot[i], fromEnd[i], fromOther[i] = -1, -1, -1
+	}
+
+	var queue []int32
+	for _, root := range t.forest.roots {
+		queue = t.search(root, fromRoot, queue)
+		end := queue[len(queue)-1]
+		queue = t.search(end, fromEnd, queue)
+		other := queue[len(queue)-1]
+		queue = t.search(other, fromOther, queue)
+		for _, i := range queue {
+			out[i] = fromEnd[i]
+			if fromOther[i] > out[i] {
+				out[i] = fromOther[i]
+			}
+		}
+	}
+
+	return out
+}
+
+// centers returns the servers in the largest component with the smallest eccentricity, those every other server
+// is closest to at worst. A tree has one or two.
+func (t *topology) centers(ecc []int32) []*Server {
+	if t.len() == 0 {
+		return nil
+	}
+
+	best := int32(-1)
+	out := []*Server{}
+	for _, i := range t.componentServers(0) {
+		switch {
+		case best < 0 || ecc[i] < best:
+			best, out = ecc[i], []*Server{t.servers[i]}
+		case ecc[i] == best:
+			out = append(out, t.servers[i])
+		}
+	}
+
+	return out
+}
+
+// subtreeSizes returns how many servers are below each server, itself included, when each tree hangs from its root
+func (t *topology) subtreeSizes() []int32 {
+	out := make([]int32, t.len())
+	for k := len(t.forest.order) - 1; k >= 0; k-- {
+		i := t.forest.order[k]
+		out[i]++
+		if p := t.forest.parent[i]; p >= 0 {
+			out[p] += out[i]
+		}
+	}
+
+	return out
+}
+
+// branches returns the sizes of the parts server i's component falls into without it, the largest first. Only
+// meaningful for acyclic topologies.
+func (t *topology) branches(i int32, sizes []int32) []int {
+	out := []int{}
+	for _, peer := range t.peers(i) {
+		if t.forest.parent[peer] == i {
+			out = append(out, int(sizes[peer]))
+		}
+	}
+
+	if up := int(t.forest.sizes[t.forest.component[i]] - sizes[i]); up > 0 {
+		out = append(out, up)
+	}
+
+	sort.Sort(sort.Reverse(sort.IntSlice(out)))
+	return out
+}
+
+// centroid returns the server in the largest tree whose removal leaves the smallest largest part, and the size of
+// that part. It is where a tree is most evenly split, and is never more than half the tree. ok is false if the
+// topology has cycles.
+func (t *topology) centroid() (srv *Server, largest int, ok bool) {
+	if !t.acyclic() || t.len() == 0 {
+		return nil, 0, false
+	}
+
+	sizes := t.subtreeSizes()
+	best := int32(-1)
+	for _, i := range t.componentServers(0) {
+		parts := t.branches(i, sizes)
+		part := 0
+		if len(parts) > 0 {
+			part = parts[0]
+		}
+
+		if best < 0 || part < largest {
+			best, largest = i, part
+		}
+	}
+
+	return t.servers[best], largest, true
+}
+
+// warnCycles adds a warning to res if the topology has cycles, as IRC networks do not, so LINKS is probably wrong
+func (t *topology) warnCycles(res *commandResult) {
+	extra := t.cycleLinks()
+	if len(extra) == 0 {
+		return
+	}
+
+	res.warn(
+		"the network has %d more links than a tree would, such as %s <-> %s, so LINKS is probably wrong",
+		len(extra), extra[0][0].Name, extra[0][1].Name,
+	)
+}
+
+type treeResult struct {
+	Tree       bool         `json:"tree"`
+	Servers    int          `json:"servers"`
+	Links      int          `json:"links"`
+	Components int          `json:"components"`
+	Centers    []serverRef  `json:"centers"`
+	Radius     int          `json:"radius"`
+	Centroid   *serverRef   `json:"centroid,omitempty"`
+	Branches   []int        `json:"centroid_branches,omitempty"`
+	CycleLinks [][2]string  `json:"cycle_links"`
+	Diameter   int          `json:"diameter"`
+	Ends       [2]serverRef `json:"diameter_ends"`
+}
+
+// treeShape reports whether the network is a tree, where its centre is, and which links close cycles if any
+func treeShape(top *topology, _ *commandArgs) (*commandResult, error) {
+	if top.len() == 0 {
+		return nil, fmt.Errorf("graph is empty")
+	}
+
+	ecc := top.eccentricities()
+	centers := top.centers(ecc)
+	d, one, two := top.diameter(nil)
+	out := treeResult{
+		Tree:       top.isTree(),
+		Servers:    top.len(),
+		Links:      len(top.adj) / 2,
+		Components: len(top.forest.roots),
+		Centers:    []serverRef{},
+		Radius:     int(ecc[top.index[centers[0]]]),
+		CycleLinks: [][2]string{},
+		Diameter:   d,
+		Ends:       [2]serverRef{one.ref(), two.ref()},
+	}
+
+	names := []string{}
+	for _, srv := range centers {
+		out.Centers = append(out.Centers, srv.ref())
+		names = append(names, srv.NameID())
+	}
+
+	for _, l := range top.cycleLinks() {
+		out.CycleLinks = append(out.CycleLinks, [2]string{l[0].Name, l[1].Name})
+	}
+
+	lines := []string{}
+	switch {
+	case out.Tree:
+		lines = append(lines, fmt.Sprintf("The network is a tree of %d servers, %d hops across", out.Servers, d))
+	case top.acyclic():
+		lines = append(lines, fmt.Sprintf(
+			"The network is split into %d trees, the largest with %d servers", out.Components, top.forest.sizes[0],
+		))
+	default:
+		links := []string{}
+		for _, l := range out.CycleLinks {
+			links = append(links, l[0]+" <-> "+l[1])
+		}
+
+		lines = append(lines, fmt.Sprintf(
+			"The network has %d servers but %d links, %d more than a tree would, so LINKS is probably wrong. Links closing cycles: %s",
+			out.Servers, out.Links, len(links), strings.Join(links, ", "),
+		))
+	}
+
+	lines = append(lines, fmt.Sprintf("Centre: %s, at most %d hops from everything", strings.Join(names, " and "), out.Radius))
+	if srv, largest, ok := top.centroid(); ok {
+		ref := srv.ref()
+		out.Centroid = &ref
+		out.Branches = top.branches(top.index[srv], top.subtreeSizes())
+		lines = append(lines, fmt.Sprintf(
+			"Centroid: %s, losing it would leave no part bigger than %d servers (%d branches)",
+			srv.NameID(), largest, len(out.Branches),
+		))
+	}
+
+	return newResult(out, lines...), nil
+}
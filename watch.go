@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	irc "github.com/thoj/go-ircevent"
+)
+
+const (
+	defaultWatchFile = "watches.json"
+	watchViaPM       = "pm"
+	watchViaNotice   = "notice"
+	watchViaChannel  = "channel"
+)
+
+type watchConfig struct {
+	// File is where watches are saved so they survive restarts
+	File string `toml:"file"`
+	// Channel is where watches made with --via channel are announced
+	Channel string `toml:"channel"`
+}
+
+// watch asks for Subscriber to be told when Server leaves, returns to, or moves around Network. Subscriber is a nick
+// on From, which is where alerts go, and Account is the services account they were logged in to, if any.
+type watch struct {
+	Network    string `json:"network"`
+	Server     string `json:"server"`
+	Subscriber string `json:"subscriber"`
+	From       string `json:"from,omitempty"`
+	Account    string `json:"account,omitempty"`
+	Via        string `json:"via"`
+}
+
+// home returns the network the subscriber is on. Watches saved before From existed were made on Network.
+func (w watch) home() string {
+	if w.From == "" {
+		return w.Network
+	}
+
+	return w.From
+}
+
+// target returns where alerts for w are sent
+func (w watch) target(channel string) string {
+	if w.Via == watchViaChannel {
+		return channel
+	}
+
+	return w.Subscriber
+}
+
+// ownedBy reports whether w was made by nick on network while logged in to account
+func (w watch) ownedBy(network, nick, account string) bool {
+	return w.home() == network && strings.EqualFold(w.Subscriber, nick) && strings.EqualFold(w.Account, account)
+}
+
+func (w watch) same(other watch) bool {
+	return w.Network == other.Network && strings.EqualFold(w.Server, other.Server) &&
+		other.ownedBy(w.home(), w.Subscriber, w.Account)
+}
+
+// watchStore holds every watch, saved to a file after each change
+type watchStore struct {
+	file string
+
+	mu      sync.Mutex
+	watches []watch
+}
+
+func newWatchStore(file string) (*watchStore, error) {
+	s := &watchStore{file: file}
+	if err := s.load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("could not load watches from %q: %w", file, err)
+	}
+
+	return s, nil
+}
+
+func (s *watchStore) load() error {
+	if s.file == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return json.Unmarshal(data, &s.watches)
+}
+
+func (s *watchStore) save() error {
+	if s.file == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	data, err := json.MarshalIndent(s.watches, "", "\t")
+	s.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(s.file, data, 0o600)
+}
+
+// add adds w, or updates how an existing watch for the same server and subscriber is delivered
+func (s *watchStore) add(w watch) error {
+	s.mu.Lock()
+	found := false
+	for i := range s.watches {
+		if s.watches[i].same(w) {
+			s.watches[i].Via = w.Via
+			found = true
+		}
+	}
+
+	if !found {
+		s.watches = append(s.watches, w)
+	}
+
+	s.mu.Unlock()
+
+	return s.save()
+}
+
+// remove removes the watches owner made on network for server, or all of them if server is empty, and returns how
+// many were removed
+func (s *watchStore) remove(network string, owner watch, server string) (int, error) {
+	s.mu.Lock()
+	out := []watch{}
+	for _, w := range s.watches {
+		matches := w.Network == network && w.ownedBy(owner.home(), owner.Subscriber, owner.Account) &&
+			(server == "" || strings.EqualFold(w.Server, server))
+		if !matches {
+			out = append(out, w)
+		}
+	}
+
+	removed := len(s.watches) - len(out)
+	s.watches = out
+	s.mu.Unlock()
+
+	if removed == 0 {
+		return 0, nil
+	}
+
+	return removed, s.save()
+}
+
+// list returns the watches on network matching keep
+func (s *watchStore) list(network string, keep func(watch) bool) []watch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := []watch{}
+	for _, w := range s.watches {
+		if w.Network == network && keep(w) {
+			out = append(out, w)
+		}
+	}
+
+	return out
+}
+
+// notifyWatchers returns the snapshot hook that tells watchers on n about changes to the servers they watch
+func (b *bot) notifyWatchers(n *network) snapshotHook {
+	return func(prev, cur *snapshot) {
+		type delivery struct {
+			network string
+			target  string
+			notice  bool
+		}
+
+		lines := make(map[delivery][]string)
+		sent := make(map[delivery]map[string]bool)
+		for _, change := range diffSnapshots(prev, cur) {
+			change := change
+			watchers := b.watches.list(n.name, func(w watch) bool { return strings.EqualFold(w.Server, change.Server.Name) })
+			for _, w := range watchers {
+				d := delivery{network: w.home(), target: w.target(b.cfg.Watch.Channel), notice: w.Via == watchViaNotice}
+				line := fmt.Sprintf("Watch on %s: %s", n.name, change)
+				// Everyone watching a server through the channel gets a single announcement
+				if d.target == "" || sent[d][line] {
+					continue
+				}
+
+				if sent[d] == nil {
+					sent[d] = make(map[string]bool)
+				}
+
+				sent[d][line] = true
+				lines[d] = append(lines[d], line)
+			}
+		}
+
+		// Sending is rate limited, which must not hold up whoever built the graph
+		for d, l := range lines {
+			home, exists := b.networks[d.network]
+			if !exists {
+				n.ircCon.Log.Printf("Dropping watch alerts for %s: network %s is not configured", d.target, d.network)
+				continue
+			}
+
+			if d.notice {
+				go home.output.notice(d.target, l)
+			} else {
+				go home.output.send(d.target, l)
+			}
+		}
+	}
+}
+
+// subscriber returns the watch owner behind e, which may be watching servers on n from another network
+func (b *bot) subscriber(n *network, e *irc.Event) (watch, error) {
+	from := b.networkFor(e)
+	if from == nil {
+		return watch{}, errors.New("could not tell which network you are on")
+	}
+
+	id, err := from.lookupUser(e.Nick, identify(e))
+	if err != nil {
+		return watch{}, fmt.Errorf("could not look up your account: %w", err)
+	}
+
+	return watch{Network: n.name, Subscriber: e.Nick, From: from.name, Account: id.Account}, nil
+}
+
+func (b *bot) watch(n *network, e *irc.Event, args *commandArgs) *commandResult {
+	if e == nil {
+		return errorf("watch only works on IRC")
+	}
+
+	w, err := b.subscriber(n, e)
+	if err != nil {
+		return errorResult(err)
+	}
+
+	if !args.has("server") {
+		return b.listWatches(n, w)
+	}
+
+	via := args.str("via")
+	if via == "" {
+		via = watchViaPM
+	}
+
+	switch {
+	case !stringSliceContains(via, []string{watchViaPM, watchViaNotice, watchViaChannel}):
+		return errorf("--via must be one of %s, %s or %s", watchViaPM, watchViaNotice, watchViaChannel)
+	case via == watchViaChannel && b.cfg.Watch.Channel == "":
+		return errorf("no watch channel is configured")
+	}
+
+	w.Server, w.Via = args.str("server"), via
+
+	// Servers that are down right now can still be watched, for when they come back
+	res := newResult(&w)
+	if s, err := n.currentSnapshot(); err != nil {
+		res.warn("could not check %s exists: %s", w.Server, err)
+	} else if srv := s.topology().getServer(w.Server); srv != nil {
+		w.Server = srv.Name
+	} else {
+		res.warn("%s is not on %s right now", w.Server, n.name)
+	}
+
+	if err := b.watches.add(w); err != nil {
+		return errorf("could not save watch: %s", err)
+	}
+
+	res.text = []string{fmt.Sprintf(
+		"Watching %s on %s, alerts go to %s on %s by %s", w.Server, n.name, w.target(b.cfg.Watch.Channel), w.home(), via,
+	)}
+	return res
+}
+
+func (b *bot) unwatch(n *network, e *irc.Event, args *commandArgs) *commandResult {
+	if e == nil {
+		return errorf("unwatch only works on IRC")
+	}
+
+	owner, err := b.subscriber(n, e)
+	if err != nil {
+		return errorResult(err)
+	}
+
+	server := args.str("server")
+	removed, err := b.watches.remove(n.name, owner, server)
+	switch {
+	case err != nil:
+		return errorf("could not save watches: %s", err)
+	case removed == 0 && server != "":
+		return errorf("you are not watching %s on %s", server, n.name)
+	case removed == 0:
+		return errorf("you are not watching anything on %s", n.name)
+	case server == "":
+		return resultf(removed, "Stopped watching %d servers on %s", removed, n.name)
+	}
+
+	return resultf(removed, "Stopped watching %s on %s", server, n.name)
+}
+
+func (b *bot) listWatches(n *network, owner watch) *commandResult {
+	watches := b.watches.list(n.name, func(w watch) bool {
+		return w.ownedBy(owner.home(), owner.Subscriber, owner.Account)
+	})
+	if len(watches) == 0 {
+		return newResult(watches, fmt.Sprintf("You are not watching anything on %s", n.name))
+	}
+
+	names := []string{}
+	for _, w := range watches {
+		names = append(names, fmt.Sprintf("%s (%s)", w.Server, w.Via))
+	}
+
+	sort.Strings(names)
+	return resultf(watches, "Watching on %s: %s", n.name, strings.Join(names, ", "))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestWatchOtherNetwork(t *testing.T) {
+	silenceLog(t)
+	d, d2 := newFakeIRCd(t), newFakeIRCd(t)
+
+	cfg := testConfig(t, d.addr(), func(cfg *config) {
+		cfg.Permissions.Rules = append(defaultACLRules(),
+			aclRule{Command: "watch", Roles: []string{roleEveryone}},
+			aclRule{Command: "unwatch", Roles: []string{roleEveryone}},
+		)
+	})
+
+	md, err := toml.Decode(fmt.Sprintf(`
+[networks.default.irc]
+server = %q
+oper = {name = "graphbot", password = "hunter2"}
+
+[networks.other.irc]
+server = %q
+oper = {name = "graphbot", password = "hunter2"}
+`, d.addr(), d2.addr()), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cfg.resolveNetworks(md); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewBot(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, _ := connectTestNetwork(t, d, b.networks[defaultNetworkName])
+	connectTestNetwork(t, d2, b.networks["other"])
+
+	d.addUser("dragon", fakeUser{account: "A_Dragon"})
+	c.privmsg("dragon!dragon@user.host", "graphbot", "~watch leaf1.test.net --net other")
+	if got := d.waitForPrivmsg("dragon"); !strings.Contains(got, "alerts go to dragon on default") {
+		t.Fatalf("watch: got %q", got)
+	}
+
+	// leaf1 leaves other, and the alert goes to dragon where they asked for it
+	d2.setNetwork(append(testServers[:1:1], testServers[2:]...), testLinks[1:])
+	if _, err := b.networks["other"].refreshSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := d.waitForPrivmsg("dragon"); !strings.Contains(got, "Watch on other: leaf1.test.net") {
+		t.Errorf("alert: got %q", got)
+	}
+
+	// eve takes the nick, and must not see or remove dragon's watch
+	c.send(":dragon!dragon@user.host NICK dragon_")
+	c.send(":eve!eve@user.host NICK dragon")
+	d.addUser("dragon", fakeUser{account: "eve"})
+
+	c.privmsg("dragon!eve@user.host", "graphbot", "~unwatch leaf1.test.net --net other")
+	if got := d.waitForPrivmsg("dragon"); !strings.Contains(got, "you are not watching leaf1.test.net on other") {
+		t.Errorf("unwatch by eve: got %q", got)
+	}
+
+	if w := b.watches.list("other", func(watch) bool { return true }); len(w) != 1 || w[0].Account != "A_Dragon" {
+		t.Errorf("watches after eve's unwatch: %+v", w)
+	}
+}